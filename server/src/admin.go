@@ -0,0 +1,269 @@
+/**
+ (C) Sheer Industries Group
+
+  Administrative subcommands. They work offline, against the -store directory:
+
+  user list
+  user add <login> <password> [full name]
+  user remove <login>
+  user passwd <login> <password>
+  user quota <login> <renders> <storage MB>
+  user limits <login> <width> <height> <haltspp> | default
+  du [login ...]
+  usage [from [to]]
+  node list
+  node add <name>
+  node remove <name>
+  hook list
+  hook listen <port> [secret]
+  verify
+
+*/
+
+package main
+
+import (
+	"cloud"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const admin_usage = `Subcommands:
+  user list
+  user add <login> <password> [full name]
+  user remove <login>
+  user passwd <login> <password>
+  user quota <login> <renders> <storage MB>
+  user limits <login> <width> <height> <haltspp>
+                           bounds render overrides, 0 for no limit
+  user limits <login> default
+  du [login ...]
+  usage [from [to]]        CSV report, days as YYYY-MM-DD
+  node list
+  node add <name>          prints the token the render node needs
+  node remove <name>
+  hook list
+  hook listen <port> [secret]
+                           prints webhook deliveries, checking them with the secret
+  verify
+`
+
+// AdminError is reported when a subcommand is misused.
+type AdminError string
+
+func (a AdminError) Error() string {
+	return string(a)
+}
+
+// admin runs a subcommand against the store.
+func admin(store string, args []string) error {
+	cfg := cloud.OpenConfig(store)
+
+	need := func(n int) error {
+		if len(args) < n {
+			return AdminError("Not enough arguments for " + strings.Join(args, " ") + "\n" + admin_usage)
+		}
+		return nil
+	}
+
+	save := func(err error) error {
+		if err != nil {
+			return err
+		}
+		return cfg.SaveMembers()
+	}
+
+	if err := need(1); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "user":
+		if err := need(2); err != nil {
+			return err
+		}
+		switch args[1] {
+		case "list":
+			for _, login := range cfg.MemberLogins() {
+				mbr := cfg.GetUser(login)
+				fmt.Printf("%s\t%s\trenders:%d\tstorage:%dMB\n", mbr.Login, mbr.FullName, mbr.Renders, mbr.Storage)
+			}
+			return nil
+		case "add":
+			if err := need(4); err != nil {
+				return err
+			}
+			name := strings.Join(args[4:], " ")
+			if name == "" {
+				name = args[2]
+			}
+			return save(cfg.AddMember(cloud.Member{FullName: name, Login: args[2], Password: args[3]}))
+		case "remove":
+			if err := need(3); err != nil {
+				return err
+			}
+			return save(cfg.RemoveMember(args[2]))
+		case "passwd":
+			if err := need(4); err != nil {
+				return err
+			}
+			return save(cfg.SetPassword(args[2], args[3]))
+		case "quota":
+			if err := need(5); err != nil {
+				return err
+			}
+			renders, err := strconv.Atoi(args[3])
+			if err != nil {
+				return err
+			}
+			storage, err := strconv.Atoi(args[4])
+			if err != nil {
+				return err
+			}
+			return save(cfg.SetQuota(args[2], renders, storage))
+		case "limits":
+			if len(args) == 4 && args[3] == "default" {
+				return save(cfg.SetLimits(args[2], nil))
+			}
+			if err := need(6); err != nil {
+				return err
+			}
+			limits := [3]int{}
+			for i := range limits {
+				n, err := strconv.Atoi(args[3+i])
+				if err != nil {
+					return err
+				}
+				limits[i] = n
+			}
+			return save(cfg.SetLimits(args[2], &cloud.RenderLimits{Width: limits[0], Height: limits[1], HaltSPP: limits[2]}))
+		}
+	case "du":
+		logins := args[1:]
+		if len(logins) == 0 {
+			logins = cfg.MemberLogins()
+		}
+		for _, login := range logins {
+			bytes, files, err := cfg.DiskUsage(login)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%d bytes\t%d files\tquota:%dMB\n", login, bytes, files, cfg.GetUser(login).Storage)
+		}
+		return nil
+	case "usage":
+		from, to := "", ""
+		if len(args) > 1 {
+			from = args[1]
+		}
+		if len(args) > 2 {
+			to = args[2]
+		}
+		start, end, err := cloud.ParseUsageRange(from, to)
+		if err != nil {
+			return err
+		}
+		rows, err := cfg.Usage(start, end, "")
+		if err != nil {
+			return err
+		}
+		return cloud.WriteUsageCSV(os.Stdout, rows)
+	case "node":
+		if err := need(2); err != nil {
+			return err
+		}
+		nodes := cfg.Nodes()
+		switch args[1] {
+		case "list":
+			all, err := nodes.List()
+			if err != nil {
+				return err
+			}
+			for _, node := range all {
+				fmt.Printf("%s\thost:%s\tslots:%d\tseen:%s\n", node.Name, node.Host, node.Slots, node.Seen.Format(time.RFC3339))
+			}
+			return nil
+		case "add":
+			if err := need(3); err != nil {
+				return err
+			}
+			node, err := nodes.Add(args[2])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%s\n", node.Name, node.Token)
+			return nil
+		case "remove":
+			if err := need(3); err != nil {
+				return err
+			}
+			return nodes.Remove(args[2])
+		}
+	case "hook":
+		if err := need(2); err != nil {
+			return err
+		}
+		switch args[1] {
+		case "list":
+			all, err := cfg.Hooks().List("")
+			if err != nil {
+				return err
+			}
+			for _, hook := range all {
+				fmt.Printf("%s\t%s\t%s\t%v\n", hook.ID, hook.Owner, hook.URL, hook.Events)
+			}
+			return nil
+		case "listen":
+			if err := need(3); err != nil {
+				return err
+			}
+			secret := ""
+			if len(args) > 3 {
+				secret = args[3]
+			}
+			return http.ListenAndServe(":"+args[2], hook_listener(secret))
+		}
+	case "verify":
+		problems := cfg.Verify()
+		for _, problem := range problems {
+			fmt.Println(problem.Error())
+		}
+		if len(problems) > 0 {
+			return AdminError(fmt.Sprintf("%d problems found in %s", len(problems), store))
+		}
+		fmt.Println("Store " + store + " is consistent")
+		return nil
+	}
+
+	fmt.Fprint(os.Stderr, admin_usage)
+	return AdminError("Unknown subcommand: " + strings.Join(args, " "))
+}
+
+// hook_listener stands in for a webhook receiver: it prints what is delivered.
+func hook_listener(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signature := r.Header.Get(cloud.HookSignatureHeader)
+		check := "unchecked"
+		if secret != "" {
+			check = "bad signature"
+			if cloud.VerifyHook(secret, body, signature) {
+				check = "signed"
+			}
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n%s\n", time.Now().Format(time.RFC3339),
+			r.Header.Get(cloud.HookDeliveryHeader), r.Header.Get(cloud.HookEventHeader), check, body)
+		if check == "bad signature" {
+			http.Error(w, check, http.StatusForbidden)
+		}
+	}
+}
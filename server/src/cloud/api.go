@@ -74,7 +74,7 @@ func init() {
 }
 
 func GenerateSessionID() SessionID {
-	return SessionID(fmt.Sprintf("%s", rand.Int()))
+	return SessionID(fmt.Sprintf("%d", rand.Int()))
 }
 
 func (a SessionID) GetInfo() *SessionInfo {
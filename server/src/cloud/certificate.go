@@ -0,0 +1,92 @@
+package cloud
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+// certificate_lifetime is how long a generated certificate stays valid.
+const certificate_lifetime = 5 * 365 * 24 * time.Hour
+
+// EnsureCertificate generates a self-signed certificate unless both files exist already.
+func EnsureCertificate(cert_file, key_file string) error {
+	_, cert_err := os.Stat(cert_file)
+	_, key_err := os.Stat(key_file)
+	if cert_err == nil && key_err == nil {
+		return nil
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	Log("Generating self-signed certificate " + cert_file)
+	return GenerateCertificate(cert_file, key_file, hosts)
+}
+
+// GenerateCertificate writes a self-signed certificate for the hosts and its key in PEM format.
+// It is meant for on-premises installations, where clients are told to trust it explicitly.
+func GenerateCertificate(cert_file, key_file string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Sheer Industries Cloud"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certificate_lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	write_pem := func(where, kind string, data []byte, mode os.FileMode) error {
+		if err := os.MkdirAll(path.Dir(where), 0777); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(where, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return pem.Encode(f, &pem.Block{Type: kind, Bytes: data})
+	}
+
+	if err := write_pem(cert_file, "CERTIFICATE", der, 0666); err != nil {
+		return err
+	}
+	return write_pem(key_file, "EC PRIVATE KEY", key_der, 0600)
+}
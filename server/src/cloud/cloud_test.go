@@ -1,9 +1,14 @@
 package cloud
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 var guys = Users{
@@ -31,7 +36,7 @@ func TestAddUser(t *testing.T) {
 }
 
 func TestUserLoading(t *testing.T) {
-	if Populate(guys); NumberOfUsers() != 4 {
+	if Populate(guys); NumberOfUsers() != len(TheCloud().TheMembers) { // All of them are members
 		t.Logf("Users: %v", ListUsers())
 		t.Error("Unexpected number of users")
 	}
@@ -58,16 +63,157 @@ func TestUserLoading(t *testing.T) {
 }
 
 func TestInitialConfig(t *testing.T) {
-	the_place := path.Join(os.TempDir(), "cloud")
+	defer publish(TheCloud())
+	the_place := path.Join(os.TempDir(), fmt.Sprintf("cloud%d", time.Now().UnixNano()))
+	os.MkdirAll(the_place, 0777)
+	defer os.RemoveAll(the_place)
+
+	// An older store, with its users in users.json
+	if err := ConfigWrite(path.Join(the_place, "users.json"), Users{User{Login: "legacy", Password: "old", Name: "Legacy"}}); err != nil {
+		t.Fatal(err)
+	}
 	Configure(the_place)
+	if user := GetUser("legacy", "old"); user == nil || TheCloud().GetUser("legacy") == nil {
+		t.Error("Users of users.json have to be taken over as members")
+	}
+	members := NumberOfUsers()
+	if members != len(TheCloud().TheMembers) {
+		t.Errorf("Logins %v do not match members %v", ListUsers(), TheCloud().MemberLogins())
+	}
+
 	AddUser(User{Login: "newer", Password: "secret", Name: "007"})
 	SaveUsers()
 	ResetUsers()
-	if Configure(the_place); NumberOfUsers() != 5 {
-		t.Errorf("Expected 4 users, got %d", NumberOfUsers())
+	if Configure(the_place); NumberOfUsers() != members+1 {
+		t.Errorf("Expected %d users, got %d", members+1, NumberOfUsers())
 	}
-
 	if user := GetUser("newer", "secret"); user == nil {
 		t.Error("user has to be present")
 	}
+
+	// What the admin subcommands save is what logins are checked against
+	offline := &CloudConfig{TheRoot: the_place}
+	if err := offline.LoadMembers(); err != nil {
+		t.Fatal(err)
+	}
+	if offline.SetPassword("newer", "changed") != nil || offline.SaveMembers() != nil {
+		t.Fatal("Changing the password offline")
+	}
+	if Configure(the_place); GetUser("newer", "secret") != nil || GetUser("newer", "changed") == nil {
+		t.Error("Password changed offline has to be used")
+	}
+}
+
+func TestMembersAdmin(t *testing.T) {
+	the_place := path.Join(os.TempDir(), "cloud_members")
+	os.RemoveAll(the_place)
+	a := &CloudConfig{TheRoot: the_place}
+	a.organize()
+
+	switch {
+	case a.AddMember(Member{FullName: "Tester", Login: "tester", Password: "pw"}) != nil:
+		t.Fatal("Adding a member")
+	case a.AddMember(Member{FullName: "Again", Login: "tester", Password: "pw"}) == nil:
+		t.Error("Duplicate member must be refused")
+	case a.AddMember(Member{Login: "../up", Password: "pw"}) == nil:
+		t.Error("Sneaky login must be refused")
+	case a.SetQuota("tester", 3, 10) != nil || a.SetPassword("tester", "new") != nil:
+		t.Error("Updating a member")
+	case a.SetPassword("nobody", "new") == nil:
+		t.Error("Unknown member must be reported")
+	}
+
+	if err := a.SaveMembers(); err != nil {
+		t.Fatal(err.Error())
+	}
+	b := &CloudConfig{TheRoot: the_place}
+	if err := b.LoadMembers(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if mbr := b.GetUser("tester"); mbr == nil || mbr.Password != "new" || mbr.Renders != 3 || mbr.Storage != 10 {
+		t.Errorf("Member was not restored: %v", b.TheMembers)
+	}
+
+	os.MkdirAll(b.GetRoot("tester"), 0777)
+	ioutil.WriteFile(b.GetOsPath("tester", "scene.xml.job"), []byte("."), 0666)
+	if used, files, err := b.DiskUsage("tester"); err != nil || used != 1 || files != 1 {
+		t.Errorf("Disk usage: %d bytes in %d files (%v)", used, files, err)
+	}
+	if problems := b.Verify(); len(problems) != 1 {
+		t.Errorf("Expected a single problem with the job marker, got %v", problems)
+	}
+
+	if b.RemoveMember("tester"); b.GetUser("tester") != nil {
+		t.Error("Member was not removed")
+	}
+}
+
+func TestUsageReport(t *testing.T) {
+	the_place := path.Join(os.TempDir(), fmt.Sprintf("cloud_usage%d", time.Now().UnixNano()))
+	a := &CloudConfig{TheRoot: the_place, TheMembers: []Member{Member{"Tester", "tester", "pw", 0, 0, nil}}}
+	a.organize()
+
+	os.MkdirAll(a.GetOsPath("tester", "house"), 0777)
+	ioutil.WriteFile(a.GetOsPath("tester", "house/scene.xml"), []byte("12345"), 0666)
+
+	a.RecordUsage("tester", "house/scene.xml", UsageUploaded, 5)
+	a.RecordStored("tester", "house/scene.xml")
+	a.RecordUsage("tester", "house/scene.xml", UsageDownloaded, 5)
+	a.RecordUsage("tester", "house/scene.xml.png", UsageRender, 1.5)
+	a.RecordUsage("tester", "loose.txt", UsageUploaded, 3)
+	os.MkdirAll(a.GetOsPath("tester", "Projects/Kitchen/Designer"), 0777)
+	ioutil.WriteFile(a.GetOsPath("tester", "Projects/Kitchen/Designer/kitchen.osgt"), []byte("1234567"), 0666)
+	a.RecordStored("tester", "Projects/Kitchen/Designer/kitchen.osgt")
+
+	for user_path, project := range map[string]string{"Projects/Kitchen/Designer/kitchen.osgt": "Kitchen", "Projects/notes.txt": no_project,
+		"CSLibrairies/Models/Chair.obj": "CSLibrairies", "loose.txt": no_project} {
+		if got := ProjectOf(user_path); got != project {
+			t.Errorf("Project of %s should be %s, got %s", user_path, project, got)
+		}
+	}
+
+	if login, user_path, ok := a.Owner(a.GetOsPath("tester", "house/scene.xml")); !ok || login != "tester" || user_path != "house/scene.xml" {
+		t.Errorf("Owner resolved to %s %s", login, user_path)
+	}
+
+	from, to, err := ParseUsageRange(time.Now().AddDate(0, 0, -1).Format("2006-01-02"), "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rows, err := a.Usage(from, to, "tester")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var house, kitchen *UsageReport
+	for i := range rows {
+		if rows[i].Day != time.Now().Format("2006-01-02") {
+			continue
+		}
+		switch rows[i].Project {
+		case "house":
+			house = &rows[i]
+		case "Kitchen":
+			kitchen = &rows[i]
+		}
+	}
+	switch {
+	case house == nil || kitchen == nil:
+		t.Fatalf("No usage for the projects: %v", rows)
+	case house.BytesStored != 5 || house.BytesUploaded != 5 || house.BytesDownloaded != 5 || house.RenderSeconds != 1.5:
+		t.Errorf("Wrong usage: %#v", *house)
+	case kitchen.BytesStored != 7:
+		t.Errorf("The project folder under Projects should be accounted: %#v", *kitchen)
+	case len(rows) != 3:
+		t.Errorf("Expected projects and loose files: %v", rows)
+	}
+
+	csv := &bytes.Buffer{}
+	if err := WriteUsageCSV(csv, rows); err != nil || !strings.Contains(csv.String(), ",tester,house,5,5,5,1.5") {
+		t.Errorf("CSV export: %s (%v)", csv.String(), err)
+	}
+
+	if _, _, err := ParseUsageRange("2014-01-02", "2014-01-01"); err == nil {
+		t.Error("Inverted range must be refused")
+	}
 }
@@ -5,7 +5,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
 )
 
 // Not needed
@@ -14,47 +13,20 @@ func unused_init() {
 	Configure(tmpdir + "/store")
 }
 
-const users_config = "users.json"
 
+// Configure points the cloud to the store. Members, and the logins they authenticate with,
+// come from its members file; a users.json of older stores is taken over once.
 func Configure(where string) {
-
-
-//	var err error
-	// Create filestore from the location
-/*	theCloud, err = NewFileStore(where)
-	if err != nil {
-		panic(err.Error())
-	}
-  */
-	TheCloud().TheRoot = where;
+	OpenConfig(where)
 	log.Printf("Setting path to [%s]", where);
-	// Populate users
-	users_place := path.Join(TheCloud().TheRoot, users_config)
-
-	old_guys := Users{} // Where to try to load
-
-	if err := ConfigRead(users_place, &old_guys); err != nil {
-		log.Printf("Failed to load config [%s]; generating default.", err.Error())
-		Populate(test_guys)
-		ConfigBackup(users_place)
-		if err = ConfigWrite(users_place, DumpUsers()); err != nil {
-			log.Printf("Failed to generate default config [%s].", err.Error())
-		}
-	} else { // Got the old_guys
-		Populate(old_guys)
-	}
 }
 
+// SaveUsers keeps the users added at run time as members, in the members file.
 func SaveUsers() {
-	users_place := path.Join(path.Join(TheCloud().TheRoot, users_config))
-
-	saved_guys := Users{}
-	for _, user := range by_login {
-		saved_guys = append(saved_guys, user)
-	}
-	ConfigBackup(users_place)
-	if err := ConfigWrite(users_place, saved_guys); err != nil {
-		log.Print("Failed to save users [%s]", err.Error())
+	a := TheCloud()
+	a.merge_users(DumpUsers())
+	if err := a.SaveMembers(); err != nil {
+		log.Printf("Failed to save users [%s]", err.Error())
 	}
 }
 
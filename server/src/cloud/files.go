@@ -233,15 +233,15 @@ func (store *FileStore) Sync() {
 		return
 	}
 
+	// Remove and Link note their changes in meta_queue from queue, so it goes first.
 	store.queue <- fn
-	store.meta_queue <- fn
-
 	<-done
+	store.meta_queue <- fn
 	<-done
 	return
 }
 
 func (store *FileStore) Test(name CloudPath) int {
-	fmt.Println("%v", name)
+	fmt.Printf("%v\n", name)
 	return len(name)
 }
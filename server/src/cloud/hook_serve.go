@@ -0,0 +1,75 @@
+package cloud
+
+import (
+	"net/http"
+)
+
+// ApiHookReply is what /hooks/add sends; the secret is only ever told then.
+type ApiHookReply struct {
+	ApiStatus
+	Hook *Hook
+}
+
+// ApiHookList is what /hooks/list sends.
+type ApiHookList struct {
+	ApiStatus
+	Hooks []*Hook
+}
+
+// ApiHookLog is what /hooks/log sends.
+type ApiHookLog struct {
+	ApiStatus
+	Deliveries []*HookDelivery
+}
+
+// hook_log_size limits the deliveries /hooks/log sends.
+const hook_log_size = 100
+
+// worker_hook_add subscribes url to the events given as event=...&event=..., or to all of them.
+func worker_hook_add(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	events := []HookEvent{}
+	for _, name := range r.URL.Query()["event"] {
+		event, err := ParseHookEvent(name)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+	}
+	hook, err := TheCloud().Hooks().Add(info.Who, r.URL.Query().Get("url"), events)
+	if err != nil {
+		return err
+	}
+	return send_json(w, &ApiHookReply{ApiStatus{true, "OK"}, hook})
+}
+
+// worker_hook_list sends the hooks of the member, without their secrets.
+func worker_hook_list(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	hooks, err := TheCloud().Hooks().List(info.Who)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+	return send_json(w, &ApiHookList{ApiStatus{true, "OK"}, hooks})
+}
+
+// worker_hook_remove unsubscribes the hook given by id.
+func worker_hook_remove(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	if err := TheCloud().Hooks().Remove(info.Who, r.URL.Query().Get("id")); err != nil {
+		return err
+	}
+	return send_OK(w)
+}
+
+// worker_hook_log sends the latest deliveries of the member, or of its hook given by id.
+func worker_hook_log(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	deliveries, err := TheCloud().Hooks().Deliveries(info.Who, r.URL.Query().Get("id"))
+	if err != nil {
+		return err
+	}
+	if len(deliveries) > hook_log_size {
+		deliveries = deliveries[:hook_log_size]
+	}
+	return send_json(w, &ApiHookLog{ApiStatus{true, "OK"}, deliveries})
+}
@@ -0,0 +1,587 @@
+package cloud
+
+/*
+
+  Webhooks.
+
+  Members subscribe URLs to events of their jobs and files. Each event
+  becomes a delivery record in .hooks/pending/ at the root of the store,
+  so the scanner, which finishes jobs in its own process, queues them just
+  as the server does. The server posts the JSON payload, signed with the
+  secret of the hook, to all the hooks at once, and retries failed
+  deliveries with back-off. Finished deliveries are moved to
+  .hooks/deliveries/ and stay around for a while as the delivery log.
+
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// HookEvent names what happened.
+type HookEvent string
+
+const (
+	EventJobFinished  HookEvent = "job.finished" // Succeeded or cancelled.
+	EventJobFailed    HookEvent = "job.failed"
+	EventFileUploaded HookEvent = "file.uploaded"
+	EventFileDeleted  HookEvent = "file.deleted"
+)
+
+// HookEvents are all the events a hook may subscribe to.
+var HookEvents = []HookEvent{EventJobFinished, EventJobFailed, EventFileUploaded, EventFileDeleted}
+
+// ParseHookEvent checks the name of an event.
+func ParseHookEvent(some string) (HookEvent, error) {
+	for _, event := range HookEvents {
+		if string(event) == some {
+			return event, nil
+		}
+	}
+	return "", &CloudError{"Unknown event: " + some}
+}
+
+// Hook is a URL of a member subscribed to events.
+type Hook struct {
+	ID     string
+	Owner  string
+	URL    string
+	Secret string      // Key of the HMAC signature of the payloads.
+	Events []HookEvent // All of them when empty.
+
+	Created time.Time
+}
+
+// Wants tells if the hook is subscribed to the event.
+func (a *Hook) Wants(event HookEvent) bool {
+	if len(a.Events) == 0 {
+		return true
+	}
+	for _, wanted := range a.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// HookPayload is the JSON posted to a hook.
+type HookPayload struct {
+	Delivery string
+	Event    HookEvent
+	Owner    string
+	Time     time.Time
+	Job      *Job   `json:",omitempty"`
+	Path     string `json:",omitempty"` // User path of a file event.
+}
+
+// DeliveryState is where a delivery is in its life.
+type DeliveryState string
+
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+// HookDelivery is a payload on its way to a hook, and then its entry in the delivery log.
+type HookDelivery struct {
+	ID    string
+	Hook  string
+	Owner string
+	URL   string
+	Event HookEvent
+	Body  json.RawMessage // Signed as it is, so it is kept as it is.
+
+	State    DeliveryState
+	Attempts int
+	Status   int // HTTP status of the last attempt, 0 when there was no reply.
+	Error    string
+
+	Created, NextTry, Finished time.Time
+}
+
+// Header names of the deliveries.
+const (
+	HookSignatureHeader = "X-Cloud-Signature"
+	HookEventHeader     = "X-Cloud-Event"
+	HookDeliveryHeader  = "X-Cloud-Delivery"
+)
+
+const hooks_dir = ".hooks"
+const hooks_config = "hooks.json"
+const deliveries_dir = "deliveries"
+const pending_dir = "pending"
+
+// HookRetry is how failed deliveries are retried.
+var HookRetry = RetryPolicy{Attempts: 12, Backoff: 30 * time.Second, Factor: 2, MaxBackoff: time.Hour}
+
+// HookTimeout bounds a single delivery.
+var HookTimeout = 10 * time.Second
+
+// HookPoll is how often the server looks for deliveries to make.
+var HookPoll = time.Second
+
+// HookPrivate lets hooks post to loopback, link-local and private addresses, such as a service
+// next to an on-premises server. Otherwise members could reach into the network of the server.
+var HookPrivate = false
+
+// HookLogAge is how long finished deliveries are kept in the log.
+var HookLogAge = 7 * 24 * time.Hour
+
+// HookPrune is how often the log is looked through for deliveries older than HookLogAge.
+var HookPrune = time.Hour
+
+// hooks_lock serializes changes of the hook list, delivering_lock the delivery passes.
+var hooks_lock, delivering_lock sync.Mutex
+
+// pruned tells when the log of each store was last pruned; delivering_lock guards it.
+var pruned = map[string]time.Time{}
+
+// HookStore keeps the webhooks of a cloud and their deliveries.
+type HookStore struct {
+	cfg *CloudConfig
+}
+
+// Hooks gives access to the webhooks of the store.
+func (a *CloudConfig) Hooks() *HookStore {
+	return &HookStore{a}
+}
+
+func (a *HookStore) place() string {
+	return path.Join(a.cfg.TheRoot, hooks_dir)
+}
+
+func (a *HookStore) log_place() string {
+	return path.Join(a.place(), deliveries_dir)
+}
+
+func (a *HookStore) delivery(id string) string {
+	return path.Join(a.log_place(), id+".json")
+}
+
+func (a *HookStore) pending_place() string {
+	return path.Join(a.place(), pending_dir)
+}
+
+func (a *HookStore) pending(id string) string {
+	return path.Join(a.pending_place(), id+".json")
+}
+
+// save_atomic writes a record so readers never see it half-written.
+func save_atomic(place string, what interface{}) error {
+	if err := os.MkdirAll(path.Dir(place), 0777); err != nil {
+		return err
+	}
+	temp := place + ".tmp"
+	if err := Save(temp, what); err != nil {
+		return err
+	}
+	return os.Rename(temp, place)
+}
+
+func new_hook_id() string {
+	return fmt.Sprintf("%d%04d", time.Now().UnixNano(), mrand.Intn(10000))
+}
+
+// List returns the hooks of the member, or all of them for an empty owner.
+func (a *HookStore) List(owner string) ([]*Hook, error) {
+	hooks := []*Hook{}
+	if err := Load(path.Join(a.place(), hooks_config), &hooks); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if owner == "" {
+		return hooks, nil
+	}
+	own := []*Hook{}
+	for _, hook := range hooks {
+		if hook.Owner == owner {
+			own = append(own, hook)
+		}
+	}
+	return own, nil
+}
+
+// update changes the hook list under the lock.
+func (a *HookStore) update(change func([]*Hook) ([]*Hook, error)) error {
+	hooks_lock.Lock()
+	defer hooks_lock.Unlock()
+
+	hooks, err := a.List("")
+	if err != nil {
+		return err
+	}
+	if hooks, err = change(hooks); err != nil {
+		return err
+	}
+	return save_atomic(path.Join(a.place(), hooks_config), hooks)
+}
+
+// Add subscribes the URL to the events, or to all of them, with a fresh secret.
+func (a *HookStore) Add(owner, target string, events []HookEvent) (*Hook, error) {
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, &CloudError{"Hook URL must be http or https: " + target}
+	}
+	if err := check_hook_host(parsed.Hostname(), HookPrivate); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	hook := &Hook{ID: new_hook_id(), Owner: owner, URL: target, Secret: hex.EncodeToString(secret),
+		Events: events, Created: time.Now()}
+	err = a.update(func(hooks []*Hook) ([]*Hook, error) {
+		return append(hooks, hook), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	Log(fmt.Sprintf("Hook %s of %s added for %s", hook.ID, owner, target))
+	return hook, nil
+}
+
+// Remove unsubscribes a hook of the member.
+func (a *HookStore) Remove(owner, id string) error {
+	return a.update(func(hooks []*Hook) ([]*Hook, error) {
+		for i, hook := range hooks {
+			if hook.ID == id && hook.Owner == owner {
+				return append(hooks[:i], hooks[i+1:]...), nil
+			}
+		}
+		return nil, &CloudError{"No such hook: " + id}
+	})
+}
+
+// get finds a hook by id.
+func (a *HookStore) get(id string) *Hook {
+	hooks, _ := a.List("")
+	for _, hook := range hooks {
+		if hook.ID == id {
+			return hook
+		}
+	}
+	return nil
+}
+
+// Fire queues the payload for every hook of its owner subscribed to its event.
+// Failures are only logged; events must never break what caused them.
+func (a *HookStore) Fire(payload HookPayload) {
+	hooks, err := a.List(payload.Owner)
+	if err != nil {
+		Log("Unable to read hooks: " + err.Error())
+		return
+	}
+	for _, hook := range hooks {
+		if !hook.Wants(payload.Event) {
+			continue
+		}
+		payload.Delivery, payload.Time = new_hook_id(), time.Now()
+		body, err := json.Marshal(&payload)
+		if err != nil {
+			Log("Unable to encode a hook payload: " + err.Error())
+			return
+		}
+		delivery := &HookDelivery{ID: payload.Delivery, Hook: hook.ID, Owner: hook.Owner, URL: hook.URL,
+			Event: payload.Event, Body: body, State: DeliveryPending, Created: payload.Time, NextTry: payload.Time}
+		if err := save_atomic(a.pending(delivery.ID), delivery); err != nil {
+			Log("Unable to queue a hook delivery: " + err.Error())
+		}
+	}
+}
+
+// FireJob queues the event of a job that has just finished.
+func (a *HookStore) FireJob(job *Job) {
+	event := EventJobFinished
+	if job.State == JobFailed {
+		event = EventJobFailed
+	}
+	a.Fire(HookPayload{Event: event, Owner: job.Owner, Job: job})
+}
+
+// Deliveries returns the pending deliveries and the log of the member, or all of them for an empty owner,
+// latest first. hook, when given, picks the deliveries of that hook only.
+func (a *HookStore) Deliveries(owner, hook string) ([]*HookDelivery, error) {
+	by_id := map[string]*HookDelivery{}
+	// A delivery finished meanwhile is in both, and the log has the last word.
+	for _, place := range []string{a.pending_place(), a.log_place()} {
+		some, err := read_deliveries(place)
+		if err != nil {
+			return nil, err
+		}
+		for _, delivery := range some {
+			if (owner == "" || delivery.Owner == owner) && (hook == "" || delivery.Hook == hook) {
+				by_id[delivery.ID] = delivery
+			}
+		}
+	}
+	deliveries := []*HookDelivery{}
+	for _, delivery := range by_id {
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Sort(deliveries_by_creation(deliveries))
+	return deliveries, nil
+}
+
+// read_deliveries loads the delivery records of a folder, oldest first.
+func read_deliveries(place string) ([]*HookDelivery, error) {
+	entries, err := ioutil.ReadDir(place)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*HookDelivery{}, nil
+		}
+		return nil, err
+	}
+	deliveries := []*HookDelivery{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		delivery := &HookDelivery{}
+		if err := Load(path.Join(place, entry.Name()), delivery); err != nil {
+			Log("Skipping hook delivery " + entry.Name() + ": " + err.Error())
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+type deliveries_by_creation []*HookDelivery
+
+func (a deliveries_by_creation) Len() int      { return len(a) }
+func (a deliveries_by_creation) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a deliveries_by_creation) Less(i, j int) bool {
+	if a[i].Created.Equal(a[j].Created) {
+		return a[i].ID > a[j].ID
+	}
+	return a[i].Created.After(a[j].Created)
+}
+
+// SignHook gives the signature header value of a body.
+func SignHook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyHook tells if the signature of a delivered body is right; receivers of hooks use it.
+func VerifyHook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignHook(secret, body)), []byte(signature))
+}
+
+// hook_refused tells if hooks may not post to the address; private ones are let through when asked.
+func hook_refused(ip net.IP, private bool) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	return !private && (ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate())
+}
+
+// check_hook_host makes sure that none of the addresses of the host is refused.
+func check_hook_host(host string, private bool) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return &CloudError{"Unable to resolve hook host " + host + ": " + err.Error()}
+	}
+	for _, ip := range ips {
+		if hook_refused(ip, private) {
+			return &CloudError{"Hook host " + host + " is not a public address"}
+		}
+	}
+	return nil
+}
+
+// hook_client posts the deliveries. Each address it connects to is checked again, redirects included,
+// as the host may resolve elsewhere by now.
+func hook_client(private bool) *http.Client {
+	dialer := &net.Dialer{Timeout: HookTimeout, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || hook_refused(ip, private) {
+			return &CloudError{"Hook address " + host + " is not a public address"}
+		}
+		return nil
+	}}
+	transport := &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true}
+	return &http.Client{Timeout: HookTimeout, Transport: transport}
+}
+
+// send makes one attempt at a delivery; hook is nil when it was removed.
+func send(hook *Hook, delivery *HookDelivery, web *http.Client) (int, error) {
+	if hook == nil {
+		return 0, &CloudError{"Hook was removed"}
+	}
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HookSignatureHeader, SignHook(hook.Secret, delivery.Body))
+	req.Header.Set(HookEventHeader, string(delivery.Event))
+	req.Header.Set(HookDeliveryHeader, delivery.ID)
+	resp, err := web.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, &CloudError{"Hook replied " + resp.Status}
+	}
+	return resp.StatusCode, nil
+}
+
+// attempt sends a delivery and records how it went: back in pending to be retried,
+// or in the log once it is finished. It tells if the delivery was made.
+func (a *HookStore) attempt(hook *Hook, delivery *HookDelivery, web *http.Client) bool {
+	status, err := send(hook, delivery, web)
+	delivery.Attempts, delivery.Status = delivery.Attempts+1, status
+	switch {
+	case err == nil:
+		delivery.State, delivery.Error, delivery.Finished = DeliveryDelivered, "", time.Now()
+	default:
+		delivery.Error = err.Error()
+		if wait, ok := HookRetry.Delay(delivery.Attempts); ok && hook != nil {
+			delivery.NextTry = time.Now().Add(wait)
+		} else {
+			delivery.State, delivery.Finished = DeliveryFailed, time.Now()
+		}
+	}
+	Log(fmt.Sprintf("Hook delivery %s of %s to %s: %s %s", delivery.ID, delivery.Event, delivery.URL, delivery.State, delivery.Error))
+
+	if delivery.State == DeliveryPending {
+		if err := save_atomic(a.pending(delivery.ID), delivery); err != nil {
+			Log("Unable to record a hook delivery: " + err.Error())
+		}
+	} else if err := save_atomic(a.delivery(delivery.ID), delivery); err != nil {
+		Log("Unable to record a hook delivery: " + err.Error())
+	} else {
+		os.Remove(a.pending(delivery.ID))
+	}
+	return delivery.State == DeliveryDelivered
+}
+
+// Deliver makes the pending deliveries that are due, once each; the hooks are sent to at once,
+// the deliveries of each hook in turn, until one fails: the rest wait for its retry.
+// Old entries of the log are forgotten now and then.
+// It returns how many were delivered.
+func (a *HookStore) Deliver() int {
+	delivering_lock.Lock()
+	defer delivering_lock.Unlock()
+
+	a.prune()
+	pending, err := read_deliveries(a.pending_place())
+	if err != nil {
+		Log("Unable to read hook deliveries: " + err.Error())
+		return 0
+	}
+	hooks, err := a.List("")
+	if err != nil {
+		Log("Unable to read hooks: " + err.Error())
+		return 0
+	}
+	by_id := map[string]*Hook{}
+	for _, hook := range hooks {
+		by_id[hook.ID] = hook
+	}
+	due := map[string][]*HookDelivery{}
+	for _, delivery := range pending {
+		if _, err := os.Stat(a.delivery(delivery.ID)); err == nil {
+			os.Remove(a.pending(delivery.ID)) // Finished, but not yet removed.
+			continue
+		}
+		if !time.Now().Before(delivery.NextTry) {
+			due[delivery.Hook] = append(due[delivery.Hook], delivery)
+		}
+	}
+
+	web := hook_client(HookPrivate)
+	var sending sync.WaitGroup
+	var counting sync.Mutex
+	delivered := 0
+	for id, deliveries := range due {
+		sending.Add(1)
+		go func(hook *Hook, deliveries []*HookDelivery) {
+			defer sending.Done()
+			for i, delivery := range deliveries {
+				if a.attempt(hook, delivery, web) {
+					counting.Lock()
+					delivered++
+					counting.Unlock()
+				} else if hook != nil {
+					// The hook is likely down; its other deliveries would only hold up the pass.
+					a.postpone(deliveries[i+1:], delivery)
+					return
+				}
+			}
+		}(by_id[id], deliveries)
+	}
+	sending.Wait()
+	return delivered
+}
+
+// postpone puts off deliveries until failed, made to the same hook, is retried,
+// or the first backoff when failed was given up. They are not attempted, so not counted.
+func (a *HookStore) postpone(deliveries []*HookDelivery, failed *HookDelivery) {
+	next := failed.NextTry
+	if failed.State != DeliveryPending {
+		next = time.Now().Add(HookRetry.Backoff)
+	}
+	for _, delivery := range deliveries {
+		delivery.NextTry = next
+		if err := save_atomic(a.pending(delivery.ID), delivery); err != nil {
+			Log("Unable to record a hook delivery: " + err.Error())
+		}
+	}
+}
+
+// prune forgets deliveries finished more than HookLogAge ago, at most every HookPrune.
+func (a *HookStore) prune() {
+	if time.Since(pruned[a.place()]) < HookPrune {
+		return
+	}
+	pruned[a.place()] = time.Now()
+	entries, err := ioutil.ReadDir(a.log_place())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// Records are written for the last time when they are finished.
+		if strings.HasSuffix(entry.Name(), ".json") && time.Since(entry.ModTime()) > HookLogAge {
+			os.Remove(path.Join(a.log_place(), entry.Name()))
+		}
+	}
+}
+
+// dispatching starts Dispatch and Watch once, however many servers the process runs.
+var dispatching sync.Once
+
+// Dispatch delivers webhooks of the store as they come; the server runs it.
+func (a *HookStore) Dispatch() {
+	for {
+		a.Deliver()
+		time.Sleep(HookPoll)
+	}
+}
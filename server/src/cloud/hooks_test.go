@@ -0,0 +1,258 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hook_receiver stands in for the server of a hook; it fails the first failures requests.
+type hook_receiver struct {
+	lock     sync.Mutex
+	failures int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (a *hook_receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.failures > 0 {
+		a.failures--
+		http.Error(w, "Not now", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	a.bodies = append(a.bodies, body)
+	a.headers = append(a.headers, r.Header)
+}
+
+func (a *hook_receiver) received() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.bodies)
+}
+
+func TestHooks(t *testing.T) {
+	cfg, jobs := test_jobs(t)
+	hooks := cfg.Hooks()
+	receiver := &hook_receiver{failures: 1}
+	stand_in := httptest.NewServer(receiver)
+	defer stand_in.Close()
+
+	if _, err := hooks.Add("tester", "ftp://example.com", nil); err == nil {
+		t.Error("Only HTTP hooks are expected")
+	}
+	hook, err := hooks.Add("tester", stand_in.URL, []HookEvent{EventJobFailed})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hooks.Add("tester", stand_in.URL+"/all", nil)
+
+	retry := HookRetry
+	HookRetry = RetryPolicy{Attempts: 3}
+	defer func() { HookRetry = retry }()
+
+	job, _ := jobs.Submit("tester", "house/a.xml")
+	jobs.Cancel(job.ID)
+	job, _ = jobs.Submit("tester", "house/b.xml")
+	jobs.Claim("w")
+	jobs.Complete(job.ID, "w", JobReport{State: JobFailed, Error: "Bad scene"})
+
+	// Whichever hook fails first, the rest of its deliveries wait for the retry.
+	first := hooks.Deliver()
+	if first != 1 && first != 2 {
+		t.Errorf("One of three deliveries should fail first, %d made", first)
+	}
+	if delivered := hooks.Deliver(); first+delivered != 3 {
+		t.Errorf("Failed delivery should be retried, %d made", delivered)
+	}
+	if hooks.Deliver() != 0 || receiver.received() != 3 {
+		t.Errorf("Everything should be delivered once: %d", receiver.received())
+	}
+
+	for i, body := range receiver.bodies {
+		payload := HookPayload{}
+		if err := json.Unmarshal(body, &payload); err != nil || payload.Job == nil || payload.Owner != "tester" {
+			t.Errorf("Unexpected payload: %s %v", body, err)
+		}
+		header := receiver.headers[i]
+		if header.Get(HookEventHeader) != string(payload.Event) || header.Get(HookDeliveryHeader) != payload.Delivery {
+			t.Errorf("Headers should tell the event: %v", header)
+		}
+	}
+
+	log, _ := hooks.Deliveries("tester", hook.ID)
+	if len(log) != 1 || log[0].State != DeliveryDelivered || log[0].Event != EventJobFailed {
+		t.Fatalf("Only failures were asked for: %#v", log)
+	}
+	if !VerifyHook(hook.Secret, log[0].Body, SignHook(hook.Secret, log[0].Body)) || VerifyHook("wrong", log[0].Body, SignHook(hook.Secret, log[0].Body)) {
+		t.Error("Signature should check the secret")
+	}
+	if all, _ := hooks.Deliveries("tester", ""); all[0].Attempts+all[1].Attempts+all[2].Attempts != 4 {
+		t.Errorf("Attempts should be counted: %#v", all)
+	}
+
+	// Nobody listens any more.
+	stand_in.Close()
+	hooks.Fire(HookPayload{Event: EventFileDeleted, Owner: "tester", Path: "house/a.xml"})
+	for i := 0; i < 3; i++ {
+		hooks.Deliver()
+	}
+	if log, _ := hooks.Deliveries("tester", ""); log[0].State != DeliveryFailed || log[0].Attempts != 3 {
+		t.Errorf("Delivery should be given up: %#v", log[0])
+	}
+	if pending, _ := read_deliveries(hooks.pending_place()); len(pending) != 0 {
+		t.Errorf("Finished deliveries should be in the log only: %#v", pending)
+	}
+
+	age, prune := HookLogAge, HookPrune
+	HookLogAge, HookPrune = 0, 0
+	defer func() { HookLogAge, HookPrune = age, prune }()
+	hooks.Deliver()
+	if log, _ := hooks.Deliveries("", ""); len(log) != 0 {
+		t.Errorf("Old deliveries should be forgotten: %#v", log)
+	}
+}
+
+// slow_receiver takes its time with each delivery.
+type slow_receiver struct{}
+
+func (a slow_receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(300 * time.Millisecond)
+}
+
+func TestHookConcurrency(t *testing.T) {
+	cfg, _ := test_jobs(t)
+	hooks := cfg.Hooks()
+	stand_in := httptest.NewServer(slow_receiver{})
+	defer stand_in.Close()
+	for _, target := range []string{"/a", "/b", "/c"} {
+		hooks.Add("tester", stand_in.URL+target, nil)
+	}
+	hooks.Fire(HookPayload{Event: EventFileUploaded, Owner: "tester", Path: "house/a.xml"})
+	hooks.Fire(HookPayload{Event: EventFileDeleted, Owner: "tester", Path: "house/a.xml"})
+
+	started := time.Now()
+	if delivered := hooks.Deliver(); delivered != 6 {
+		t.Errorf("Expected all 6 deliveries, %d made", delivered)
+	}
+	if took := time.Since(started); took > 1500*time.Millisecond {
+		t.Errorf("Hooks should be sent to at once, it took %v", took)
+	}
+}
+
+// TestHookDown keeps a hook that does not answer from holding up the others.
+func TestHookDown(t *testing.T) {
+	cfg, _ := test_jobs(t)
+	hooks := cfg.Hooks()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		http.Error(w, "Down", http.StatusBadGateway)
+	}))
+	defer down.Close()
+	receiver := &hook_receiver{}
+	up := httptest.NewServer(receiver)
+	defer up.Close()
+	hooks.Add("tester", down.URL, nil)
+	hooks.Add("tester", up.URL, nil)
+
+	retry := HookRetry
+	HookRetry = RetryPolicy{Attempts: 3, Backoff: time.Minute}
+	defer func() { HookRetry = retry }()
+	for i := 0; i < 5; i++ {
+		hooks.Fire(HookPayload{Event: EventFileUploaded, Owner: "tester", Path: fmt.Sprintf("house/%d.xml", i)})
+	}
+
+	started := time.Now()
+	if delivered := hooks.Deliver(); delivered != 5 || receiver.received() != 5 {
+		t.Errorf("The hook that is up should get all 5 deliveries, %d made", delivered)
+	}
+	if took := time.Since(started); took > 900*time.Millisecond {
+		t.Errorf("The hook that is down should be given up on for the pass, it took %v", took)
+	}
+	pending, _ := read_deliveries(hooks.pending_place())
+	attempts := 0
+	for _, delivery := range pending {
+		attempts += delivery.Attempts
+		if time.Until(delivery.NextTry) < 30*time.Second {
+			t.Errorf("Deliveries to the hook that is down should wait for the retry: %#v", delivery)
+		}
+	}
+	if len(pending) != 5 || attempts != 1 {
+		t.Errorf("Only one delivery should be attempted, %d of %d", attempts, len(pending))
+	}
+}
+
+// TestHookPrivate keeps members from posting into the network of the server, unless it is let.
+func TestHookPrivate(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "localhost", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1", "fe80::1", "0.0.0.0"} {
+		if err := check_hook_host(host, false); err == nil {
+			t.Errorf("Hooks should not post to %s", host)
+		}
+	}
+	if err := check_hook_host("93.184.216.34", false); err != nil {
+		t.Errorf("Public addresses are for hooks: %v", err)
+	}
+	if err := check_hook_host("10.1.2.3", true); err != nil || check_hook_host("0.0.0.0", true) == nil {
+		t.Errorf("Private addresses may be let through, but not unspecified ones: %v", err)
+	}
+
+	// The host may resolve elsewhere by the time of the delivery.
+	receiver := &hook_receiver{}
+	stand_in := httptest.NewServer(receiver)
+	defer stand_in.Close()
+	delivery := &HookDelivery{ID: "1", URL: stand_in.URL, Event: EventFileUploaded, Body: []byte("{}")}
+	hook := &Hook{URL: stand_in.URL, Secret: "s"}
+	if _, err := send(hook, delivery, hook_client(false)); err == nil || receiver.received() != 0 {
+		t.Errorf("Delivery to the loopback should not be made: %v", err)
+	}
+	if _, err := send(hook, delivery, hook_client(true)); err != nil || receiver.received() != 1 {
+		t.Errorf("Delivery to the loopback should be made when let: %v", err)
+	}
+}
+
+func TestHookApi(t *testing.T) {
+	receiver := &hook_receiver{}
+	stand_in := httptest.NewServer(receiver)
+	defer stand_in.Close()
+
+	reply := ApiHookReply{}
+	if err := json.Unmarshal(good_guy.HookAdd(stand_in.URL, EventFileUploaded), &reply); err != nil || !reply.Success {
+		t.Fatalf("Adding a hook failed: %v %v", reply, err)
+	}
+	defer TheCloud().Hooks().Remove(good_guy.Login, reply.Hook.ID)
+	if bad := string(good_guy.HookAdd(stand_in.URL, "file.renamed")); !strings.Contains(bad, "FAIL") {
+		t.Errorf("Unknown events must be refused: %s", bad)
+	}
+
+	uploaded := fmt.Sprintf("hooked%d.txt", time.Now().UnixNano())
+	good_guy.Upload(uploaded, []byte("123"))
+	for tries := 0; tries < 50 && receiver.received() == 0; tries++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if receiver.received() != 1 {
+		t.Fatal("Upload should be delivered by the server")
+	}
+	if !VerifyHook(reply.Hook.Secret, receiver.bodies[0], receiver.headers[0].Get(HookSignatureHeader)) {
+		t.Error("Delivery should be signed")
+	}
+	if !strings.Contains(string(receiver.bodies[0]), uploaded) {
+		t.Errorf("Delivery should tell the file: %s", receiver.bodies[0])
+	}
+
+	log := ApiHookLog{}
+	json.Unmarshal(good_guy.HookLog(reply.Hook.ID), &log)
+	if len(log.Deliveries) != 1 || log.Deliveries[0].State != DeliveryDelivered {
+		t.Errorf("Delivery should be logged: %#v", log)
+	}
+	if other := string((Identity{"sheer/asd", "456"}).HookLog(reply.Hook.ID)); strings.Contains(other, uploaded) {
+		t.Errorf("Deliveries of others must not be shown: %s", other)
+	}
+}
@@ -1,43 +1,848 @@
 package cloud
 
+/*
+
+  Render jobs.
+
+  Each job is a JSON record in .jobs/ at the root of the store, so jobs
+  survive restarts of both the server and the scanner, which may run as
+  separate processes. A worker claims a queued job by creating its .claim
+  file and keeps the lease alive with heartbeats. Jobs whose lease has
+  expired are put back into the queue. Records are changed holding the
+  .lock file, so that the processes take turns.
+
+*/
+
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
 	"math/rand"
-	_ "os/exec"
+	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type JobID string
-type Result bool
 
-var jobs = make(map[JobID]Result)
+// JobState is where a job is in its life.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Final tells if nothing is going to happen to a job in this state.
+func (a JobState) Final() bool {
+	return a == JobSucceeded || a == JobFailed || a == JobCancelled
+}
+
+// JobPriority tells how soon the result of a job is wanted.
+type JobPriority string
+
+const (
+	PriorityPreview JobPriority = "preview" // Quick look; picked before final renders.
+	PriorityFinal   JobPriority = "final"
+)
+
+// ParsePriority reads a priority, final unless told otherwise.
+func ParsePriority(some string) (JobPriority, error) {
+	switch JobPriority(some) {
+	case "", PriorityFinal:
+		return PriorityFinal, nil
+	case PriorityPreview:
+		return PriorityPreview, nil
+	}
+	return PriorityFinal, &CloudError{"Priority is either preview or final: " + some}
+}
+
+// JobOptions are what the member asks for when submitting a job.
+type JobOptions struct {
+	Priority  JobPriority
+	TimeLimit float64        // Seconds of wall-clock time per attempt, 0 derives it from the scene.
+	Overrides RenderSettings // Of what the scene says.
+}
+
+// JobProgress is what the renderer reports while it works.
+type JobProgress struct {
+	Percent             float64
+	SamplesPerPixel     float64
+	HaltSamplesPerPixel int     // Target of the scene, 0 when not limited.
+	Elapsed, ETA        float64 // Seconds; ETA is 0 while unknown.
+	Errors, Warnings    []string
+	Updated             time.Time
+}
+
+// JobReport is how an attempt to render a job ended.
+type JobReport struct {
+	State      JobState
+	Error      string
+	Transient  bool // The failure may go away by itself, so the job is worth another try.
+	CPUSeconds float64
+	Progress   JobProgress
+	Settings   RenderSettings // What the renderer used, if it got that far.
+}
+
+// JobAttempt is the history of one try to render a job.
+type JobAttempt struct {
+	Worker            string
+	Started, Finished time.Time
+	JobReport
+}
+
+// RetryPolicy tells how transient failures are retried.
+type RetryPolicy struct {
+	Attempts   int           // At most, including the first one.
+	Backoff    time.Duration // Wait before the second attempt.
+	Factor     float64       // Growth of the wait with each further attempt.
+	MaxBackoff time.Duration
+}
+
+// Retry is the policy of this process; the server and the scanner set it from flags.
+var Retry = RetryPolicy{Attempts: 3, Backoff: time.Minute, Factor: 2, MaxBackoff: 30 * time.Minute}
+
+// Delay tells how long to wait after the given number of attempts, or false to give up.
+func (a RetryPolicy) Delay(attempts int) (time.Duration, bool) {
+	if attempts >= a.Attempts {
+		return 0, false
+	}
+	delay := float64(a.Backoff)
+	for i := 1; i < attempts; i++ {
+		delay *= a.Factor
+	}
+	if a.MaxBackoff > 0 && delay > float64(a.MaxBackoff) {
+		return a.MaxBackoff, true
+	}
+	return time.Duration(delay), true
+}
+
+// PNGOf is the .png luxconsole writes along with the picture; for a .png, the picture itself.
+func PNGOf(picture string) string {
+	return strings.TrimSuffix(picture, path.Ext(picture)) + ".png"
+}
+
+// Job is a durable record of a render request.
+type Job struct {
+	ID     JobID
+	Owner  string // Member login.
+	Scene  string // User path of the scene.
+	Output string // User path of the resulting image.
+	Log    string // User path of the renderer output.
+	Live   string // User path of the latest image while the job renders.
+	JobOptions
+	Pin    int // Set by admins: pinned jobs go first, lowest first; 0 is none.
+	State  JobState
+	Worker string
+	Error  string
+
+	// CancelRequested tells the worker to stop rendering.
+	CancelRequested bool
+
+	Progress   JobProgress
+	CPUSeconds float64
+	Attempts   []JobAttempt
+	Limits     RenderLimits   // Of the owner when the job was submitted.
+	Settings   RenderSettings // Used by the latest attempt.
+
+	Submitted, Started, Finished, Heartbeat time.Time
+	NotBefore                               time.Time // A retried job waits until then.
+}
+
+const jobs_dir = ".jobs"
+const claim_suffix = ".claim"
+const lock_file = ".lock"
+
+// jobs_wake is touched whenever a job becomes claimable, for workers in other processes.
+const jobs_wake = "queued"
+
+// JobLease is how long a running job survives without a heartbeat.
+var JobLease = 2 * time.Minute
+
+// jobs_lock serializes record updates within the process; the lock file does the same between processes.
+var jobs_lock sync.Mutex
+
+// JobLockStale is how old a lock file has to be to be taken as left by a process that went away.
+var JobLockStale = 10 * time.Second
 
 func init() {
 	rand.Seed(int64(time.Now().Nanosecond()))
 }
 
-func DoJob(file string) JobID {
-	id := JobID(fmt.Sprintf("[%d]", rand.Int()))
-	log.Printf("Rendering job %s started for %s", id, file)
-	jobs[id] = false
-	go func() {
-		if strings.Contains(file, "scene.txt") {
-			time.Sleep(time.Second)
+// JobStore keeps job records of a cloud.
+type JobStore struct {
+	cfg *CloudConfig
+}
+
+// Jobs gives access to the job records of the store.
+func (a *CloudConfig) Jobs() *JobStore {
+	return &JobStore{a}
+}
+
+func (a *JobStore) place() string {
+	return path.Join(a.cfg.TheRoot, jobs_dir)
+}
+
+func (a *JobStore) record(id JobID) string {
+	return path.Join(a.place(), string(id)+".json")
+}
+
+func (a *JobStore) claim(id JobID) string {
+	return path.Join(a.place(), string(id)+claim_suffix)
+}
+
+// locked runs change holding the locks of the records.
+func (a *JobStore) locked(change func() error) error {
+	jobs_lock.Lock()
+	defer jobs_lock.Unlock()
+
+	if err := os.MkdirAll(a.place(), 0777); err != nil {
+		return err
+	}
+	lock := path.Join(a.place(), lock_file)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > JobLockStale {
+			// Moved aside first, so that only one of those who found it stale removes it.
+			stale := fmt.Sprintf("%s.%d", lock, time.Now().UnixNano())
+			if os.Rename(lock, stale) == nil {
+				Log("Removing the stale lock of the jobs")
+				os.Remove(stale)
+			}
+			continue
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	defer os.Remove(lock)
+	return change()
+}
+
+// OsPath returns the location of a user path of the job.
+func (a *JobStore) OsPath(job *Job, user_path string) string {
+	return a.cfg.GetOsPath(job.Owner, user_path)
+}
+
+// save writes the record so readers never see it half-written.
+func (a *JobStore) save(job *Job) error {
+	if err := os.MkdirAll(a.place(), 0777); err != nil {
+		return err
+	}
+	temp := a.record(job.ID) + ".tmp"
+	if err := Save(temp, job); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, a.record(job.ID)); err != nil {
+		return err
+	}
+	stream.job_changed(job)
+	return nil
+}
+
+// Get reads a job record.
+func (a *JobStore) Get(id JobID) (*Job, error) {
+	if id == "" || strings.ContainsAny(string(id), "/\\.") {
+		return nil, &CloudError{"Unknown job"}
+	}
+	job := &Job{}
+	if err := Load(a.record(id), job); err != nil {
+		if os.IsNotExist(err) {
+			return nil, &CloudError{"Unknown job"}
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// List returns all the jobs, oldest first.
+func (a *JobStore) List() ([]*Job, error) {
+	entries, err := ioutil.ReadDir(a.place())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Job{}, nil
+		}
+		return nil, err
+	}
+	jobs := []*Job{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		if job, err := a.Get(JobID(strings.TrimSuffix(entry.Name(), ".json"))); err == nil {
+			jobs = append(jobs, job)
 		} else {
-			log.Print("10 seconds...")
-			time.Sleep(10 * time.Second)
+			Log("Skipping job record " + entry.Name() + ": " + err.Error())
+		}
+	}
+	sort.Sort(jobs_by_submission(jobs))
+	return jobs, nil
+}
+
+type jobs_by_submission []*Job
+
+func (a jobs_by_submission) Len() int      { return len(a) }
+func (a jobs_by_submission) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a jobs_by_submission) Less(i, j int) bool {
+	if a[i].Submitted.Equal(a[j].Submitted) {
+		return a[i].ID < a[j].ID
+	}
+	return a[i].Submitted.Before(a[j].Submitted)
+}
+
+// Active finds an unfinished job for the scene.
+func (a *JobStore) Active(owner, scene string) *Job {
+	jobs, _ := a.List()
+	for _, job := range jobs {
+		if job.Owner == owner && job.Scene == scene && !job.State.Final() {
+			return job
 		}
-		jobs[id] = true
-		log.Printf("Rendering job %s for %s completed", id, file)
-	}()
-	return id
+	}
+	return nil
+}
+
+// Latest finds the most recent job for the scene, finished or not.
+func (a *JobStore) Latest(owner, scene string) *Job {
+	jobs, _ := a.List()
+	for i := len(jobs) - 1; i >= 0; i-- {
+		if jobs[i].Owner == owner && jobs[i].Scene == scene {
+			return jobs[i]
+		}
+	}
+	return nil
+}
+
+// Submit queues a final render of the scene of the member.
+func (a *JobStore) Submit(owner, scene string) (*Job, error) {
+	return a.SubmitWith(owner, scene, JobOptions{Priority: PriorityFinal})
 }
 
-func JobDone(id JobID) (*Result, error) {
-	if r, ok := jobs[id]; ok {
-		return &r, nil
+// SubmitWith queues a render of the scene of the member as asked.
+// Overrides beyond the limits of the member are refused.
+func (a *JobStore) SubmitWith(owner, scene string, opt JobOptions) (*Job, error) {
+	limits := a.cfg.LimitsOf(owner)
+	if err := limits.Check(opt.Overrides); err != nil {
+		return nil, err
+	}
+	format := opt.Overrides.Format
+	if format == "" {
+		format = Formats[0]
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:         JobID(fmt.Sprintf("%d%04d", now.UnixNano(), rand.Intn(10000))),
+		Owner:      owner,
+		Scene:      scene,
+		Output:     scene + "." + format,
+		Log:        scene + JOB_OUTPUT_SUFFIX,
+		Live:       scene + JOB_LIVE_SUFFIX,
+		JobOptions: opt,
+		Limits:     limits,
+		State:      JobQueued,
+		Submitted:  now,
+	}
+	err := a.locked(func() error {
+		if active := a.Active(owner, scene); active != nil {
+			return &CloudError{"Job seems to be already submitted: " + string(active.ID)}
+		}
+		return a.save(job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	Log(fmt.Sprintf("Job %s queued for %s: %s (%s)", job.ID, owner, scene, opt.Priority))
+	a.wake()
+	return job, nil
+}
+
+// Update changes a job record under the locks, also against other processes.
+func (a *JobStore) Update(id JobID, change func(*Job) error) (*Job, error) {
+	var job *Job
+	err := a.locked(func() (err error) {
+		if job, err = a.Get(id); err != nil {
+			return err
+		}
+		if err = change(job); err != nil {
+			return err
+		}
+		return a.save(job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CompanyOf tells which company a login belongs to: sheer/abc is of sheer.
+func CompanyOf(login string) string {
+	return strings.SplitN(login, "/", 2)[0]
+}
+
+// Queue returns the queued jobs in the order they are going to be picked:
+//   - pinned by admins first;
+//   - then previews before final renders;
+//   - then the company, and within it the member, with the fewest running jobs
+//     for its share, a share being the Renders allowance of the member (at least 1);
+//   - then older jobs first.
+func (a *JobStore) Queue() ([]*Job, error) {
+	jobs, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+
+	share := func(login string) float64 {
+		if mbr := a.cfg.GetUser(login); mbr != nil && mbr.Renders > 1 {
+			return float64(mbr.Renders)
+		}
+		return 1
+	}
+
+	running, company_running := map[string]float64{}, map[string]float64{}
+	members, company_share := map[string]bool{}, map[string]float64{}
+	queued := []*Job{}
+	for _, job := range jobs {
+		switch job.State {
+		case JobRunning:
+			running[job.Owner]++
+			company_running[CompanyOf(job.Owner)]++
+		case JobQueued:
+			queued = append(queued, job)
+		default:
+			continue
+		}
+		if !members[job.Owner] {
+			members[job.Owner] = true
+			company_share[CompanyOf(job.Owner)] += share(job.Owner)
+		}
+	}
+
+	order := jobs_in_queue{queued, make([]queue_key, len(queued))}
+	for i, job := range queued {
+		company := CompanyOf(job.Owner)
+		order.keys[i] = queue_key{
+			pin:     job.Pin,
+			preview: job.Priority == PriorityPreview,
+			company: company_running[company] / company_share[company],
+			member:  running[job.Owner] / share(job.Owner),
+		}
+	}
+	sort.Stable(order)
+	return queued, nil
+}
+
+// queue_key is what decides the place of a job in the queue, besides its age.
+type queue_key struct {
+	pin             int
+	preview         bool
+	company, member float64
+}
+
+// jobs_in_queue sorts jobs, which are already oldest first, by their keys.
+type jobs_in_queue struct {
+	jobs []*Job
+	keys []queue_key
+}
+
+func (a jobs_in_queue) Len() int { return len(a.jobs) }
+func (a jobs_in_queue) Swap(i, j int) {
+	a.jobs[i], a.jobs[j] = a.jobs[j], a.jobs[i]
+	a.keys[i], a.keys[j] = a.keys[j], a.keys[i]
+}
+func (a jobs_in_queue) Less(i, j int) bool {
+	x, y := a.keys[i], a.keys[j]
+	switch {
+	case (x.pin > 0) != (y.pin > 0):
+		return x.pin > 0
+	case x.pin != y.pin:
+		return x.pin < y.pin
+	case x.preview != y.preview:
+		return x.preview
+	case x.company != y.company:
+		return x.company < y.company
+	}
+	return x.member < y.member
+}
+
+// Reorder pins the queued jobs at the front of the queue in the given order.
+// Jobs pinned before and not given are unpinned; no jobs clears all the pins.
+func (a *JobStore) Reorder(ids []JobID) error {
+	pins := map[JobID]int{}
+	for i, id := range ids {
+		job, err := a.Get(id)
+		if err != nil {
+			return err
+		}
+		if job.State != JobQueued {
+			return &CloudError{"Job " + string(id) + " is not queued"}
+		}
+		pins[id] = i + 1
+	}
+	jobs, err := a.List()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.State != JobQueued || job.Pin == pins[job.ID] {
+			continue
+		}
+		pin := pins[job.ID]
+		if _, err := a.Update(job.ID, func(job *Job) error {
+			job.Pin = pin
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	Log(fmt.Sprintf("Queue reordered: %v", ids))
+	return nil
+}
+
+// Claim picks the next queued job for the worker, or nil if there is none.
+func (a *JobStore) Claim(worker string) (*Job, error) {
+	queued, err := a.Queue()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range queued {
+		if time.Now().Before(job.NotBefore) {
+			continue // Backing off after a transient failure.
+		}
+		f, err := os.OpenFile(a.claim(job.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err != nil {
+			continue // Somebody else got it.
+		}
+		f.Write([]byte(worker))
+		f.Close()
+
+		cancelled := false
+		claimed, err := a.Update(job.ID, func(job *Job) error {
+			if job.State != JobQueued {
+				return &CloudError{"Job is no longer queued"}
+			}
+			if job.CancelRequested { // While somebody else had the claim.
+				cancelled = true
+				return finish(job, JobCancelled, cancelled_before_start)
+			}
+			now := time.Now()
+			job.State, job.Worker, job.Started, job.Heartbeat, job.Error = JobRunning, worker, now, now, ""
+			return nil
+		})
+		if err != nil {
+			os.Remove(a.claim(job.ID))
+			continue
+		}
+		if cancelled {
+			a.finished(claimed, cancelled_before_start)
+			continue
+		}
+		Log(fmt.Sprintf("Job %s claimed by %s", claimed.ID, worker))
+		return claimed, nil
+	}
+	return nil, nil
+}
+
+// Beat keeps the lease of a running job with its latest progress.
+// The returned record tells whether the job was asked to stop.
+func (a *JobStore) Beat(id JobID, worker string, progress JobProgress) (*Job, error) {
+	return a.Update(id, func(job *Job) error {
+		if job.State != JobRunning || job.Worker != worker {
+			return &CloudError{"Job " + string(id) + " is not leased to " + worker}
+		}
+		job.Heartbeat, job.Progress = time.Now(), progress
+		return nil
+	})
+}
+
+// Complete records what an attempt of the worker cost and how it ended.
+// Transient failures are queued again as the retry policy allows.
+func (a *JobStore) Complete(id JobID, worker string, report JobReport) (*Job, error) {
+	if !report.State.Final() {
+		return nil, &CloudError{"Not a final state: " + string(report.State)}
+	}
+	job, err := a.Update(id, func(job *Job) error {
+		if job.State != JobRunning || job.Worker != worker {
+			return &CloudError{"Job " + string(id) + " is not leased to " + worker}
+		}
+		job.CPUSeconds += report.CPUSeconds
+		job.Progress = report.Progress
+		if report.Settings != (RenderSettings{}) {
+			job.Settings = report.Settings
+		}
+		job.Attempts = append(job.Attempts, JobAttempt{worker, job.Started, time.Now(), report})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.cfg.RecordUsage(job.Owner, job.Output, UsageRender, report.CPUSeconds)
+	a.cfg.RecordStored(job.Owner, job.Output)
+
+	if report.State == JobFailed && report.Transient {
+		return a.retry(job, report.Error, true)
+	}
+	return a.Finish(id, report.State, report.Error)
+}
+
+// retry queues a job again after its last attempt failed for a passing reason,
+// unless it has been tried enough. Without back_off it may start again at once.
+func (a *JobStore) retry(job *Job, why string, back_off bool) (*Job, error) {
+	delay, ok := Retry.Delay(len(job.Attempts))
+	if !back_off {
+		delay = 0
+	}
+	if !ok {
+		return a.Finish(job.ID, JobFailed, fmt.Sprintf("Gave up after %d attempts: %s", len(job.Attempts), why))
+	}
+	job, err := a.Update(job.ID, func(job *Job) error {
+		if job.State != JobRunning {
+			return &CloudError{"Job " + string(job.ID) + " is not running"}
+		}
+		job.State, job.Worker, job.Error, job.NotBefore = JobQueued, "", why, time.Now().Add(delay)
+		return nil
+	})
+	if err == nil {
+		os.Remove(a.claim(job.ID))
+		Log(fmt.Sprintf("Job %s is queued again after %d attempts, in %v: %s", job.ID, len(job.Attempts), delay, why))
+		a.wake()
+	}
+	return job, err
+}
+
+// Finish puts a job into a final state; why explains failures.
+func (a *JobStore) Finish(id JobID, state JobState, why string) (*Job, error) {
+	if !state.Final() {
+		return nil, &CloudError{"Not a final state: " + string(state)}
+	}
+	job, err := a.Update(id, func(job *Job) error {
+		return finish(job, state, why)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.finished(job, why), nil
+}
+
+// finish puts the job record into a final state.
+func finish(job *Job, state JobState, why string) error {
+	if job.State.Final() {
+		return &CloudError{"Job " + string(job.ID) + " is already " + string(job.State)}
+	}
+	job.State, job.Error, job.Finished = state, why, time.Now()
+	return nil
+}
+
+// finished cleans up after a job that was put into a final state.
+func (a *JobStore) finished(job *Job, why string) *Job {
+	os.Remove(a.claim(job.ID))
+	os.Remove(a.OsPath(job, job.Scene) + JOB_SUFFIX)
+	if job.Live != "" {
+		os.Remove(a.OsPath(job, job.Live)) // The output, whatever it is, takes over.
+	}
+	a.cfg.Hooks().FireJob(job)
+	Log(fmt.Sprintf("Job %s %s %s", job.ID, job.State, why))
+	return job
+}
+
+const cancelled_before_start = "Cancelled before start"
+
+// Cancel stops a job. A queued job is taken by its claim file, as a worker would, and cancelled
+// right away; others are marked, and their worker stops the renderer and finishes them.
+func (a *JobStore) Cancel(id JobID) (*Job, error) {
+	if _, err := a.Get(id); err != nil {
+		return nil, err
+	}
+	claimed := false
+	if f, err := os.OpenFile(a.claim(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666); err == nil {
+		f.Write([]byte("cancel"))
+		f.Close()
+		claimed = true
+	}
+	job, err := a.Update(id, func(job *Job) error {
+		switch {
+		case job.State.Final():
+			return &CloudError{"Job " + string(id) + " is already " + string(job.State)}
+		case job.State == JobQueued && claimed:
+			return finish(job, JobCancelled, cancelled_before_start)
+		}
+		job.CancelRequested = true
+		return nil
+	})
+	if claimed && (err != nil || job.State != JobCancelled) {
+		os.Remove(a.claim(id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if job.State == JobCancelled {
+		return a.finished(job, cancelled_before_start), nil
+	}
+	Log(fmt.Sprintf("Job %s cancellation requested", id))
+	return job, nil
+}
+
+// requeue returns a running job into the queue, unless it was asked to stop.
+// Losing the worker counts as a failed attempt, so that a job which keeps
+// bringing its workers down is given up; there is no reason to wait with it though.
+func (a *JobStore) requeue(id JobID, why string) (*Job, error) {
+	if job, err := a.Get(id); err == nil && job.CancelRequested {
+		return a.Finish(id, JobCancelled, why)
+	}
+	job, err := a.Update(id, func(job *Job) error {
+		if job.State != JobRunning {
+			return &CloudError{"Job " + string(id) + " is not running"}
+		}
+		report := JobReport{State: JobFailed, Error: why, Transient: true, Progress: job.Progress}
+		job.Attempts = append(job.Attempts, JobAttempt{job.Worker, job.Started, time.Now(), report})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.retry(job, why, false)
+}
+
+// RequeueExpired puts back into the queue running jobs whose lease expired.
+// Claims left on queued jobs, by a worker that went away before its job was
+// running, are dropped once as old as a lease, so that the jobs are picked up again.
+func (a *JobStore) RequeueExpired() []*Job {
+	requeued := []*Job{}
+	jobs, _ := a.List()
+	for _, job := range jobs {
+		switch {
+		case job.State == JobRunning && time.Since(job.Heartbeat) > JobLease:
+			if job, err := a.requeue(job.ID, "Lease of "+job.Worker+" expired"); err == nil {
+				requeued = append(requeued, job)
+			}
+		case job.State == JobQueued:
+			if info, err := os.Stat(a.claim(job.ID)); err == nil && time.Since(info.ModTime()) > JobLease {
+				os.Remove(a.claim(job.ID))
+				Log(fmt.Sprintf("Job %s was claimed but never started; the claim is dropped", job.ID))
+				if job.CancelRequested {
+					a.Finish(job.ID, JobCancelled, cancelled_before_start)
+				}
+			}
+		}
+	}
+	return requeued
+}
+
+// SlotWorker names one of several render slots of a worker.
+func SlotWorker(worker string, slot int) string {
+	return fmt.Sprintf("%s#%d", worker, slot)
+}
+
+// Release puts back into the queue jobs left running by a worker and its slots, when it restarts.
+func (a *JobStore) Release(worker string) []*Job {
+	released := []*Job{}
+	jobs, _ := a.List()
+	for _, job := range jobs {
+		if job.State == JobRunning && (job.Worker == worker || strings.HasPrefix(job.Worker, worker+"#")) {
+			if job, err := a.requeue(job.ID, "Worker "+worker+" restarted"); err == nil {
+				released = append(released, job)
+			}
+		}
+	}
+	return released
+}
+
+// AdoptMarker submits a job for a .job marker created without one, such as by hand.
+// Markers written by /jobstart hold the job ID and are left alone.
+func (a *JobStore) AdoptMarker(marker string) (*Job, error) {
+	owner, user_path, ok := a.cfg.Owner(marker)
+	if !ok || !strings.HasSuffix(user_path, JOB_SUFFIX) {
+		return nil, &CloudError{"Marker is not in a member folder: " + marker}
+	}
+	if content, err := ioutil.ReadFile(marker); err == nil {
+		if _, err := a.Get(JobID(strings.TrimSpace(string(content)))); err == nil {
+			return nil, nil
+		}
+	}
+	scene := strings.TrimSuffix(user_path, JOB_SUFFIX)
+	if active := a.Active(owner, scene); active != nil {
+		// Such as one caught before /jobstart wrote the ID into it.
+		return nil, ioutil.WriteFile(marker, []byte(active.ID), 0666)
+	}
+	job, err := a.Submit(owner, scene)
+	if err != nil {
+		return nil, err
+	}
+	return job, ioutil.WriteFile(marker, []byte(job.ID), 0666)
+}
+
+// jobs_queued wakes workers of this process when a job becomes claimable.
+var jobs_queued = make(chan bool, 1)
+
+// wake tells workers that there may be a job to claim: those in this process at once,
+// those in other processes through the wake file.
+func (a *JobStore) wake() {
+	select {
+	case jobs_queued <- true:
+	default:
+	}
+	place := path.Join(a.place(), jobs_wake)
+	now := time.Now()
+	if err := os.Chtimes(place, now, now); err != nil {
+		ioutil.WriteFile(place, []byte{}, 0666)
+	}
+}
+
+// JobWatcher waits for jobs to be queued.
+type JobWatcher struct {
+	jobs *JobStore
+	seen time.Time // Of the wake file.
+}
+
+// JobWake is how often a watcher looks at the wake file written by other processes.
+var JobWake = 500 * time.Millisecond
+
+// Watcher starts waiting for jobs queued from now on.
+func (a *JobStore) Watcher() *JobWatcher {
+	watcher := &JobWatcher{jobs: a}
+	watcher.changed()
+	select {
+	case <-jobs_queued:
+	default:
+	}
+	return watcher
+}
+
+// changed tells if the wake file was touched since it was last looked at.
+func (a *JobWatcher) changed() bool {
+	info, err := os.Stat(path.Join(a.jobs.place(), jobs_wake))
+	if err != nil || !info.ModTime().After(a.seen) {
+		return false
+	}
+	a.seen = info.ModTime()
+	return true
+}
+
+// Wait returns true once a job may have been queued, or false after the timeout.
+func (a *JobWatcher) Wait(timeout time.Duration) bool {
+	expired := time.After(timeout)
+	look := time.NewTicker(JobWake)
+	defer look.Stop()
+	for {
+		select {
+		case <-jobs_queued:
+			a.changed() // That was us.
+			return true
+		case <-look.C:
+			if a.changed() {
+				return true
+			}
+		case <-expired:
+			return false
+		}
 	}
-	return nil, &CloudError{"Unknown job"}
 }
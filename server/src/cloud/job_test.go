@@ -0,0 +1,405 @@
+package cloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test_jobs gives a job store in a new place with a single member.
+func test_jobs(t *testing.T) (*CloudConfig, *JobStore) {
+	the_place := path.Join(os.TempDir(), fmt.Sprintf("cloud_jobs%d", time.Now().UnixNano()))
+	a := &CloudConfig{TheRoot: the_place, TheMembers: []Member{Member{"Tester", "tester", "pw", 0, 0, nil}}}
+	a.organize()
+	os.MkdirAll(a.GetOsPath("tester", "house"), 0777)
+	for _, scene := range []string{"house/a.xml", "house/b.xml"} {
+		if err := ioutil.WriteFile(a.GetOsPath("tester", scene), []byte("<RenderingData/>"), 0666); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return a, a.Jobs()
+}
+
+func TestJobLifecycle(t *testing.T) {
+	_, jobs := test_jobs(t)
+
+	first, err := jobs.Submit("tester", "house/a.xml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := jobs.Submit("tester", "house/a.xml"); err == nil {
+		t.Error("Same scene must not be queued twice")
+	}
+	second, _ := jobs.Submit("tester", "house/b.xml")
+
+	claimed, err := jobs.Claim("w1")
+	switch {
+	case err != nil || claimed == nil:
+		t.Fatalf("Claim failed: %v", err)
+	case claimed.ID != first.ID || claimed.State != JobRunning || claimed.Worker != "w1":
+		t.Errorf("Oldest job is expected to be running: %#v", claimed)
+	case claimed.Output != "house/a.xml.png" || claimed.Log != "house/a.xml"+JOB_OUTPUT_SUFFIX:
+		t.Errorf("Unexpected outputs: %#v", claimed)
+	}
+
+	if _, err := jobs.Beat(first.ID, "w2", JobProgress{}); err == nil {
+		t.Error("Only the worker holding the lease can extend it")
+	}
+	if _, err := jobs.Beat(first.ID, "w1", JobProgress{}); err != nil {
+		t.Error(err.Error())
+	}
+
+	if done, err := jobs.Finish(first.ID, JobSucceeded, ""); err != nil || done.Finished.IsZero() {
+		t.Errorf("Finishing: %v", err)
+	}
+	if _, err := jobs.Finish(first.ID, JobFailed, "again"); err == nil {
+		t.Error("Finished job can not finish again")
+	}
+
+	if next, _ := jobs.Claim("w1"); next == nil || next.ID != second.ID {
+		t.Errorf("Second job is expected, got %v", next)
+	}
+	if none, err := jobs.Claim("w1"); none != nil || err != nil {
+		t.Errorf("Nothing is expected, got %v %v", none, err)
+	}
+}
+
+func TestJobRecovery(t *testing.T) {
+	_, jobs := test_jobs(t)
+
+	a, _ := jobs.Submit("tester", "house/a.xml")
+	b, _ := jobs.Submit("tester", "house/b.xml")
+	jobs.Claim("dead")
+	jobs.Claim("restarted")
+
+	lease := JobLease
+	JobLease = 0
+	jobs.Beat(b.ID, "restarted", JobProgress{}) // Must not matter
+	expired := jobs.RequeueExpired()
+	JobLease = lease
+
+	if len(expired) != 2 {
+		t.Fatalf("Both jobs should expire, got %v", expired)
+	}
+
+	again, _ := jobs.Claim("restarted")
+	if again == nil || again.ID != a.ID {
+		t.Fatalf("Requeued job should be claimable: %v", again)
+	}
+	if released := jobs.Release("restarted"); len(released) != 1 || released[0].ID != a.ID {
+		t.Errorf("Restarted worker should release its jobs: %v", released)
+	}
+	if job, _ := jobs.Get(a.ID); job.State != JobQueued || !strings.Contains(job.Error, "restarted") {
+		t.Errorf("Released job should be queued: %#v", job)
+	}
+}
+
+// TestJobStaleClaim picks up a job whose claimer went away before the job was running.
+func TestJobStaleClaim(t *testing.T) {
+	_, jobs := test_jobs(t)
+
+	job, _ := jobs.Submit("tester", "house/a.xml")
+	ioutil.WriteFile(jobs.claim(job.ID), []byte("crashed"), 0666)
+	if claimed, _ := jobs.Claim("w"); claimed != nil {
+		t.Fatalf("Claimed job must not be claimed again: %v", claimed)
+	}
+	jobs.RequeueExpired()
+	if _, err := os.Stat(jobs.claim(job.ID)); err != nil {
+		t.Error("A fresh claim may be on its way to running and has to be kept")
+	}
+
+	old := time.Now().Add(-2*JobLease - time.Second)
+	os.Chtimes(jobs.claim(job.ID), old, old)
+	jobs.RequeueExpired()
+	if claimed, _ := jobs.Claim("w"); claimed == nil || claimed.ID != job.ID {
+		t.Errorf("Job with a stale claim should be claimable, got %v", claimed)
+	}
+}
+
+func TestJobFairness(t *testing.T) {
+	cfg, jobs := test_jobs(t)
+	cfg.TheMembers = append(cfg.TheMembers, Member{"Other", "other", "pw", 0, 0, nil})
+	cfg.organize()
+	os.MkdirAll(cfg.GetOsPath("other", "flat"), 0777)
+	ioutil.WriteFile(cfg.GetOsPath("other", "flat/c.xml"), []byte("<RenderingData/>"), 0666)
+
+	jobs.Submit("tester", "house/a.xml")
+	jobs.Submit("tester", "house/b.xml")
+	late, _ := jobs.Submit("other", "flat/c.xml")
+
+	jobs.Claim(SlotWorker("w", 1))
+	if second, _ := jobs.Claim(SlotWorker("w", 2)); second == nil || second.ID != late.ID {
+		t.Errorf("Member with nothing running should go first: %v", second)
+	}
+	jobs.Claim(SlotWorker("w", 3))
+	if released := jobs.Release("w"); len(released) != 3 {
+		t.Errorf("All slots of a worker should be released: %v", released)
+	}
+}
+
+func TestJobQueueOrder(t *testing.T) {
+	cfg, jobs := test_jobs(t)
+	cfg.TheMembers = append(cfg.TheMembers,
+		Member{"Other", "other", "pw", 3, 0, nil}, Member{"A", "acme/a", "pw", 0, 0, nil}, Member{"B", "acme/b", "pw", 0, 0, nil})
+	cfg.organize()
+
+	submit := func(owner, scene string, priority JobPriority) JobID {
+		job, err := jobs.SubmitWith(owner, scene, JobOptions{Priority: priority})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return job.ID
+	}
+	expect := func(what string, ids ...JobID) {
+		queued, _ := jobs.Queue()
+		got := []JobID{}
+		for _, job := range queued {
+			got = append(got, job.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(ids) {
+			t.Errorf("%s: expected %v, got %v", what, ids, got)
+		}
+	}
+
+	t1 := submit("tester", "t1.xml", PriorityFinal)
+	t2 := submit("tester", "t2.xml", PriorityFinal)
+	o1 := submit("other", "o1.xml", PriorityFinal)
+	o2 := submit("other", "o2.xml", PriorityFinal)
+	a1 := submit("acme/a", "a1.xml", PriorityFinal)
+	b1 := submit("acme/b", "b1.xml", PriorityFinal)
+
+	for _, id := range []JobID{t1, o1, a1} {
+		if job, _ := jobs.Claim("w"); job == nil || job.ID != id {
+			t.Fatalf("Each company should get a job first, expected %s, got %v", id, job)
+		}
+	}
+	// Other has a larger share, acme is two members sharing a job.
+	expect("Weighted", o2, b1, t2)
+
+	p := submit("tester", "p.xml", PriorityPreview)
+	expect("Previews first", p, o2, b1, t2)
+
+	if err := jobs.Reorder([]JobID{t2, b1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("Pinned", t2, b1, p, o2)
+	if err := jobs.Reorder([]JobID{t1}); err == nil {
+		t.Error("Running jobs can not be pinned")
+	}
+	jobs.Reorder(nil)
+	expect("Unpinned", p, o2, b1, t2)
+}
+
+func TestJobRetry(t *testing.T) {
+	_, jobs := test_jobs(t)
+	retry := Retry
+	Retry = RetryPolicy{Attempts: 3, Backoff: time.Hour, Factor: 2, MaxBackoff: 90 * time.Minute}
+	defer func() { Retry = retry }()
+
+	if delay, _ := Retry.Delay(2); delay != 90*time.Minute {
+		t.Errorf("Back-off should grow up to its most: %v", delay)
+	}
+
+	job, _ := jobs.Submit("tester", "house/a.xml")
+	jobs.Claim("w")
+	failure := JobReport{State: JobFailed, Error: "Renderer killed", Transient: true, CPUSeconds: 1}
+	if again, err := jobs.Complete(job.ID, "w", failure); err != nil || again.State != JobQueued || !again.NotBefore.After(time.Now()) {
+		t.Fatalf("Transient failure should be retried later: %#v %v", again, err)
+	}
+	if claimed, _ := jobs.Claim("w"); claimed != nil {
+		t.Errorf("Job backing off must not be claimed: %#v", claimed)
+	}
+
+	// The worker disappears on the second attempt.
+	jobs.Update(job.ID, func(job *Job) error {
+		job.NotBefore = time.Time{}
+		return nil
+	})
+	jobs.Claim("w")
+	jobs.Release("w")
+	jobs.Claim("w")
+	done, err := jobs.Complete(job.ID, "w", failure)
+	if err != nil || done.State != JobFailed || !strings.HasPrefix(done.Error, "Gave up after 3 attempts") {
+		t.Errorf("Job should be given up: %#v %v", done, err)
+	}
+	if len(done.Attempts) != 3 || done.Attempts[1].Worker != "w" || !done.Attempts[2].Transient || done.CPUSeconds != 2 {
+		t.Errorf("Attempts should be recorded: %#v", done.Attempts)
+	}
+
+	broken, _ := jobs.Submit("tester", "house/b.xml")
+	jobs.Claim("w")
+	if done, _ := jobs.Complete(broken.ID, "w", JobReport{State: JobFailed, Error: "Bad scene"}); done.State != JobFailed || len(done.Attempts) != 1 {
+		t.Errorf("Permanent failure must not be retried: %#v", done)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	cfg, jobs := test_jobs(t)
+
+	queued, _ := jobs.Submit("tester", "house/a.xml")
+	if job, err := jobs.Cancel(queued.ID); err != nil || job.State != JobCancelled {
+		t.Errorf("Queued job should be cancelled at once: %v %v", job, err)
+	}
+
+	running, _ := jobs.Submit("tester", "house/b.xml")
+	jobs.Claim("w")
+	ioutil.WriteFile(cfg.GetOsPath("tester", running.Output), []byte("partial"), 0666)
+	job, err := jobs.Cancel(running.ID)
+	if err != nil || job.State != JobRunning || !job.CancelRequested {
+		t.Fatalf("Running job is left to its worker: %v %v", job, err)
+	}
+
+	// The worker is gone; the lease expires instead.
+	lease := JobLease
+	JobLease = 0
+	jobs.RequeueExpired()
+	JobLease = lease
+
+	if job, _ := jobs.Get(running.ID); job.State != JobCancelled {
+		t.Errorf("Expired job asked to stop must not be requeued: %#v", job)
+	}
+	if _, err := os.Stat(cfg.GetOsPath("tester", running.Output)); err != nil {
+		t.Error("Partial image should be kept")
+	}
+	if _, err := jobs.Cancel(running.ID); err == nil {
+		t.Error("Finished job can not be cancelled")
+	}
+
+	// A job is either cancelled before start or claimed, never both.
+	ids := []JobID{}
+	for i := 0; i < 10; i++ {
+		job, _ := jobs.Submit("tester", fmt.Sprintf("race/%d.xml", i))
+		ids = append(ids, job.ID)
+	}
+	claimed := make(chan *Job, len(ids))
+	go func() {
+		for job, _ := jobs.Claim("w"); job != nil; job, _ = jobs.Claim("w") {
+			claimed <- job
+		}
+		close(claimed)
+	}()
+	for _, id := range ids {
+		jobs.Cancel(id)
+	}
+	for job := range claimed {
+		if job, _ := jobs.Get(job.ID); job.State == JobCancelled && job.Error == "Cancelled before start" {
+			t.Errorf("Claimed job was cancelled before start: %#v", job)
+		}
+	}
+}
+
+// TestJobCancelClaimed cancels a queued job that a worker in another process is claiming.
+func TestJobCancelClaimed(t *testing.T) {
+	_, jobs := test_jobs(t)
+
+	queued, _ := jobs.Submit("tester", "house/a.xml")
+	ioutil.WriteFile(jobs.claim(queued.ID), []byte("scanner"), 0666)
+	if job, err := jobs.Cancel(queued.ID); err != nil || job.State != JobQueued || !job.CancelRequested {
+		t.Fatalf("Job being claimed is left to its claimer: %v %v", job, err)
+	}
+	if _, err := os.Stat(jobs.claim(queued.ID)); err != nil {
+		t.Error("The claim of the other worker has to be kept")
+	}
+
+	// The claimer went away; the next one finishes it instead of rendering it.
+	os.Remove(jobs.claim(queued.ID))
+	if claimed, _ := jobs.Claim("w"); claimed != nil {
+		t.Errorf("Job asked to stop must not be rendered: %#v", claimed)
+	}
+	if job, _ := jobs.Get(queued.ID); job.State != JobCancelled {
+		t.Errorf("Job should be cancelled: %#v", job)
+	}
+	if _, err := os.Stat(jobs.claim(queued.ID)); err == nil {
+		t.Error("Claim of a cancelled job should be gone")
+	}
+}
+
+// TestJobLock waits for the lock of another process, unless it was left behind.
+func TestJobLock(t *testing.T) {
+	_, jobs := test_jobs(t)
+	job, _ := jobs.Submit("tester", "house/a.xml")
+
+	lock := path.Join(jobs.place(), lock_file)
+	ioutil.WriteFile(lock, []byte{}, 0666)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.Remove(lock)
+	}()
+	started := time.Now()
+	if _, err := jobs.Update(job.ID, func(*Job) error { return nil }); err != nil || time.Since(started) < 100*time.Millisecond {
+		t.Errorf("Update should wait for the lock: %v after %v", err, time.Since(started))
+	}
+
+	ioutil.WriteFile(lock, []byte{}, 0666)
+	old := time.Now().Add(-2 * JobLockStale)
+	os.Chtimes(lock, old, old)
+	if _, err := jobs.Update(job.ID, func(*Job) error { return nil }); err != nil {
+		t.Error(err.Error())
+	}
+	if _, err := os.Stat(lock); err == nil {
+		t.Error("Lock should be released")
+	}
+}
+
+func TestJobMarker(t *testing.T) {
+	cfg, jobs := test_jobs(t)
+
+	marker := cfg.GetOsPath("tester", "house/a.xml") + JOB_SUFFIX
+	ioutil.WriteFile(marker, []byte("."), 0666)
+
+	job, err := jobs.AdoptMarker(marker)
+	if err != nil || job == nil || job.Scene != "house/a.xml" {
+		t.Fatalf("Marker should become a job: %v %v", job, err)
+	}
+	if again, err := jobs.AdoptMarker(marker); again != nil || err != nil {
+		t.Errorf("Adopted marker should be left alone: %v %v", again, err)
+	}
+
+	// Caught before /jobstart wrote the ID into it.
+	other, _ := jobs.Submit("tester", "house/b.xml")
+	early := cfg.GetOsPath("tester", "house/b.xml") + JOB_SUFFIX
+	ioutil.WriteFile(early, []byte{}, 0666)
+	if again, err := jobs.AdoptMarker(early); again != nil || err != nil {
+		t.Errorf("Marker of an active job should be left to it: %v %v", again, err)
+	}
+	if content, _ := ioutil.ReadFile(early); string(content) != string(other.ID) {
+		t.Errorf("Marker should name the active job: %s", content)
+	}
+
+	jobs.Claim("w")
+	jobs.Finish(job.ID, JobFailed, "no renderer")
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Marker should be removed once the job is over")
+	}
+}
+
+func TestJobWatcher(t *testing.T) {
+	_, jobs := test_jobs(t)
+	watcher := jobs.Watcher()
+	if watcher.Wait(100 * time.Millisecond) {
+		t.Error("Nothing was queued")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		jobs.Submit("tester", "house/a.xml")
+	}()
+	started := time.Now()
+	if !watcher.Wait(10*time.Second) || time.Since(started) > 5*time.Second {
+		t.Error("Submitted job should wake the watcher")
+	}
+
+	// A server in another process only touches the wake file.
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path.Join(jobs.place(), jobs_wake), later, later)
+	if !watcher.Wait(5 * time.Second) {
+		t.Error("Wake file should wake the watcher")
+	}
+	if watcher.Wait(100 * time.Millisecond) {
+		t.Error("Watcher should be woken once")
+	}
+}
@@ -2,6 +2,7 @@ package cloud
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -16,6 +17,7 @@ const ui_dir = "./ui"
 
 func init() {
 	log.Print("Starting test server ...\n")
+	HookPrivate = true // The hooks of the tests listen on the loopback.
 	// Real server should probably configured away from the default location.
 	// make sure the place is new.
 	Configure("/tmp/cloud_testing/" + fmt.Sprint(time.Now().Unix()))
@@ -306,7 +308,7 @@ func TestStoreCreation(t *testing.T) {
 	store := tg.get_store(t)
 	store.Sync()
 	if store.Size() != 5 {
-		t.Errorf("Incorrect store size: %i", store.Size())
+		t.Errorf("Incorrect store size: %d", store.Size())
 	}
 }
 
@@ -315,7 +317,7 @@ func TestStoreRemove(t *testing.T) {
 	store := tg.get_store(t)
 
 	if store.Sync(); store.Size() != 5 {
-		t.Errorf("Incorrect store size: %i", store.Size())
+		t.Errorf("Incorrect store size: %d", store.Size())
 	}
 
 	new_file := CloudPath("cool/stuff/me.txt")
@@ -323,7 +325,7 @@ func TestStoreRemove(t *testing.T) {
 
 	store.Add(new_file, new_content)
 	if store.Sync(); store.Size() != 6 {
-		t.Errorf("Incorrect store size: %i", store.Size())
+		t.Errorf("Incorrect store size: %d", store.Size())
 	}
 
 	if content, err := store.GetContent(new_file); !bytes.Equal(content, new_content) || err != nil {
@@ -336,7 +338,7 @@ func TestStoreRemove(t *testing.T) {
 
 	store.Remove(new_file)
 	if store.Sync(); store.Size() != 5 {
-		t.Errorf("Incorrect store size: %i", store.Size())
+		t.Errorf("Incorrect store size: %d", store.Size())
 	}
 
 	if file, err := os.Stat(store.OsPath(new_file)); err == nil {
@@ -372,3 +374,32 @@ func NotTestFileStore(t *testing.T) {
 		t.Errorf("Matched %d instead of %d; %v|%v", got, expected, files, ids)
 	}
 }
+
+func TestUsageApi(t *testing.T) {
+	_, test_bytes := some_content()
+	if good_guy.Upload("billed/scene.txt", test_bytes) != "OK" {
+		t.Fatal("Upload")
+	}
+	good_guy.Download("billed/scene.txt")
+
+	report := ApiUsageReply{}
+	if err := json.Unmarshal(good_guy.Usage(""), &report); err != nil {
+		t.Fatal(err.Error())
+	}
+	found := false
+	for _, day := range report.Days {
+		if day.Project == "billed" && day.BytesUploaded >= int64(len(test_bytes)) && day.BytesDownloaded >= int64(len(test_bytes)) {
+			found = true
+		}
+	}
+	if !report.Success || !found || report.User.Usage.BytesUsed == 0 {
+		t.Errorf("Upload and download are not accounted: %#v", report)
+	}
+
+	if csv := string(good_guy.Usage("format=csv")); !strings.Contains(csv, "sheer/abc,billed,") {
+		t.Errorf("CSV export lacks the project: %s", csv)
+	}
+	if bad := string(good_guy.Usage("from=yesterday")); !strings.Contains(bad, "FAIL") {
+		t.Errorf("Bad date must fail, got %s", bad)
+	}
+}
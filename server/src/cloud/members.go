@@ -0,0 +1,270 @@
+package cloud
+
+/*
+
+  Member administration.
+
+  Members live in members.json at the root of the store, so they can be
+  managed offline with the admin subcommands of the server binary. It is the
+  one place logins and passwords are kept: users.json of older stores is taken
+  over the first time the store is opened. If neither is there, the compiled-in
+  defaults are used.
+
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const members_config = "members.json"
+
+// users_config is where older stores kept logins.
+const users_config = "users.json"
+
+// storedConfig is the part of CloudConfig which is kept on disk.
+type storedConfig struct {
+	TheCompany Company
+	TheMembers []Member
+}
+
+// MembersFile returns the location of the members configuration.
+func (a *CloudConfig) MembersFile() string {
+	return path.Join(a.TheRoot, members_config)
+}
+
+// LoadMembers replaces company and members with the ones saved in the store.
+func (a *CloudConfig) LoadMembers() error {
+	stored := storedConfig{}
+	if err := Load(a.MembersFile(), &stored); err != nil {
+		return err
+	}
+	a.TheCompany, a.TheMembers = stored.TheCompany, stored.TheMembers
+	a.organize()
+	return nil
+}
+
+// SaveMembers writes company and members into the store.
+func (a *CloudConfig) SaveMembers() error {
+	if err := os.MkdirAll(a.TheRoot, 0777); err != nil {
+		return err
+	}
+	return Save(a.MembersFile(), &storedConfig{a.TheCompany, a.TheMembers})
+}
+
+// OpenConfig points the cloud to the store and picks up saved members, if any,
+// and indexes their logins. The members so far are kept for a store without any.
+// It makes a new configuration, so that those in use by others do not change under them.
+func OpenConfig(where string) *CloudConfig {
+	was := TheCloud()
+	a := &CloudConfig{TheCompany: was.TheCompany, TheMembers: append([]Member{}, was.TheMembers...), TheRoot: where}
+	a.organize()
+	err := a.LoadMembers()
+	if os.IsNotExist(err) {
+		err = a.take_over_users()
+	}
+	if err != nil {
+		Log("Unable to load members, using defaults: " + err.Error())
+	}
+	publish(a)
+	ResetUsers()
+	for _, mbr := range a.TheMembers {
+		AddUser(User{Name: mbr.FullName, Login: mbr.Login, Password: mbr.Password})
+	}
+	return a
+}
+
+// take_over_users makes members of the users of an older store, kept in users.json,
+// and saves them in the members file, which is used from then on.
+func (a *CloudConfig) take_over_users() error {
+	old_guys := Users{}
+	if err := ConfigRead(path.Join(a.TheRoot, users_config), &old_guys); err != nil {
+		if os.IsNotExist(err) {
+			return nil // A new store
+		}
+		return err
+	}
+	a.merge_users(old_guys)
+	Log(fmt.Sprintf("Taking over %d users of %s into %s", len(old_guys), users_config, members_config))
+	return a.SaveMembers()
+}
+
+// merge_users makes members of users, or updates the members they are.
+func (a *CloudConfig) merge_users(users Users) {
+	for _, user := range users {
+		if mbr := a.GetUser(user.Login); mbr != nil {
+			mbr.FullName, mbr.Password = user.Name, user.Password
+		} else {
+			a.TheMembers = append(a.TheMembers, Member{FullName: user.Name, Login: user.Login, Password: user.Password})
+			a.organize()
+		}
+	}
+}
+
+// member looks up a member, failing if there is none.
+func (a *CloudConfig) member(login string) (*Member, error) {
+	if mbr := a.GetUser(login); mbr != nil {
+		return mbr, nil
+	}
+	return nil, &CloudError{"No such member: " + login}
+}
+
+// AddMember registers a new member.
+func (a *CloudConfig) AddMember(mbr Member) error {
+	switch {
+	case mbr.Login == "" || strings.ContainsAny(mbr.Login, "\\:") || strings.Contains(mbr.Login, ".."):
+		return &CloudError{"Illegal login: " + mbr.Login}
+	case mbr.Password == "":
+		return &CloudError{"Password is required for " + mbr.Login}
+	}
+	if _, err := a.member(mbr.Login); err == nil {
+		return &CloudError{"Member already exists: " + mbr.Login}
+	}
+	a.TheMembers = append(a.TheMembers, mbr)
+	a.organize()
+	return nil
+}
+
+// RemoveMember removes a member; the files are left intact.
+func (a *CloudConfig) RemoveMember(login string) error {
+	if _, err := a.member(login); err != nil {
+		return err
+	}
+	kept := []Member{}
+	for _, mbr := range a.TheMembers {
+		if mbr.Login != login {
+			kept = append(kept, mbr)
+		}
+	}
+	a.TheMembers = kept
+	a.organize()
+	return nil
+}
+
+// SetPassword changes the password of a member.
+func (a *CloudConfig) SetPassword(login, password string) error {
+	mbr, err := a.member(login)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return &CloudError{"Empty password is not allowed"}
+	}
+	mbr.Password = password
+	return nil
+}
+
+// SetQuota changes render allowance and storage (in megabytes) of a member.
+// Zero means no limit.
+func (a *CloudConfig) SetQuota(login string, renders, storage int) error {
+	mbr, err := a.member(login)
+	if err != nil {
+		return err
+	}
+	if renders < 0 || storage < 0 {
+		return &CloudError{"Quotas can not be negative"}
+	}
+	mbr.Renders, mbr.Storage = renders, storage
+	return nil
+}
+
+// DiskUsage returns the number of bytes and files kept by a member.
+func (a *CloudConfig) DiskUsage(login string) (bytes int64, files int, err error) {
+	if _, err = a.member(login); err != nil {
+		return
+	}
+	err = filepath.Walk(a.GetRoot(login), func(where string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Nothing uploaded yet
+			}
+			return err
+		}
+		if !info.IsDir() {
+			bytes += info.Size()
+			files++
+		}
+		return nil
+	})
+	return
+}
+
+// Verify checks the store for inconsistencies and returns the problems found.
+func (a *CloudConfig) Verify() []error {
+	problems := []error{}
+	complain := func(format string, args ...interface{}) {
+		problems = append(problems, &CloudError{fmt.Sprintf(format, args...)})
+	}
+
+	if info, err := os.Stat(a.TheRoot); err != nil || !info.IsDir() {
+		complain("Store [%s] is not an accessible directory", a.TheRoot)
+		return problems
+	}
+
+	if _, err := os.Stat(a.MembersFile()); err == nil {
+		if err := Load(a.MembersFile(), &storedConfig{}); err != nil {
+			complain("Unable to parse %s: %s", a.MembersFile(), err.Error())
+		}
+	}
+
+	roots := map[string]string{}
+	for _, mbr := range a.TheMembers {
+		root := a.GetRoot(mbr.Login)
+		if other, ok := roots[root]; ok {
+			complain("Members %s and %s share the folder %s", other, mbr.Login, root)
+		}
+		roots[root] = mbr.Login
+		if mbr.Password == "" {
+			complain("Member %s has no password", mbr.Login)
+		}
+		if mbr.Storage > 0 {
+			if used, _, err := a.DiskUsage(mbr.Login); err == nil && used > int64(mbr.Storage)<<20 {
+				complain("Member %s uses %d bytes over quota of %d MB", mbr.Login, used, mbr.Storage)
+			}
+		}
+	}
+
+	entries, err := ioutil.ReadDir(a.TheRoot)
+	if err != nil {
+		complain("Unable to list store: %s", err.Error())
+		return problems
+	}
+	for _, entry := range entries {
+		where := path.Join(a.TheRoot, entry.Name())
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if _, ok := roots[where]; !ok {
+			complain("Folder %s does not belong to any member", where)
+			continue
+		}
+		filepath.Walk(where, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				complain("Unable to access %s: %s", file, err.Error())
+				return nil
+			}
+			if !info.IsDir() && strings.HasSuffix(file, JOB_SUFFIX) {
+				if err := must_be_file(strings.TrimSuffix(file, JOB_SUFFIX)); err != nil {
+					complain("Job marker %s has no scene", file)
+				}
+			}
+			return nil
+		})
+	}
+	return problems
+}
+
+// MemberLogins lists logins in alphabetical order.
+func (a *CloudConfig) MemberLogins() []string {
+	logins := []string{}
+	for _, mbr := range a.TheMembers {
+		logins = append(logins, mbr.Login)
+	}
+	sort.Strings(logins)
+	return logins
+}
@@ -0,0 +1,302 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// NodeRequest stores verified information of a render node request.
+type NodeRequest struct {
+	Node *Node
+	Data []byte
+}
+
+// node_worker processes a request of a render node.
+type node_worker func(http.ResponseWriter, *http.Request, *NodeRequest) error
+
+// ApiNodeLease is what /node/lease sends; Job is nil when nothing is queued.
+type ApiNodeLease struct {
+	ApiStatus
+	Job   *Job
+	Files []string // User paths of the owner the render needs.
+}
+
+// parse_node_inputs_for checks the node and its token before the worker is called.
+func parse_node_inputs_for(a node_worker) worker_simple {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		incoming, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return NewCloudError("Reading data: " + err.Error())
+		}
+		param := r.URL.Query()
+		node, err := TheCloud().Nodes().Authorize(param.Get("node"), param.Get("token"))
+		if err != nil {
+			Log("Failed to resolve node: " + param.Get("node"))
+			return err
+		}
+		return a(w, r, &NodeRequest{node, incoming})
+	}
+}
+
+// leased_job reads the job given by id, which must be running on the node.
+func leased_job(r *http.Request, req *NodeRequest) (*Job, error) {
+	job, err := TheCloud().Jobs().Get(JobID(r.URL.Query().Get("id")))
+	if err != nil {
+		return nil, err
+	}
+	if job.State != JobRunning || !strings.HasPrefix(job.Worker, NodeWorker(req.Node.Name)+"#") {
+		return nil, &CloudError{"Job " + string(job.ID) + " is not leased to " + req.Node.Name}
+	}
+	return job, nil
+}
+
+// node_register notes a node that has just started.
+func node_register(w http.ResponseWriter, r *http.Request, req *NodeRequest) error {
+	slots, err := strconv.Atoi(r.URL.Query().Get("slots"))
+	if err != nil || slots < 1 {
+		return &CloudError{"slots parameter must be a positive number"}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if _, err := TheCloud().Nodes().Register(req.Node.Name, host, slots); err != nil {
+		return err
+	}
+	return send_OK(w)
+}
+
+// node_lease gives the next queued job to a slot of the node, with the files it needs.
+func node_lease(w http.ResponseWriter, r *http.Request, req *NodeRequest) error {
+	slot, err := strconv.Atoi(r.URL.Query().Get("slot"))
+	if err != nil || slot < 1 {
+		return &CloudError{"slot parameter must be a positive number"}
+	}
+	jobs := TheCloud().Jobs()
+	jobs.RequeueExpired() // Nodes poll often enough to notice the ones gone.
+	TheCloud().Nodes().Seen(req.Node.Name)
+
+	reply := &ApiNodeLease{ApiStatus: ApiStatus{true, "OK"}}
+	if reply.Job, err = jobs.Claim(SlotWorker(NodeWorker(req.Node.Name), slot)); err != nil {
+		return err
+	}
+	if reply.Job != nil {
+		if reply.Files, err = jobs.Files(reply.Job); err != nil {
+			jobs.Finish(reply.Job.ID, JobFailed, "Unable to list the files: "+err.Error())
+			return err
+		}
+	}
+	return send_json(w, reply)
+}
+
+// node_file sends a file a leased job needs.
+func node_file(w http.ResponseWriter, r *http.Request, req *NodeRequest) error {
+	job, err := leased_job(r, req)
+	if err != nil {
+		return err
+	}
+	files, err := TheCloud().Jobs().Files(job)
+	if err != nil {
+		return err
+	}
+	asked := r.URL.Query().Get("file")
+	for _, user_path := range files {
+		if user_path == asked {
+			data, err := ioutil.ReadFile(TheCloud().GetOsPath(job.Owner, user_path))
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+			return nil
+		}
+	}
+	return &CloudError{"Not a file of job " + string(job.ID) + ": " + asked}
+}
+
+// node_heartbeat keeps the lease of a job with its progress; OK:CANCEL asks the node to stop.
+func node_heartbeat(w http.ResponseWriter, r *http.Request, req *NodeRequest) error {
+	job, err := leased_job(r, req)
+	if err != nil {
+		return err
+	}
+	progress := JobProgress{}
+	if len(req.Data) > 0 {
+		if err := json.Unmarshal(req.Data, &progress); err != nil {
+			return err
+		}
+	}
+	if job, err = TheCloud().Jobs().Beat(job.ID, job.Worker, progress); err != nil {
+		return err
+	}
+	if job.CancelRequested {
+		say(w, "OK:CANCEL")
+		return nil
+	}
+	return send_OK(w)
+}
+
+// node_upload stores the image (kind=image), the .png along with it (kind=png), the live image (kind=live)
+// or the log (kind=log) of a job.
+func node_upload(w http.ResponseWriter, r *http.Request, req *NodeRequest) error {
+	job, err := leased_job(r, req)
+	if err != nil {
+		return err
+	}
+	target := ""
+	switch r.URL.Query().Get("kind") {
+	case "image":
+		target = job.Output
+	case "png":
+		target = PNGOf(job.Output)
+	case "live":
+		target = job.Live
+	case "log":
+		target = job.Log
+	default:
+		return &CloudError{"kind parameter must be image, png, live or log"}
+	}
+
+	temp_file, err := make_temp_file(req.Data)
+	if err != nil {
+		return err
+	}
+	place := TheCloud().GetOsPath(job.Owner, target)
+	if err := os.MkdirAll(path.Dir(place), 0777); err != nil {
+		return err
+	}
+	os.RemoveAll(place)
+	if err := os.Rename(temp_file, place); err != nil {
+		return err
+	}
+	return send_OK(w)
+}
+
+// node_finish records the outcome of an attempt at a job.
+func node_finish(w http.ResponseWriter, r *http.Request, req *NodeRequest) error {
+	job, err := leased_job(r, req)
+	if err != nil {
+		return err
+	}
+	report := JobReport{}
+	if err := json.Unmarshal(req.Data, &report); err != nil {
+		return err
+	}
+	if _, err := TheCloud().Jobs().Complete(job.ID, job.Worker, report); err != nil {
+		return err
+	}
+	return send_OK(w)
+}
+
+// --- Client for render nodes
+
+// NodeClient talks to the server on behalf of a render node.
+type NodeClient struct {
+	Server      string // Such as https://cloud.example.com:8080
+	Name, Token string
+	web         *http.Client
+}
+
+// NewNodeClient makes a client; cert_file, if given, is trusted in addition to the system roots,
+// as a self-signed certificate of the server would be.
+func NewNodeClient(server, name, token, cert_file string) (*NodeClient, error) {
+	client := &http.Client{}
+	if cert_file != "" {
+		pem, err := ioutil.ReadFile(cert_file)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, &CloudError{"No certificates in " + cert_file}
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+	return &NodeClient{strings.TrimSuffix(server, "/"), name, token, client}, nil
+}
+
+// call posts to a node verb; FAIL replies become errors.
+func (a *NodeClient) call(verb string, query url.Values, data []byte) ([]byte, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("node", a.Name)
+	query.Set("token", a.Token)
+	resp, err := a.web.Post(a.Server+"/node/"+verb+"?"+query.Encode(), "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(reply, []byte("FAIL:")) {
+		return nil, &CloudError{string(reply)}
+	}
+	return reply, nil
+}
+
+// Register tells the server the node has started with so many slots.
+func (a *NodeClient) Register(slots int) error {
+	_, err := a.call("register", url.Values{"slots": {strconv.Itoa(slots)}}, nil)
+	return err
+}
+
+// Lease asks for a job for the slot; the job is nil when nothing is queued.
+func (a *NodeClient) Lease(slot int) (*Job, []string, error) {
+	reply, err := a.call("lease", url.Values{"slot": {strconv.Itoa(slot)}}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	lease := ApiNodeLease{}
+	if err := json.Unmarshal(reply, &lease); err != nil {
+		return nil, nil, err
+	}
+	return lease.Job, lease.Files, nil
+}
+
+// Fetch downloads a file of a leased job.
+func (a *NodeClient) Fetch(id JobID, user_path string) ([]byte, error) {
+	return a.call("file", url.Values{"id": {string(id)}, "file": {user_path}}, nil)
+}
+
+// Heartbeat keeps the lease with the progress so far; it tells if the job is to be cancelled.
+func (a *NodeClient) Heartbeat(id JobID, progress JobProgress) (bool, error) {
+	data, err := json.Marshal(&progress)
+	if err != nil {
+		return false, err
+	}
+	reply, err := a.call("heartbeat", url.Values{"id": {string(id)}}, data)
+	return string(reply) == "OK:CANCEL", err
+}
+
+// Upload sends the image (kind "image"), the .png along with it (kind "png"), the live image (kind "live")
+// or the log (kind "log") of a job.
+func (a *NodeClient) Upload(id JobID, kind string, data []byte) error {
+	_, err := a.call("upload", url.Values{"id": {string(id)}, "kind": {kind}}, data)
+	return err
+}
+
+// Finish reports the outcome of a job.
+func (a *NodeClient) Finish(id JobID, report JobReport) error {
+	data, err := json.Marshal(&report)
+	if err != nil {
+		return err
+	}
+	_, err = a.call("finish", url.Values{"id": {string(id)}}, data)
+	return err
+}
@@ -0,0 +1,220 @@
+package cloud
+
+/*
+
+  Render nodes.
+
+  Nodes render on machines which do not share the filesystem of the store.
+  An administrator adds a node by name, which gives its token. The node
+  registers with the server, leases jobs over HTTP, downloads the scene with
+  its project folder, renders and uploads the image and the log back.
+  Heartbeats keep the lease; jobs of a node that went away are queued again
+  once the lease expires.
+
+*/
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const nodes_config = "nodes.json"
+
+// Node is a render node known to the store.
+type Node struct {
+	Name  string
+	Token string
+	Host  string // Where it registered from.
+	Slots int
+
+	Registered, Seen time.Time
+}
+
+var nodes_lock sync.Mutex
+
+var node_name = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// NodeStore keeps the render nodes of a cloud.
+type NodeStore struct {
+	cfg *CloudConfig
+}
+
+// Nodes gives access to the render nodes of the store.
+func (a *CloudConfig) Nodes() *NodeStore {
+	return &NodeStore{a}
+}
+
+func (a *NodeStore) place() string {
+	return path.Join(a.cfg.TheRoot, nodes_config)
+}
+
+// NodeWorker names a node in job records.
+func NodeWorker(name string) string {
+	return name + "/node"
+}
+
+// List returns all the nodes by name.
+func (a *NodeStore) List() ([]*Node, error) {
+	nodes := []*Node{}
+	if err := Load(a.place(), &nodes); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Sort(nodes_by_name(nodes))
+	return nodes, nil
+}
+
+type nodes_by_name []*Node
+
+func (a nodes_by_name) Len() int           { return len(a) }
+func (a nodes_by_name) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a nodes_by_name) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// update changes the node list under the lock.
+func (a *NodeStore) update(change func([]*Node) ([]*Node, error)) error {
+	nodes_lock.Lock()
+	defer nodes_lock.Unlock()
+
+	nodes, err := a.List()
+	if err != nil {
+		return err
+	}
+	if nodes, err = change(nodes); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.cfg.TheRoot, 0777); err != nil {
+		return err
+	}
+	// Readers, such as Authorize, must never see it half-written.
+	temp := a.place() + ".tmp"
+	if err := Save(temp, nodes); err != nil {
+		return err
+	}
+	return os.Rename(temp, a.place())
+}
+
+// Add makes a new node with a fresh token.
+func (a *NodeStore) Add(name string) (*Node, error) {
+	if !node_name.MatchString(name) {
+		return nil, &CloudError{"Node names are letters, digits, dots, dashes and underscores: " + name}
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	node := &Node{Name: name, Token: hex.EncodeToString(secret)}
+	err := a.update(func(nodes []*Node) ([]*Node, error) {
+		for _, known := range nodes {
+			if known.Name == name {
+				return nil, &CloudError{"Node already exists: " + name}
+			}
+		}
+		return append(nodes, node), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Remove forgets a node; its running jobs are queued again.
+func (a *NodeStore) Remove(name string) error {
+	err := a.update(func(nodes []*Node) ([]*Node, error) {
+		for i, known := range nodes {
+			if known.Name == name {
+				return append(nodes[:i], nodes[i+1:]...), nil
+			}
+		}
+		return nil, &CloudError{"No such node: " + name}
+	})
+	if err == nil {
+		a.cfg.Jobs().Release(NodeWorker(name))
+	}
+	return err
+}
+
+// Authorize finds the node with the token.
+func (a *NodeStore) Authorize(name, token string) (*Node, error) {
+	nodes, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		if node.Name == name && subtle.ConstantTimeCompare([]byte(node.Token), []byte(token)) == 1 {
+			return node, nil
+		}
+	}
+	return nil, &CloudError{"Node authentication failed"}
+}
+
+// Register notes that a node has started; whatever it was running before is queued again.
+func (a *NodeStore) Register(name, host string, slots int) (*Node, error) {
+	var registered *Node
+	err := a.update(func(nodes []*Node) ([]*Node, error) {
+		for _, node := range nodes {
+			if node.Name == name {
+				now := time.Now()
+				node.Host, node.Slots, node.Registered, node.Seen = host, slots, now, now
+				registered = node
+				return nodes, nil
+			}
+		}
+		return nil, &CloudError{"No such node: " + name}
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.cfg.Jobs().Release(NodeWorker(name))
+	Log("Node " + name + " registered from " + host)
+	return registered, nil
+}
+
+// Seen notes that a node is alive.
+func (a *NodeStore) Seen(name string) error {
+	return a.update(func(nodes []*Node) ([]*Node, error) {
+		for _, node := range nodes {
+			if node.Name == name {
+				node.Seen = time.Now()
+			}
+		}
+		return nodes, nil
+	})
+}
+
+// Files lists user paths a job needs: everything in the folder of its owner, where scenes refer to
+// shared models and materials, except hidden files, job markers and outputs.
+// Scene references are resolved against these alone, whether the job is rendered here or on a node.
+func (a *JobStore) Files(job *Job) ([]string, error) {
+	root := a.cfg.GetRoot(job.Owner)
+	files := []string{}
+	err := filepath.Walk(root, func(where string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case where == root:
+			return nil
+		case info.IsDir() && strings.HasPrefix(info.Name(), "."):
+			return filepath.SkipDir
+		case info.IsDir():
+			return nil
+		}
+		user_path := strings.TrimPrefix(slash(where), slash(root)+"/")
+		switch {
+		case strings.HasPrefix(info.Name(), "."),
+			strings.HasSuffix(user_path, JOB_SUFFIX), strings.HasSuffix(user_path, JOB_OUTPUT_SUFFIX), strings.HasSuffix(user_path, JOB_LIVE_SUFFIX),
+			user_path == job.Output:
+			return nil
+		}
+		files = append(files, user_path)
+		return nil
+	})
+	return files, err
+}
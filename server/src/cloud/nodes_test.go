@@ -0,0 +1,129 @@
+package cloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeRegistry(t *testing.T) {
+	cfg, jobs := test_jobs(t)
+	nodes := cfg.Nodes()
+
+	if _, err := nodes.Add("bad/name"); err == nil {
+		t.Error("Node names must be plain")
+	}
+	node, err := nodes.Add("n1")
+	if err != nil || len(node.Token) != 32 {
+		t.Fatalf("Adding a node: %v %v", node, err)
+	}
+	if _, err := nodes.Add("n1"); err == nil {
+		t.Error("Duplicate node must be refused")
+	}
+	if _, err := nodes.Authorize("n1", "wrong"); err == nil {
+		t.Error("Wrong token must be refused")
+	}
+	if _, err := nodes.Authorize("n1", node.Token); err != nil {
+		t.Error(err.Error())
+	}
+
+	job, _ := jobs.Submit("tester", "house/a.xml")
+	jobs.Claim(SlotWorker(NodeWorker("n1"), 1))
+	if _, err := nodes.Register("n1", "10.0.0.1", 2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if again, _ := jobs.Get(job.ID); again.State != JobQueued {
+		t.Errorf("Jobs of a restarted node should be queued again: %#v", again)
+	}
+
+	// Scenes refer to models and materials of the member outside of their project.
+	for _, name := range []string{"CSLibrairies/Models/Chair.obj", "house/a.xml" + JOB_SUFFIX, ".notes/house", "wood.jpg", ".hidden"} {
+		os.MkdirAll(path.Dir(cfg.GetOsPath("tester", name)), 0777)
+		ioutil.WriteFile(cfg.GetOsPath("tester", name), []byte("."), 0666)
+	}
+	expected := "CSLibrairies/Models/Chair.obj house/a.xml house/b.xml wood.jpg"
+	if files, err := jobs.Files(job); err != nil || strings.Join(files, " ") != expected {
+		t.Errorf("Files of the member are expected, without markers and hidden ones: %v %v", files, err)
+	}
+
+	if err := nodes.Remove("n1"); err != nil {
+		t.Error(err.Error())
+	}
+	if all, _ := nodes.List(); len(all) != 0 {
+		t.Errorf("Removed node is still there: %v", all)
+	}
+}
+
+func TestNodeApi(t *testing.T) {
+	name := fmt.Sprintf("node%d", time.Now().UnixNano())
+	node, err := TheCloud().Nodes().Add(name)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	project := name + "_project"
+	scene, asset := project+"/scene.xml", project+"/models/chair.obj"
+	good_guy.Upload(scene, []byte("<RenderingData/>"))
+	good_guy.Upload(asset, []byte("v 0 0 0"))
+	id := JobID(strings.TrimPrefix(good_guy.JobStart(scene), "OK:"))
+
+	if intruder, _ := NewNodeClient("http://localhost:8080", name, "wrong", ""); intruder.Register(1) == nil {
+		t.Error("Node with a wrong token must be refused")
+	}
+
+	client, _ := NewNodeClient("http://localhost:8080", name, node.Token, "")
+	if err := client.Register(1); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Earlier runs may have left jobs in the test store.
+	var job *Job
+	var files []string
+	for tries := 0; tries < 100 && (job == nil || job.ID != id); tries++ {
+		if job, files, err = client.Lease(1); err != nil || job == nil {
+			t.Fatalf("Lease failed: %v %v", job, err)
+		}
+		if job.ID != id {
+			client.Finish(job.ID, JobReport{State: JobCancelled, Error: "Left by an earlier test"})
+		}
+	}
+
+	shipped := strings.Join(files, " ")
+	if !strings.Contains(shipped, asset) || !strings.Contains(shipped, scene) || strings.Contains(shipped, JOB_SUFFIX) {
+		t.Errorf("Scene and its assets are expected: %v", files)
+	}
+	if data, err := client.Fetch(id, asset); err != nil || string(data) != "v 0 0 0" {
+		t.Errorf("Asset should be fetched: %s %v", data, err)
+	}
+	if _, err := client.Fetch(id, "../sheer_asd/scene.txt"); err == nil {
+		t.Error("Files of other members must not be fetched")
+	}
+
+	if cancel, err := client.Heartbeat(id, JobProgress{Percent: 10}); cancel || err != nil {
+		t.Errorf("Heartbeat failed: %v %v", cancel, err)
+	}
+	good_guy.JobCancel(id)
+	if cancel, _ := client.Heartbeat(id, JobProgress{Percent: 20}); !cancel {
+		t.Error("Node should be told to stop")
+	}
+
+	client.Upload(id, "image", []byte("partial"))
+	if err := client.Finish(id, JobReport{State: JobCancelled, Error: "Cancelled while rendering", CPUSeconds: 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := client.Upload(id, "image", []byte("late")); err == nil {
+		t.Error("Finished job must not take uploads")
+	}
+
+	done, _ := TheCloud().Jobs().Get(id)
+	if done.State != JobCancelled || done.CPUSeconds != 1 || done.Progress.Percent != 0 {
+		t.Errorf("Unexpected record: %#v", done)
+	}
+	if image := string(good_guy.Download(scene + ".png")); image != "partial" {
+		t.Errorf("Image should be in the store, got %s", image)
+	}
+	os.RemoveAll(TheCloud().GetOsPath(good_guy.Login, project))
+}
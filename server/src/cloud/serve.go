@@ -3,6 +3,7 @@ package cloud
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	_ "html/template"
@@ -11,17 +12,20 @@ import (
 	"log"
 	"net/http"
 	"net"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 //---> PlaceConsts
 const JOB_SUFFIX = ".job"
 const JOB_OUTPUT_SUFFIX = ".jobout"
+const JOB_LIVE_SUFFIX = ".live.png"
 
 // Errors
 //---> PlaceErrors Make errors capture traces. (And probably log themselves too?)
@@ -61,6 +65,7 @@ type Company struct {
 type Member struct {
 	FullName,     Login,     Password string
 	Renders,     Storage              int
+	Limits *RenderLimits `json:",omitempty"` // Of render settings; nil takes DefaultLimits.
 }
 
 // Meta holds volatile configuration information which should not be saved.
@@ -130,17 +135,25 @@ func (a *CloudConfig) GetOsPath(login, user_path string) string {
 var cfg = &CloudConfig{
 	Company{"Test Company Inc.", "company", "abc"},
 	[]Member{
-		Member{"Konstantin Levinski", "kdl", "p@ssw0rd", 0, 0},
-		Member{"Alvine Agbo", "alvine", "abc", 0, 0},
-		Member{"Shawn Ignatius", "shawn", "secret", 0, 0},
-		Member{"Sheer Industries", "sheer", "all", 0, 0},
-		Member{"Me", "sheer/abc", "123", 0, 0},
-		Member{"Him", "sheer/asd", "456", 0, 0},
-		Member{"Big CEO", "sheer/important", "7890", 0, 0}},
+		Member{"Konstantin Levinski", "kdl", "p@ssw0rd", 0, 0, nil},
+		Member{"Alvine Agbo", "alvine", "abc", 0, 0, nil},
+		Member{"Shawn Ignatius", "shawn", "secret", 0, 0, nil},
+		Member{"Sheer Industries", "sheer", "all", 0, 0, nil},
+		Member{"Me", "sheer/abc", "123", 0, 0, nil},
+		Member{"Him", "sheer/asd", "456", 0, 0, nil},
+		Member{"Big CEO", "sheer/important", "7890", 0, 0, nil}},
 	os.TempDir(), nil}
 
-func default_configuration() *CloudConfig {
+// cfg_lock guards cfg, which OpenConfig replaces; a configuration in use is not changed.
+var cfg_lock sync.RWMutex
+
+func init() {
 	cfg.organize()
+}
+
+func default_configuration() *CloudConfig {
+	cfg_lock.RLock()
+	defer cfg_lock.RUnlock()
 	return cfg
 }
 
@@ -149,6 +162,13 @@ func TheCloud() *CloudConfig {
 	return default_configuration()
 }
 
+// publish makes the configuration the one of the cloud.
+func publish(a *CloudConfig) {
+	cfg_lock.Lock()
+	cfg = a
+	cfg_lock.Unlock()
+}
+
 /* Simple handlers, no pre-processing needed */
 // version prints out a version
 func version(w http.ResponseWriter, r *http.Request) {
@@ -209,6 +229,12 @@ func send_OK(some io.Writer) error {
 	return nil
 }
 
+// send_json replies with what as JSON.
+func send_json(w http.ResponseWriter, what interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(what)
+}
+
 // crash is here to test
 func worker_crash(w http.ResponseWriter, _ *http.Request) error {
 	say(w, "bye-bye")
@@ -308,6 +334,11 @@ func worker_uploader(w http.ResponseWriter, r *http.Request, info *RequestInfo)
 		return err
 	}
 
+	TheCloud().RecordUsage(info.Who, info.Paths[0], UsageUploaded, float64(len(info.Data)))
+	TheCloud().RecordStored(info.Who, info.Paths[0])
+	TheCloud().Hooks().Fire(HookPayload{Event: EventFileUploaded, Owner: info.Who, Path: info.Paths[0]})
+	FileChanged(info.Who, info.Paths[0], FileUploaded)
+
 	return send_OK(w)
 }
 
@@ -322,6 +353,10 @@ func worker_deleter(w http.ResponseWriter, r *http.Request, info *RequestInfo) e
 		return err
 	}
 
+	TheCloud().RecordStored(info.Who, info.Paths[0])
+	TheCloud().Hooks().Fire(HookPayload{Event: EventFileDeleted, Owner: info.Who, Path: info.Paths[0]})
+	FileChanged(info.Who, info.Paths[0], FileDeleted)
+
 	return send_OK(w)
 }
 
@@ -337,6 +372,7 @@ func worker_downloader(w http.ResponseWriter, r *http.Request, info *RequestInfo
 	} else { // All seem okay.
 		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(data)), 10))
 		w.Write(data)
+		TheCloud().RecordUsage(info.Who, info.Paths[0], UsageDownloaded, float64(len(data)))
 	}
 	return nil // don't print ok.
 }
@@ -544,68 +580,69 @@ func catcher(a func (w http.ResponseWriter, r *http.Request) error) func (w http
 
 // info provides test printout of the params of incloming request ***
 
-// job is API call to start a job ***
-func job(w http.ResponseWriter, r *http.Request) {
-	// Main response:
-	_, err := ioutil.ReadAll(r.Body) // Must read body first
-	if err != nil {
-		say(w, "FAIL: Reading data: " + err.Error())
-		return
+//---> PlaceJobs
+
+// worker_jober queues a render of the scene and puts a mark with the job ID next to it.
+// priority=preview puts it before final renders, timelimit=seconds bounds each attempt;
+// render settings of the scene are overridden as told by ParseRenderSettings.
+func worker_jober(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	if len(info.Paths) < 1 {
+		return &CloudError{"Path to scene to be processed is not provided"}
 	}
 
-	_, file_path, err := user_and_file(r.URL.Query())
-	if err != nil {
-		say(w, "FAIL:" + err.Error())
-		return
+	scene_file := TheCloud().GetOsPath(info.Who, info.Paths[0])
+
+	if err := must_be_file(scene_file); err != nil {
+		return err
 	}
 
-	// Render
-	result := DoJob(string(file_path[0]))
+	job_file := scene_file + JOB_SUFFIX
 
-	say(w, fmt.Sprintf("OK:%s", result))
-}
+	if _, err := os.Stat(job_file); err == nil {
+		return &CloudError{"Job seems to be already submitted"}
+	}
 
-// progress returns the progress of a rendering job being done ***
-func progress(w http.ResponseWriter, r *http.Request) {
-	// Main response:
-	_, err := ioutil.ReadAll(r.Body) // Must read body first
+	priority, err := ParsePriority(r.URL.Query().Get("priority"))
 	if err != nil {
-		say(w, "FAIL: Reading data: " + err.Error())
-		return
+		return err
 	}
 
-	the_user := user(r.URL.Query())
-	if the_user == nil {
-		say(w, "FAIL:" + err.Error())
-		return
+	limit := 0.0
+	if asked := r.URL.Query().Get("timelimit"); asked != "" {
+		if limit, err = strconv.ParseFloat(asked, 64); err != nil || limit <= 0 {
+			return &CloudError{"timelimit parameter must be a positive number of seconds"}
+		}
 	}
 
-	id, ok := r.URL.Query()["id"]
-
-	if !ok {
-		say(w, "FAIL:id parameter is required")
-		return
+	overrides, err := ParseRenderSettings(r.URL.Query())
+	if err != nil {
+		return err
 	}
 
-	// Render
-	result, err := JobDone(JobID(id[0]))
+	job, err := TheCloud().Jobs().SubmitWith(info.Who, info.Paths[0], JobOptions{Priority: priority, TimeLimit: limit, Overrides: overrides})
 	if err != nil {
-		say(w, "FAIL:" + err.Error())
-		return
+		return err
 	}
 
-	if *result {
-		say(w, fmt.Sprintf("OK:DONE"))
-	} else {
-		say(w, fmt.Sprintf("OK:PROGRESS"))
+	if err := ioutil.WriteFile(job_file, []byte(job.ID), 0666); err != nil {
+		return err
 	}
 
+	say(w, "OK:"+string(job.ID))
+	return nil
 }
 
-//---> PlaceJobs
+// ApiJobProgress is what /jobresult sends when format=json is asked for.
+type ApiJobProgress struct {
+	ApiStatus
+	ID    JobID
+	State JobState
+	JobProgress
+}
 
-// worker_jober puts a mark in the cloud to say that the job can be picked up for processing
-func worker_jober(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+// worker_progresser sends the output of the renderer for the scene,
+// or with format=json, the progress of its latest job.
+func worker_progresser(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
 	if len(info.Paths) < 1 {
 		return &CloudError{"Path to scene to be processed is not provided"}
 	}
@@ -616,43 +653,213 @@ func worker_jober(w http.ResponseWriter, r *http.Request, info *RequestInfo) err
 		return err
 	}
 
-	job_file := scene_file + JOB_SUFFIX
-
-	if _, err := os.Stat(job_file); err == nil {
-		return &CloudError{"Job seems to be already submitted"}
+	if r.URL.Query().Get("format") == "json" {
+		job := TheCloud().Jobs().Latest(info.Who, info.Paths[0])
+		if job == nil {
+			return &CloudError{"No job for " + info.Paths[0]}
+		}
+		return send_json(w, &ApiJobProgress{ApiStatus{true, "OK"}, job.ID, job.State, job.Progress})
 	}
 
-	if err := ioutil.WriteFile(job_file, []byte("."), 0666); err != nil {
+	progress_file := scene_file + JOB_OUTPUT_SUFFIX
+
+	if data, err := ioutil.ReadFile(progress_file); err != nil {
 		return err
+	} else {
+		w.Write(data)
+		w.Write([]byte("\n\n"))
 	}
 
 	return send_OK(w)
 }
 
-// worker_uploader puts a file in the cloud
-func worker_progresser(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
-	if len(info.Paths) < 1 {
-		return &CloudError{"Path to scene to be processed is not provided"}
+// own_job reads a job of the member from the id parameter.
+func own_job(r *http.Request, info *RequestInfo) (*Job, error) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return nil, &CloudError{"id parameter is required"}
+	}
+	job, err := TheCloud().Jobs().Get(JobID(id))
+	if err != nil {
+		return nil, err
 	}
+	if job.Owner != info.Who {
+		return nil, &CloudError{"Unknown job"}
+	}
+	return job, nil
+}
 
-	scene_file := TheCloud().GetOsPath(info.Who, info.Paths[0])
+// worker_job_status sends the record of the job given by id, or all the jobs of the member as JSON.
+func worker_job_status(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	if r.URL.Query().Get("id") != "" {
+		job, err := own_job(r, info)
+		if err != nil {
+			return err
+		}
+		return send_json(w, job)
+	}
 
-	if err := must_be_file(scene_file); err != nil {
+	all, err := TheCloud().Jobs().List()
+	if err != nil {
+		return err
+	}
+	own := []*Job{}
+	for _, job := range all {
+		if job.Owner == info.Who {
+			own = append(own, job)
+		}
+	}
+	return send_json(w, own)
+}
+
+// worker_job_done answers OK:DONE once the job given by id is over, as older clients expect.
+func worker_job_done(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	job, err := own_job(r, info)
+	if err != nil {
 		return err
 	}
+	switch job.State {
+	case JobSucceeded:
+		say(w, "OK:DONE")
+	case JobFailed, JobCancelled:
+		return &CloudError{"Job " + string(job.State) + ": " + job.Error}
+	default:
+		say(w, "OK:PROGRESS")
+	}
+	return nil
+}
 
-	progress_file := scene_file + JOB_OUTPUT_SUFFIX
+// worker_job_cancel stops the job given by id. Partial image and log are kept.
+func worker_job_cancel(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	job, err := own_job(r, info)
+	if err != nil {
+		return err
+	}
+	if job, err = TheCloud().Jobs().Cancel(job.ID); err != nil {
+		return err
+	}
+	say(w, "OK:"+strings.ToUpper(string(job.State)))
+	return nil
+}
 
-	if data, err := ioutil.ReadFile(progress_file); err != nil {
+// worker_job_live sends the latest image of the job given by id: the live one while it renders,
+// the final one after, or the .png written along with it when the output is a .tga or an .exr.
+// width=N scales it down to N pixels across.
+func worker_job_live(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	job, err := own_job(r, info)
+	if err != nil {
 		return err
-	} else {
-		w.Write(data)
-		w.Write([]byte("\n\n"))
 	}
+	picture := PNGOf(job.Output)
+	if !job.State.Final() {
+		picture = job.Live
+	}
+	data, err := ioutil.ReadFile(TheCloud().GetOsPath(info.Who, picture))
+	if err != nil {
+		return &CloudError{"No image of job " + string(job.ID) + " yet"}
+	}
+	if asked := r.URL.Query().Get("width"); asked != "" {
+		width, err := strconv.Atoi(asked)
+		if err != nil || width < 1 {
+			return &CloudError{"width parameter must be a positive number"}
+		}
+		if data, err = Thumbnail(data, width); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+	return nil
+}
+
+// parse_admin_inputs_for lets only the company administrator through to the worker.
+func parse_admin_inputs_for(a worker) worker_simple {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		Log("Doing " + r.URL.Path)
+		incoming, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return NewCloudError("Reading data: " + err.Error())
+		}
+		param := r.URL.Query()
+		company := TheCloud().TheCompany
+		if company.Password == "" || param.Get("login") != company.Login || param.Get("password") != company.Password {
+			Log("Failed to resolve administrator for:" + param.Get("login"))
+			return NewCloudError("Authentication failed")
+		}
+		return a(w, r, &RequestInfo{company.Login, nil, incoming})
+	}
+}
+
+// ApiQueueReply is what /admin/queue sends.
+type ApiQueueReply struct {
+	ApiStatus
+	Running []*Job
+	Queued  []*Job // In the order they are going to be picked.
+}
+
+// worker_queue shows the running jobs and the queue to the administrator.
+func worker_queue(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	jobs := TheCloud().Jobs()
+	queued, err := jobs.Queue()
+	if err != nil {
+		return err
+	}
+	all, err := jobs.List()
+	if err != nil {
+		return err
+	}
+	reply := &ApiQueueReply{ApiStatus{true, "OK"}, []*Job{}, queued}
+	for _, job := range all {
+		if job.State == JobRunning {
+			reply.Running = append(reply.Running, job)
+		}
+	}
+	return send_json(w, reply)
+}
 
+// worker_reorder pins the jobs given by id parameters at the front of the queue, in that order.
+// Without ids, all the pins are cleared.
+func worker_reorder(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	ids := []JobID{}
+	for _, id := range r.URL.Query()["id"] {
+		ids = append(ids, JobID(id))
+	}
+	if err := TheCloud().Jobs().Reorder(ids); err != nil {
+		return err
+	}
 	return send_OK(w)
 }
 
+// ApiUsageReply is what /usage sends unless CSV is asked for.
+type ApiUsageReply struct {
+	ApiStatus
+	User ApiUser
+	Days []UsageReport
+}
+
+// worker_usage reports usage of the member by day and project.
+// Parameters from and to are days as YYYY-MM-DD; format=csv gives a CSV export.
+func worker_usage(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	param := r.URL.Query()
+	from, to, err := ParseUsageRange(param.Get("from"), param.Get("to"))
+	if err != nil {
+		return err
+	}
+
+	days, err := TheCloud().Usage(from, to, info.Who)
+	if err != nil {
+		return err
+	}
+
+	if param.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		return WriteUsageCSV(w, days)
+	}
+
+	return send_json(w, &ApiUsageReply{ApiStatus{true, "OK"}, TheCloud().ApiUser(info.Who), days})
+}
+
 // fail is an always-failing call, for testing relevant functions ***
 func fail(w http.ResponseWriter, r *http.Request) error {
 	return &CloudError{"OK"}
@@ -660,16 +867,37 @@ func fail(w http.ResponseWriter, r *http.Request) error {
 
 // --- Service entry points
 
-// Serve starts all the API entry points
-func Serve(port, static string) {
+// ServeOptions specifies where and how the server listens.
+type ServeOptions struct {
+	Port, Static string
+
+	// Network is "tcp4", "tcp6" or "tcp" for both IPv4 and IPv6.
+	Network string
+
+	// TLS is used when both CertFile and KeyFile are given; one without the other is an error.
+	CertFile, KeyFile string
+	// SelfSigned generates CertFile and KeyFile if they do not exist.
+	SelfSigned bool
+	// RedirectPort, if given, serves plain HTTP redirecting to HTTPS.
+	RedirectPort string
+}
+
+// Secure tells if the options ask for HTTPS.
+func (a *ServeOptions) Secure() bool {
+	return a.CertFile != "" && a.KeyFile != ""
+}
+
+// handlers sets up all the API entry points
+func handlers(static string) *http.ServeMux {
+	mux := http.NewServeMux()
 
 	// To remove, likely
-	http.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.Dir(static))))
-	http.HandleFunc("/error", catcher(fail))
+	mux.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.Dir(static))))
+	mux.HandleFunc("/error", catcher(fail))
 
-	http.HandleFunc("/api/login", catcher(api_login))
-	http.HandleFunc("/api/users", catcher(api_users))
-	http.HandleFunc("/api/adduser", catcher(api_adduser))
+	mux.HandleFunc("/api/login", catcher(api_login))
+	mux.HandleFunc("/api/users", catcher(api_users))
+	mux.HandleFunc("/api/adduser", catcher(api_adduser))
 
 	actions := map[string]worker_simple{
 		"/authorize": parse_inputs_for(worker_authorizer),
@@ -679,27 +907,104 @@ func Serve(port, static string) {
 		"/delete":    parse_inputs_for(worker_deleter),
 		"/jobstart":  parse_inputs_for(worker_jober),
 		"/jobresult": parse_inputs_for(worker_progresser),
+		"/jobstatus": parse_inputs_for(worker_job_status),
+		"/job":       parse_inputs_for(worker_jober),
+		"/progress":  parse_inputs_for(worker_job_done),
+		"/jobcancel": parse_inputs_for(worker_job_cancel),
+		"/joblive":   parse_inputs_for(worker_job_live),
+		"/usage":     parse_inputs_for(worker_usage),
+		"/hooks/add":    parse_inputs_for(worker_hook_add),
+		"/hooks/list":   parse_inputs_for(worker_hook_list),
+		"/hooks/remove": parse_inputs_for(worker_hook_remove),
+		"/hooks/log":    parse_inputs_for(worker_hook_log),
+		"/events":       parse_inputs_for(worker_events),
+		"/admin/queue":     parse_admin_inputs_for(worker_queue),
+		"/admin/reorder":   parse_admin_inputs_for(worker_reorder),
+		"/node/register":  parse_node_inputs_for(node_register),
+		"/node/lease":     parse_node_inputs_for(node_lease),
+		"/node/file":      parse_node_inputs_for(node_file),
+		"/node/heartbeat": parse_node_inputs_for(node_heartbeat),
+		"/node/upload":    parse_node_inputs_for(node_upload),
+		"/node/finish":    parse_node_inputs_for(node_finish),
 		"/info":    worker_http(info),
 		"/version": worker_http(version),
-		//	"/job":      worker_http(job),
-		//	"/progress": worker_http(progress),
 		"/crash": worker_crash,
 	}
 
 	for url, action := range actions {
-		http.HandleFunc(url, catch_errors_for(action))
+		mux.HandleFunc(url, catch_errors_for(action))
 	}
+	return mux
+}
 
-	l, e := net.Listen("tcp4", ":"+port)
-	if e != nil {
-		log.Print("Unable to listen:", e.Error())
+// redirect_to_https sends plain HTTP clients to the HTTPS port.
+func redirect_to_https(port string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		target := "https://" + net.JoinHostPort(host, port) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
 	}
+}
 
-	if err := http.Serve(l, nil); err != nil {
+// Serve starts all the API entry points over plain HTTP on IPv4.
+func Serve(port, static string) {
+	if err := ServeWith(ServeOptions{Port: port, Static: static, Network: "tcp4"}); err != nil {
 		log.Print(err.Error())
 	}
 }
 
+// ServeWith starts all the API entry points as specified by the options.
+// It does not return unless serving fails or the options do not make sense.
+func ServeWith(opt ServeOptions) error {
+	if opt.Network == "" {
+		opt.Network = "tcp4"
+	}
+
+	if !opt.Secure() && opt.CertFile+opt.KeyFile != "" {
+		return &CloudError{"HTTPS needs both a certificate and a key, only " + opt.CertFile + opt.KeyFile + " is given"}
+	}
+	if opt.SelfSigned && opt.Secure() {
+		if err := EnsureCertificate(opt.CertFile, opt.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	l, err := net.Listen(opt.Network, ":"+opt.Port)
+	if err != nil {
+		return &CloudError{"Unable to listen:" + err.Error()}
+	}
+
+	server := &http.Server{Handler: handlers(opt.Static)}
+	dispatching.Do(func() {
+		started := TheCloud()
+		go started.Hooks().Dispatch()
+		go started.Jobs().Watch()
+	})
+
+	if !opt.Secure() {
+		return server.Serve(l)
+	}
+
+	if opt.RedirectPort != "" {
+		rl, err := net.Listen(opt.Network, ":"+opt.RedirectPort)
+		if err != nil {
+			l.Close()
+			return &CloudError{"Unable to listen for redirects:" + err.Error()}
+		}
+		go func() {
+			if err := http.Serve(rl, redirect_to_https(opt.Port)); err != nil {
+				log.Print(err.Error())
+			}
+		}()
+	}
+
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	return server.ServeTLS(l, opt.CertFile, opt.KeyFile)
+}
+
 // --- Client for testing
 
 // body reads all the request body for testing
@@ -780,12 +1085,71 @@ func (i Identity) Progress(id JobID) string {
 	return string(Get("progress?login=" + i.Login + "&password=" + i.Password + "&id=" + string(id)))
 }
 
+func (i Identity) Usage(query string) []byte {
+	return Get("usage?login=" + i.Login + "&password=" + i.Password + "&" + query)
+}
+
 func (i Identity) JobStart(remote string) string {
 	log.Print("Starting processing " + remote)
 	return string(Post("jobstart?login=" + i.Login + "&password=" + i.Password + "&file=" + remote, []byte{}))
 }
 
+func (i Identity) JobStartWith(remote string, overrides url.Values) string {
+	log.Print("Starting processing " + remote + " with " + overrides.Encode())
+	return string(Post("jobstart?login=" + i.Login + "&password=" + i.Password + "&file=" + remote + "&" + overrides.Encode(), []byte{}))
+}
+
+func (i Identity) JobPreview(remote string) string {
+	log.Print("Starting preview of " + remote)
+	return string(Post("jobstart?login=" + i.Login + "&password=" + i.Password + "&priority=preview&file=" + remote, []byte{}))
+}
+
+func (i Identity) Queue() []byte {
+	return Get("admin/queue?login=" + i.Login + "&password=" + i.Password)
+}
+
+func (i Identity) Reorder(ids ...JobID) string {
+	query := ""
+	for _, id := range ids {
+		query += "&id=" + string(id)
+	}
+	return string(Post("admin/reorder?login=" + i.Login + "&password=" + i.Password + query, []byte{}))
+}
+
+func (i Identity) JobStatus(id JobID) []byte {
+	return Get("jobstatus?login=" + i.Login + "&password=" + i.Password + "&id=" + string(id))
+}
+
+func (i Identity) JobCancel(id JobID) string {
+	log.Print("Cancelling job " + id)
+	return string(Post("jobcancel?login=" + i.Login + "&password=" + i.Password + "&id=" + string(id), []byte{}))
+}
+
+func (i Identity) JobLive(id JobID, width int) []byte {
+	return Get("joblive?login=" + i.Login + "&password=" + i.Password + "&id=" + string(id) + "&width=" + strconv.Itoa(width))
+}
+
+func (i Identity) HookAdd(target string, events ...HookEvent) []byte {
+	query := url.Values{"login": {i.Login}, "password": {i.Password}, "url": {target}}
+	for _, event := range events {
+		query.Add("event", string(event))
+	}
+	return Post("hooks/add?"+query.Encode(), []byte{})
+}
+
+func (i Identity) HookLog(id string) []byte {
+	return Get("hooks/log?login=" + i.Login + "&password=" + i.Password + "&id=" + id)
+}
+
+func (i Identity) Events(since uint64, wait int) []byte {
+	return Get(fmt.Sprintf("events?login=%s&password=%s&mode=poll&since=%d&wait=%d", i.Login, i.Password, since, wait))
+}
+
 func (i Identity) JobResult(remote string) string {
 	log.Print("Getting reslut of a job ")
 	return string(Post("jobresult?login=" + i.Login + "&password=" + i.Password + "&file=" + remote, []byte{}))
 }
+
+func (i Identity) JobProgress(remote string) []byte {
+	return Get("jobresult?login=" + i.Login + "&password=" + i.Password + "&format=json&file=" + remote)
+}
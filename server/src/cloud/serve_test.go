@@ -1,8 +1,16 @@
 package cloud
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -25,7 +33,7 @@ func TestFileParameter(t *testing.T) {
 		t.Errorf("Error getting files: %v", err)
 	}
 	if len(files) != 1 || string(files[0]) != "abc/"+name {
-		t.Error("Parameter was not correctly extracted: %v", files)
+		t.Errorf("Parameter was not correctly extracted: %v", files)
 	}
 }
 
@@ -149,7 +157,7 @@ func TestBadFileParameter(t *testing.T) {
 }
 
 func TestJobStart(t *testing.T) {
-	scene_file := "scene_wow.txt"
+	scene_file := fmt.Sprintf("scene_wow%d.txt", time.Now().UnixNano())
 	t.Log("Testing jobs")
 	t.Log(good_guy.Delete(scene_file))
 	t.Log(good_guy.Delete(scene_file + JOB_SUFFIX))
@@ -157,17 +165,207 @@ func TestJobStart(t *testing.T) {
 	good_guy.Upload(scene_file, []byte("123")) // A scene file
 	started, not_there := good_guy.JobStart(scene_file), good_guy.JobStart("not"+scene_file)
 	key := string(good_guy.Download(scene_file + JOB_SUFFIX))
+	id := JobID(strings.TrimPrefix(started, "OK:"))
 
 	switch {
-	case strings.Contains(started, "FAIL"):
+	case !strings.HasPrefix(started, "OK:"):
 		t.Error(started)
 	case !strings.Contains(not_there, "FAIL"):
 		t.Error(not_there)
-	case strings.Contains(key, "FAIL"):
-		t.Error(key)
+	case key != string(id):
+		t.Errorf("Marker should hold the job ID: %s", key)
+	case !strings.Contains(good_guy.JobStart(scene_file), "FAIL"):
+		t.Error("Job should not be started twice")
+	}
+
+	job := Job{}
+	if err := json.Unmarshal(good_guy.JobStatus(id), &job); err != nil {
+		t.Fatal(err.Error())
+	}
+	if job.ID != id || job.State != JobQueued || job.Owner != good_guy.Login || job.Output != scene_file+".png" {
+		t.Errorf("Unexpected job record: %#v", job)
+	}
+
+	progress := ApiJobProgress{}
+	if err := json.Unmarshal(good_guy.JobProgress(scene_file), &progress); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !progress.Success || progress.ID != id || progress.State != JobQueued {
+		t.Errorf("Unexpected progress: %#v", progress)
+	}
+
+	if progress := good_guy.Progress(id); progress != "OK:PROGRESS" {
+		t.Errorf("Queued job should be in progress, got %s", progress)
+	}
+	if other := string(Identity{"sheer/asd", "456"}.JobStatus(id)); !strings.Contains(other, "FAIL") {
+		t.Errorf("Jobs of others must not be visible: %s", other)
+	}
+
+	TheCloud().Jobs().Finish(id, JobSucceeded, "")
+	if progress := good_guy.Progress(id); progress != "OK:DONE" {
+		t.Errorf("Finished job should be done, got %s", progress)
 	}
 }
 
+func TestJobCancelApi(t *testing.T) {
+	scene_file := fmt.Sprintf("scene_cancel%d.txt", time.Now().UnixNano())
+	good_guy.Upload(scene_file, []byte("123"))
+	id := JobID(strings.TrimPrefix(good_guy.JobStart(scene_file), "OK:"))
+
+	if other := (Identity{"sheer/asd", "456"}).JobCancel(id); !strings.Contains(other, "FAIL") {
+		t.Errorf("Jobs of others must not be cancelled: %s", other)
+	}
+	if cancelled := good_guy.JobCancel(id); cancelled != "OK:CANCELLED" {
+		t.Errorf("Queued job should be cancelled at once, got %s", cancelled)
+	}
+	if progress := good_guy.Progress(id); !strings.Contains(progress, "FAIL") || !strings.Contains(progress, "cancelled") {
+		t.Errorf("Cancelled job should be reported, got %s", progress)
+	}
+	if again := good_guy.JobCancel(id); !strings.Contains(again, "FAIL") {
+		t.Errorf("Job can not be cancelled twice: %s", again)
+	}
+}
+
+func TestJobLiveApi(t *testing.T) {
+	scene_file := fmt.Sprintf("scene_live%d.txt", time.Now().UnixNano())
+	good_guy.Upload(scene_file, []byte("123"))
+	id := JobID(strings.TrimPrefix(good_guy.JobStart(scene_file), "OK:"))
+	defer good_guy.JobCancel(id)
+
+	if reply := string(good_guy.JobLive(id, 10)); !strings.Contains(reply, "FAIL") {
+		t.Errorf("There is no image before the render: %s", reply)
+	}
+
+	picture := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		picture.Set(x, 5, color.White)
+	}
+	live := bytes.Buffer{}
+	png.Encode(&live, picture)
+	job, _ := TheCloud().Jobs().Get(id)
+	ioutil.WriteFile(TheCloud().GetOsPath(good_guy.Login, job.Live), live.Bytes(), 0666)
+
+	if whole := good_guy.JobLive(id, 100); !bytes.Equal(whole, live.Bytes()) {
+		t.Error("Wide enough image should be sent as it is")
+	}
+	small, err := png.Decode(bytes.NewReader(good_guy.JobLive(id, 10)))
+	if err != nil || small.Bounds() != image.Rect(0, 0, 10, 5) {
+		t.Fatalf("Image should be scaled down: %v", err)
+	}
+	if r, _, _, _ := small.At(3, 1).RGBA(); r == 0 || r == 0xffff {
+		t.Error("A line a pixel high should be averaged into the thumbnail")
+	}
+	if other := string((Identity{"sheer/asd", "456"}).JobLive(id, 10)); !strings.Contains(other, "FAIL") {
+		t.Errorf("Images of others must not be sent: %s", other)
+	}
+}
+
+func TestJobLiveTGA(t *testing.T) {
+	scene_file := fmt.Sprintf("scene_live_tga%d.txt", time.Now().UnixNano())
+	good_guy.Upload(scene_file, []byte("123"))
+	id := JobID(strings.TrimPrefix(good_guy.JobStartWith(scene_file, url.Values{"format": {"tga"}}), "OK:"))
+	job, err := TheCloud().Jobs().Get(id)
+	if err != nil || path.Ext(job.Output) != ".tga" {
+		t.Fatalf("Job should render a tga: %v", err)
+	}
+
+	picture := bytes.Buffer{}
+	png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	ioutil.WriteFile(TheCloud().GetOsPath(good_guy.Login, job.Output), []byte("not a png"), 0666)
+	ioutil.WriteFile(TheCloud().GetOsPath(good_guy.Login, PNGOf(job.Output)), picture.Bytes(), 0666)
+	if _, err := TheCloud().Jobs().Finish(id, JobSucceeded, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if whole := good_guy.JobLive(id, 100); !bytes.Equal(whole, picture.Bytes()) {
+		t.Errorf("The png along with the tga should be sent: %s", whole)
+	}
+	small, err := png.Decode(bytes.NewReader(good_guy.JobLive(id, 10)))
+	if err != nil || small.Bounds() != image.Rect(0, 0, 10, 5) {
+		t.Errorf("The png along with the tga should be scaled down: %v", err)
+	}
+}
+
+func TestQueueApi(t *testing.T) {
+	company := TheCloud().TheCompany
+	admin := Identity{company.Login, company.Password}
+	scene_file := fmt.Sprintf("scene_preview%d.txt", time.Now().UnixNano())
+	good_guy.Upload(scene_file, []byte("123"))
+	id := JobID(strings.TrimPrefix(good_guy.JobPreview(scene_file), "OK:"))
+	defer good_guy.JobCancel(id)
+
+	if reply := string(good_guy.Queue()); !strings.Contains(reply, "FAIL") {
+		t.Errorf("Only the administrator sees the queue: %s", reply)
+	}
+	if reply := admin.Reorder(id); reply != "OK" {
+		t.Errorf("Reordering failed: %s", reply)
+	}
+
+	queue := ApiQueueReply{}
+	if err := json.Unmarshal(admin.Queue(), &queue); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(queue.Queued) == 0 || queue.Queued[0].ID != id || queue.Queued[0].Priority != PriorityPreview || queue.Queued[0].Pin != 1 {
+		t.Errorf("Pinned preview should be first: %v", queue.Queued)
+	}
+	admin.Reorder()
+}
+
 func TestApi(t *testing.T) {
 
 }
+
+func TestServeTLS(t *testing.T) {
+	place := path.Join(os.TempDir(), fmt.Sprintf("cloud_tls%d", time.Now().UnixNano()))
+	for _, half := range []ServeOptions{{CertFile: path.Join(place, "cert.pem")}, {KeyFile: path.Join(place, "key.pem"), SelfSigned: true}} {
+		half.Port, half.Static = "8444", ui_dir
+		if err := ServeWith(half); err == nil || !strings.Contains(err.Error(), "both") {
+			t.Errorf("A certificate without its key, or the other way round, should be refused: %v", err)
+		}
+	}
+	opt := ServeOptions{
+		Port:         "8443",
+		Static:       ui_dir,
+		Network:      "tcp",
+		CertFile:     path.Join(place, "cert.pem"),
+		KeyFile:      path.Join(place, "key.pem"),
+		SelfSigned:   true,
+		RedirectPort: "8081",
+	}
+	go func() {
+		if err := ServeWith(opt); err != nil {
+			t.Log(err.Error())
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get("https://localhost:8443/version")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := string(body(resp)); got != Version {
+		t.Errorf("Expected version over HTTPS, got %s", got)
+	}
+
+	resp, err = client.Get("http://localhost:8081/version?a=1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if where := resp.Header.Get("Location"); where != "https://localhost:8443/version?a=1" {
+		t.Errorf("Unexpected redirect to [%s]", where)
+	}
+
+	if resp, err := client.Get("http://localhost:8443/version"); err == nil {
+		if got := string(body(resp)); got == Version {
+			t.Error("Plain HTTP must not be served on HTTPS port")
+		}
+	}
+}
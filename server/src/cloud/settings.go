@@ -0,0 +1,155 @@
+package cloud
+
+/*
+
+  Render settings.
+
+  A job may override what its scene says about resolution, samples, sampler,
+  field of view and output format. The renderer records what it actually used
+  in the job. Members are limited in how much they may ask for, so that one
+  render can not take a node for a week.
+
+*/
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Samplers luxconsole knows; the first one is used unless asked otherwise.
+var Samplers = []string{"metropolis", "lowdiscrepancy", "random", "erpt"}
+
+// Formats of the resulting image; the first one is used unless asked otherwise.
+var Formats = []string{"png", "tga", "exr"}
+
+// RenderSettings are the parameters of a render. Zero values are taken from the scene.
+type RenderSettings struct {
+	Width   int     `json:",omitempty"` // Pixels.
+	Height  int     `json:",omitempty"`
+	HaltSPP int     `json:",omitempty"` // Samples per pixel before the renderer stops.
+	Sampler string  `json:",omitempty"`
+	FOV     float64 `json:",omitempty"` // Degrees.
+	Format  string  `json:",omitempty"`
+	Debug   bool    `json:",omitempty"` // A small quick render to check the scene.
+	Draft   bool    `json:",omitempty"` // Rasterized in seconds instead of rendered, to check the layout.
+}
+
+// DebugResolution is the size of debug renders.
+const DebugResolution = 100
+
+// RenderLimits bound the settings a member may render with; zero is no limit.
+type RenderLimits struct {
+	Width, Height int
+	HaltSPP       int
+}
+
+// DefaultLimits apply to members that have no limits of their own.
+var DefaultLimits = RenderLimits{Width: 4096, Height: 4096, HaltSPP: 10000}
+
+func one_of(what string, choices []string) bool {
+	for _, choice := range choices {
+		if what == choice {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRenderSettings reads overrides from the parameters of a request:
+// width, height, haltspp or quality (haltspp is 20 more), sampler, fov, format, debug,
+// and type, which is render or draft.
+func ParseRenderSettings(query url.Values) (RenderSettings, error) {
+	s := RenderSettings{}
+	positive := func(name string, into *int) error {
+		asked := query.Get(name)
+		if asked == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(asked)
+		if err != nil || n <= 0 {
+			return &CloudError{name + " parameter must be a positive integer"}
+		}
+		*into = n
+		return nil
+	}
+	for name, into := range map[string]*int{"width": &s.Width, "height": &s.Height, "haltspp": &s.HaltSPP} {
+		if err := positive(name, into); err != nil {
+			return s, err
+		}
+	}
+	if asked := query.Get("quality"); asked != "" {
+		if s.HaltSPP != 0 {
+			return s, &CloudError{"Either haltspp or quality may be given, not both"}
+		}
+		quality, err := strconv.Atoi(asked)
+		if err != nil || quality < 0 {
+			return s, &CloudError{"quality parameter must be a non-negative integer"}
+		}
+		s.HaltSPP = 20 + quality
+	}
+	if asked := query.Get("fov"); asked != "" {
+		fov, err := strconv.ParseFloat(asked, 64)
+		if err != nil || fov <= 0 || fov >= 180 {
+			return s, &CloudError{"fov parameter must be between 0 and 180 degrees"}
+		}
+		s.FOV = fov
+	}
+	s.Sampler, s.Format = query.Get("sampler"), query.Get("format")
+	if s.Sampler != "" && !one_of(s.Sampler, Samplers) {
+		return s, &CloudError{fmt.Sprintf("Unknown sampler %s, expected one of %v", s.Sampler, Samplers)}
+	}
+	if s.Format != "" && !one_of(s.Format, Formats) {
+		return s, &CloudError{fmt.Sprintf("Unknown format %s, expected one of %v", s.Format, Formats)}
+	}
+	switch query.Get("debug") {
+	case "", "0", "false":
+	case "1", "true":
+		s.Debug = true
+	default:
+		return s, &CloudError{"debug parameter must be true or false"}
+	}
+	switch query.Get("type") {
+	case "", "render":
+	case "draft":
+		if s.Format == "exr" {
+			return s, &CloudError{"Drafts are not written as exr"}
+		}
+		s.Draft = true
+	default:
+		return s, &CloudError{"type parameter must be render or draft"}
+	}
+	return s, nil
+}
+
+// Check tells if the settings are within the limits.
+func (a RenderLimits) Check(s RenderSettings) error {
+	if (a.Width > 0 && s.Width > a.Width) || (a.Height > 0 && s.Height > a.Height) {
+		return &CloudError{fmt.Sprintf("Resolution %dx%d is over the limit of %dx%d", s.Width, s.Height, a.Width, a.Height)}
+	}
+	if a.HaltSPP > 0 && s.HaltSPP > a.HaltSPP {
+		return &CloudError{fmt.Sprintf("%d samples per pixel is over the limit of %d", s.HaltSPP, a.HaltSPP)}
+	}
+	return nil
+}
+
+// LimitsOf gives the render limits of a member.
+func (a *CloudConfig) LimitsOf(login string) RenderLimits {
+	if mbr, err := a.member(login); err == nil && mbr.Limits != nil {
+		return *mbr.Limits
+	}
+	return DefaultLimits
+}
+
+// SetLimits changes the render limits of a member; nil goes back to DefaultLimits.
+func (a *CloudConfig) SetLimits(login string, limits *RenderLimits) error {
+	mbr, err := a.member(login)
+	if err != nil {
+		return err
+	}
+	if limits != nil && (limits.Width < 0 || limits.Height < 0 || limits.HaltSPP < 0) {
+		return &CloudError{"Limits can not be negative"}
+	}
+	mbr.Limits = limits
+	return nil
+}
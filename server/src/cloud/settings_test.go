@@ -0,0 +1,90 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRenderSettings(t *testing.T) {
+	good := map[string]RenderSettings{
+		"":                                   {},
+		"width=800&height=600":               {Width: 800, Height: 600},
+		"quality=30&sampler=erpt&format=exr": {HaltSPP: 50, Sampler: "erpt", Format: "exr"},
+		"haltspp=64&fov=45.5&debug=true":     {HaltSPP: 64, FOV: 45.5, Debug: true},
+		"type=draft&format=tga":              {Format: "tga", Draft: true},
+	}
+	for query, expected := range good {
+		values, _ := url.ParseQuery(query)
+		if got, err := ParseRenderSettings(values); err != nil || got != expected {
+			t.Errorf("%s should give %#v, got %#v %v", query, expected, got, err)
+		}
+	}
+	for _, query := range []string{"width=-1", "height=big", "haltspp=10&quality=5", "fov=200", "sampler=fast", "format=jpg", "debug=maybe", "type=sketch", "type=draft&format=exr"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := ParseRenderSettings(values); err == nil {
+			t.Errorf("%s must be refused", query)
+		}
+	}
+}
+
+func TestRenderLimits(t *testing.T) {
+	cfg, jobs := test_jobs(t)
+	if cfg.LimitsOf("tester") != DefaultLimits {
+		t.Errorf("Members without limits have the default ones: %v", cfg.LimitsOf("tester"))
+	}
+	if cfg.SetLimits("tester", &RenderLimits{Width: -1}) == nil || cfg.SetLimits("nobody", nil) == nil {
+		t.Error("Bad limits must be refused")
+	}
+	cfg.SetLimits("tester", &RenderLimits{Width: 1000, Height: 1000})
+
+	if _, err := jobs.SubmitWith("tester", "house/a.xml", JobOptions{Overrides: RenderSettings{Width: 2000}}); err == nil {
+		t.Error("Overrides beyond the limits must be refused")
+	}
+	job, err := jobs.SubmitWith("tester", "house/a.xml", JobOptions{Overrides: RenderSettings{Width: 800, HaltSPP: 50000, Format: "exr"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if job.Output != "house/a.xml.exr" || job.Limits != (RenderLimits{Width: 1000, Height: 1000}) {
+		t.Errorf("Job should have the format and the limits of the owner: %#v", job)
+	}
+
+	used := RenderSettings{Width: 800, Height: 450, HaltSPP: 50000, Sampler: "metropolis", FOV: 30, Format: "exr"}
+	jobs.Claim("w")
+	jobs.Complete(job.ID, "w", JobReport{State: JobSucceeded, Settings: used})
+	if job, _ = jobs.Get(job.ID); job.Settings != used || job.Attempts[0].Settings != used {
+		t.Errorf("Settings used should be recorded: %#v", job)
+	}
+
+	cfg.SetLimits("tester", nil)
+	if cfg.LimitsOf("tester") != DefaultLimits {
+		t.Error("Limits should go back to the default ones")
+	}
+}
+
+func TestJobStartSettings(t *testing.T) {
+	scene := fmt.Sprintf("settings%d/scene.xml", time.Now().UnixNano())
+	good_guy.Upload(scene, []byte("<RenderingData/>"))
+
+	if bad := good_guy.JobStartWith(scene, url.Values{"sampler": {"fast"}}); !strings.Contains(bad, "FAIL") {
+		t.Errorf("Unknown sampler must be refused: %s", bad)
+	}
+	if bad := good_guy.JobStartWith(scene, url.Values{"width": {"100000"}}); !strings.Contains(bad, "limit") {
+		t.Errorf("Resolution beyond the limits must be refused: %s", bad)
+	}
+	started := good_guy.JobStartWith(scene, url.Values{"width": {"640"}, "quality": {"10"}, "format": {"tga"}})
+	if !strings.HasPrefix(started, "OK:") {
+		t.Fatalf("Job should start: %s", started)
+	}
+	id := JobID(strings.TrimPrefix(started, "OK:"))
+	defer good_guy.JobCancel(id)
+
+	job := Job{}
+	json.Unmarshal(good_guy.JobStatus(id), &job)
+	if job.Overrides != (RenderSettings{Width: 640, HaltSPP: 30, Format: "tga"}) || job.Output != scene+".tga" {
+		t.Errorf("Overrides should be kept in the job: %#v", job)
+	}
+}
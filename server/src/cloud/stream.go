@@ -0,0 +1,242 @@
+package cloud
+
+/*
+
+  Push events.
+
+  Clients subscribe to changes of their jobs and files instead of polling.
+  Job records written by this process are noticed as they are saved; those
+  written by a scanner in its own process are noticed by watching .jobs/.
+  Jobs are followed until they are final, and then soon forgotten.
+  Recent events are kept, numbered, so that a client reconnecting with the
+  last number it has seen gets what it missed.
+
+*/
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamKind tells what an event is about.
+type StreamKind string
+
+const (
+	StreamJobState    StreamKind = "job.state"    // A job was submitted or changed its state.
+	StreamJobProgress StreamKind = "job.progress" // The renderer reported how far it is.
+	StreamFileChanged StreamKind = "file.changed" // A file was uploaded, deleted or rendered.
+)
+
+// File changes of StreamFileChanged events.
+const (
+	FileUploaded = "uploaded"
+	FileDeleted  = "deleted"
+	FileRendered = "rendered"
+)
+
+// StreamEvent is a change pushed to the clients of its owner.
+type StreamEvent struct {
+	Seq    uint64
+	Kind   StreamKind
+	Owner  string `json:"-"`
+	Time   time.Time
+	Job    *Job   `json:",omitempty"`
+	Path   string `json:",omitempty"` // User path of a file event.
+	Change string `json:",omitempty"` // How the file changed.
+}
+
+// StreamFilter picks the events a client subscribed to.
+// No jobs and no folders means all the events of the owner.
+type StreamFilter struct {
+	Owner   string
+	Jobs    []JobID
+	Folders []string // User paths; everything below them.
+}
+
+// Matches tells if the event is one the client asked for.
+func (a *StreamFilter) Matches(event *StreamEvent) bool {
+	if event.Owner != a.Owner {
+		return false
+	}
+	if len(a.Jobs) == 0 && len(a.Folders) == 0 {
+		return true
+	}
+	where := event.Path
+	if event.Job != nil {
+		for _, id := range a.Jobs {
+			if id == event.Job.ID {
+				return true
+			}
+		}
+		where = event.Job.Scene
+	}
+	for _, folder := range a.Folders {
+		folder = strings.Trim(folder, "/")
+		if folder == "" || where == folder || strings.HasPrefix(where, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// stream_backlog is how many recent events are kept for clients catching up.
+const stream_backlog = 1000
+
+// stream_buffer is how many events a subscriber may fall behind before it is dropped.
+const stream_buffer = 256
+
+// StreamPoll is how often job records are checked for changes made by other processes.
+var StreamPoll = time.Second
+
+// job_seen is what was last told about a job.
+type job_seen struct {
+	state   JobState
+	updated time.Time
+}
+
+// stream_forget is how long jobs told to be final are remembered, so that a record read again
+// by Watch is not told twice; it is well beyond StreamPoll.
+const stream_forget = time.Minute
+
+// event_broker hands events to subscribers and remembers the recent ones.
+type event_broker struct {
+	lock        sync.Mutex
+	seq         uint64
+	recent      []*StreamEvent
+	subscribers map[chan *StreamEvent]*StreamFilter
+	jobs        map[JobID]job_seen  // Jobs not final yet.
+	finished    map[JobID]time.Time // Jobs told to be final, and when.
+}
+
+var stream = &event_broker{
+	subscribers: map[chan *StreamEvent]*StreamFilter{},
+	jobs:        map[JobID]job_seen{},
+	finished:    map[JobID]time.Time{},
+}
+
+// publish numbers the event and sends it to the subscribers that want it.
+// Subscribers too slow to keep up are dropped; they catch up when they come back.
+func (a *event_broker) publish(event *StreamEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.seq++
+	event.Seq, event.Time = a.seq, time.Now()
+	a.recent = append(a.recent, event)
+	if len(a.recent) > stream_backlog {
+		a.recent = a.recent[len(a.recent)-stream_backlog:]
+	}
+	for events, filter := range a.subscribers {
+		if !filter.Matches(event) {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			delete(a.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// job_changed publishes what changed in a job since it was last seen.
+// Final jobs are forgotten, but for a while.
+func (a *event_broker) job_changed(job *Job) {
+	a.lock.Lock()
+	if _, told := a.finished[job.ID]; told && job.State.Final() {
+		a.lock.Unlock()
+		return
+	}
+	seen, known := a.jobs[job.ID]
+	if job.State.Final() {
+		delete(a.jobs, job.ID)
+		now := time.Now()
+		for id, when := range a.finished {
+			if now.Sub(when) > stream_forget {
+				delete(a.finished, id)
+			}
+		}
+		a.finished[job.ID] = now
+	} else {
+		a.jobs[job.ID] = job_seen{job.State, job.Progress.Updated}
+	}
+	a.lock.Unlock()
+
+	switch {
+	case !known || seen.state != job.State:
+		a.publish(&StreamEvent{Kind: StreamJobState, Owner: job.Owner, Job: job})
+		if job.State == JobSucceeded {
+			a.publish(&StreamEvent{Kind: StreamFileChanged, Owner: job.Owner, Path: job.Output, Change: FileRendered})
+		}
+	case !seen.updated.Equal(job.Progress.Updated):
+		a.publish(&StreamEvent{Kind: StreamJobProgress, Owner: job.Owner, Job: job})
+	}
+}
+
+// subscribe starts sending events of the filter, after those since the given number.
+// It returns the missed events, the number of the latest event, and the channel of the next ones.
+func (a *event_broker) subscribe(filter *StreamFilter, since uint64) ([]*StreamEvent, uint64, chan *StreamEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	missed := []*StreamEvent{}
+	for _, event := range a.recent {
+		if event.Seq > since && filter.Matches(event) {
+			missed = append(missed, event)
+		}
+	}
+	events := make(chan *StreamEvent, stream_buffer)
+	a.subscribers[events] = filter
+	return missed, a.seq, events
+}
+
+// unsubscribe stops sending events; the channel may have been dropped already.
+func (a *event_broker) unsubscribe(events chan *StreamEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.subscribers[events]; ok {
+		delete(a.subscribers, events)
+		close(events)
+	}
+}
+
+// latest is the number of the latest event.
+func (a *event_broker) latest() uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.seq
+}
+
+// FileChanged tells the clients of the owner about a file.
+func FileChanged(owner, user_path, change string) {
+	stream.publish(&StreamEvent{Kind: StreamFileChanged, Owner: owner, Path: user_path, Change: change})
+}
+
+// Watch publishes changes of job records written by other processes, such as the scanner.
+func (a *JobStore) Watch() {
+	last := time.Now()
+	for {
+		time.Sleep(StreamPoll)
+		entries, err := ioutil.ReadDir(a.place())
+		if err != nil {
+			continue
+		}
+		newest := last
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".json") || entry.ModTime().Before(last) {
+				continue
+			}
+			if entry.ModTime().After(newest) {
+				newest = entry.ModTime()
+			}
+			// Records this process wrote were told about already, and are skipped as unchanged.
+			if job, err := a.Get(JobID(strings.TrimSuffix(path.Base(entry.Name()), ".json"))); err == nil {
+				stream.job_changed(job)
+			}
+		}
+		last = newest
+	}
+}
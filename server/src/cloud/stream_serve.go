@@ -0,0 +1,120 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ApiEvents is what /events sends in long-poll mode.
+type ApiEvents struct {
+	ApiStatus
+	Events []*StreamEvent
+	Last   uint64 // Pass it as since to get what comes next.
+}
+
+// StreamPing is how often an idle event stream sends a comment, to keep proxies from closing it.
+var StreamPing = 15 * time.Second
+
+// stream_wait_max bounds how long a long-poll request waits.
+const stream_wait_max = 60
+
+// stream_filter reads job=<id>&job=...&folder=<path>&folder=... of the request.
+func stream_filter(r *http.Request, info *RequestInfo) *StreamFilter {
+	filter := &StreamFilter{Owner: info.Who, Folders: r.URL.Query()["folder"]}
+	for _, id := range r.URL.Query()["job"] {
+		filter.Jobs = append(filter.Jobs, JobID(id))
+	}
+	return filter
+}
+
+// worker_events pushes changes of the jobs and folders of the member as server-sent events,
+// or with mode=poll, waits up to wait seconds for them and replies with ApiEvents.
+// since, or the Last-Event-ID header of a reconnecting client, asks for the events after it.
+func worker_events(w http.ResponseWriter, r *http.Request, info *RequestInfo) error {
+	param := r.URL.Query()
+	since := param.Get("since")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	from := stream.latest()
+	if since != "" {
+		var err error
+		if from, err = strconv.ParseUint(since, 10, 64); err != nil {
+			return &CloudError{"since parameter must be an event number"}
+		}
+	}
+	missed, last, events := stream.subscribe(stream_filter(r, info), from)
+	defer stream.unsubscribe(events)
+
+	if param.Get("mode") == "poll" {
+		wait := 25
+		if asked := param.Get("wait"); asked != "" {
+			var err error
+			if wait, err = strconv.Atoi(asked); err != nil || wait < 0 {
+				return &CloudError{"wait parameter must be seconds"}
+			}
+		}
+		if wait > stream_wait_max {
+			wait = stream_wait_max
+		}
+		if len(missed) == 0 {
+			select {
+			case event, ok := <-events:
+				if ok {
+					missed = append(missed, event)
+				}
+			case <-time.After(time.Duration(wait) * time.Second):
+			case <-r.Context().Done():
+				return nil
+			}
+		}
+		if len(missed) > 0 {
+			last = missed[len(missed)-1].Seq
+		}
+		return send_json(w, &ApiEvents{ApiStatus{true, "OK"}, missed, last})
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &CloudError{"Streaming is not supported"}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(event *StreamEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Kind, data)
+		return err
+	}
+	fmt.Fprintf(w, "retry: 2000\n\n")
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(StreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil // Fell behind; the client reconnects and catches up.
+			}
+			if err := send(event); err != nil {
+				return nil
+			}
+		case <-ping.C:
+			fmt.Fprintf(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
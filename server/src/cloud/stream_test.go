@@ -0,0 +1,151 @@
+package cloud
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamFilter(t *testing.T) {
+	job := &Job{ID: "1", Owner: "tester", Scene: "house/a.xml"}
+	events := []*StreamEvent{
+		{Kind: StreamJobState, Owner: "tester", Job: job},
+		{Kind: StreamFileChanged, Owner: "tester", Path: "house/models/chair.obj"},
+		{Kind: StreamFileChanged, Owner: "tester", Path: "housekeeping.txt"},
+		{Kind: StreamFileChanged, Owner: "other", Path: "house/a.xml"},
+	}
+	expect := func(filter StreamFilter, matches ...bool) {
+		for i, event := range events {
+			if filter.Matches(event) != matches[i] {
+				t.Errorf("%v should match %v: %v", filter, *event, matches[i])
+			}
+		}
+	}
+	expect(StreamFilter{Owner: "tester"}, true, true, true, false)
+	expect(StreamFilter{Owner: "tester", Folders: []string{"house/"}}, true, true, false, false)
+	expect(StreamFilter{Owner: "tester", Jobs: []JobID{"1"}}, true, false, false, false)
+	expect(StreamFilter{Owner: "tester", Jobs: []JobID{"2"}, Folders: []string{"house/models"}}, false, true, false, false)
+}
+
+// wait_events long-polls until events of the kinds come, in that order.
+func wait_events(t *testing.T, since uint64, kinds ...StreamKind) ([]*StreamEvent, uint64) {
+	got := []*StreamEvent{}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(got) < len(kinds) && time.Now().Before(deadline) {
+		reply := ApiEvents{}
+		if err := json.Unmarshal(good_guy.Events(since, 2), &reply); err != nil || !reply.Success {
+			t.Fatalf("Long-poll failed: %v %v", reply, err)
+		}
+		got, since = append(got, reply.Events...), reply.Last
+	}
+	if len(got) < len(kinds) {
+		t.Fatalf("Expected %v, got %d events", kinds, len(got))
+	}
+	for i, kind := range kinds {
+		if got[i].Kind != kind {
+			t.Errorf("Event %d should be %s: %#v", i, kind, got[i])
+		}
+	}
+	return got, since
+}
+
+// TestStreamForgets keeps the jobs known to the broker down to those not final yet.
+func TestStreamForgets(t *testing.T) {
+	broker := &event_broker{subscribers: map[chan *StreamEvent]*StreamFilter{}, jobs: map[JobID]job_seen{}, finished: map[JobID]time.Time{}}
+	job := &Job{ID: "1", Owner: "tester", Scene: "house/a.xml", Output: "house/a.xml.png", State: JobQueued}
+	broker.job_changed(job)
+	if len(broker.jobs) != 1 {
+		t.Fatalf("Queued job should be known: %v", broker.jobs)
+	}
+
+	done := *job
+	done.State = JobSucceeded
+	broker.job_changed(&done)
+	if len(broker.jobs) != 0 || broker.seq != 3 {
+		t.Errorf("Finished job should be told, with its picture, and forgotten: %v, %d events", broker.jobs, broker.seq)
+	}
+	broker.job_changed(&done) // Read again by Watch.
+	if broker.seq != 3 {
+		t.Errorf("Finished job should be told once, %d events", broker.seq)
+	}
+
+	broker.finished[done.ID] = time.Now().Add(-2 * stream_forget)
+	other := Job{ID: "2", Owner: "tester", State: JobCancelled}
+	broker.job_changed(&other)
+	if _, kept := broker.finished[done.ID]; kept || len(broker.finished) != 1 {
+		t.Errorf("Jobs finished long ago should be forgotten: %v", broker.finished)
+	}
+}
+
+func TestEventsApi(t *testing.T) {
+	reply := ApiEvents{}
+	json.Unmarshal(good_guy.Events(0, 0), &reply)
+	last := reply.Last
+
+	scene := fmt.Sprintf("events%d/scene.txt", time.Now().UnixNano())
+	good_guy.Upload(scene, []byte("123"))
+	id := JobID(strings.TrimPrefix(good_guy.JobStart(scene), "OK:"))
+	got, last := wait_events(t, last, StreamFileChanged, StreamJobState)
+	if got[0].Path != scene || got[0].Change != FileUploaded || got[1].Job.ID != id || got[1].Job.State != JobQueued {
+		t.Errorf("Unexpected events: %#v %#v", got[0], got[1])
+	}
+
+	// The scanner writes records in its own process.
+	job, _ := TheCloud().Jobs().Get(id)
+	job.Progress = JobProgress{Percent: 50, Updated: time.Now()}
+	Save(TheCloud().Jobs().record(id), job)
+	got, last = wait_events(t, last, StreamJobProgress)
+	if got[0].Job.Progress.Percent != 50 {
+		t.Errorf("Progress should be told: %#v", got[0].Job)
+	}
+
+	good_guy.JobCancel(id)
+	wait_events(t, last, StreamJobState)
+}
+
+func TestEventStream(t *testing.T) {
+	folder := fmt.Sprintf("stream%d", time.Now().UnixNano())
+	query := url.Values{"login": {good_guy.Login}, "password": {good_guy.Password}, "folder": {folder}}
+	resp, err := http.Get("http://localhost:8080/events?" + query.Encode())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected content: %s", resp.Header.Get("Content-Type"))
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	good_guy.Upload("elsewhere.txt", []byte("123"))
+	good_guy.Upload(folder+"/a.txt", []byte("123"))
+	event, data := "", ""
+	for data == "" {
+		select {
+		case line := <-lines:
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No event in time")
+		}
+	}
+	if event != string(StreamFileChanged) || !strings.Contains(data, folder+"/a.txt") {
+		t.Errorf("Only the file in the folder should be told: %s %s", event, data)
+	}
+}
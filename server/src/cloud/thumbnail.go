@@ -0,0 +1,47 @@
+package cloud
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Thumbnail scales a PNG image down to the width, keeping its aspect.
+// Images already as narrow are returned as they are.
+func Thumbnail(data []byte, width int) ([]byte, error) {
+	picture, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &CloudError{"Not a PNG image: " + err.Error()}
+	}
+	from := picture.Bounds()
+	if width >= from.Dx() {
+		return data, nil
+	}
+	height := from.Dy() * width / from.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	// Each pixel averages the box of the original it covers.
+	small := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := from.Min.Y+y*from.Dy()/height, from.Min.Y+(y+1)*from.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := from.Min.X+x*from.Dx()/width, from.Min.X+(x+1)*from.Dx()/width
+			var r, g, b, a, n uint64 // Boxes of big images hold more than uint32 sums.
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := picture.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			small.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	out := bytes.Buffer{}
+	if err := png.Encode(&out, small); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
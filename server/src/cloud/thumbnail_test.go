@@ -0,0 +1,33 @@
+package cloud
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestThumbnail(t *testing.T) {
+	big := image.NewRGBA(image.Rect(0, 0, 1000, 1000))
+	for i := range big.Pix {
+		big.Pix[i] = 255
+	}
+	data := bytes.Buffer{}
+	png.Encode(&data, big)
+
+	small, err := Thumbnail(data.Bytes(), 3)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	picture, err := png.Decode(bytes.NewReader(small))
+	if err != nil || picture.Bounds().Dx() != 3 || picture.Bounds().Dy() != 3 {
+		t.Fatalf("Expected 3x3, got %v %v", picture, err)
+	}
+	if got := color.RGBAModel.Convert(picture.At(1, 1)); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Big boxes should stay white, got %v", got)
+	}
+	if _, err := Thumbnail([]byte("not a picture"), 3); err == nil {
+		t.Error("Only PNG images are expected")
+	}
+}
@@ -0,0 +1,328 @@
+package cloud
+
+/*
+
+  Usage accounting.
+
+  Every upload, download, deletion and render appends an event to a daily
+  journal in .usage/ at the root of the store. Both the server and the
+  scanner write there, so appends are kept to a single line each.
+  Reports aggregate the journal per day, member and project folder,
+  the folders under Projects/ or else the top ones.
+
+*/
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageKind names the resource being accounted.
+type UsageKind string
+
+const (
+	UsageStored     UsageKind = "stored"     // Bytes in the project folder after a change.
+	UsageUploaded   UsageKind = "uploaded"   // Bytes received.
+	UsageDownloaded UsageKind = "downloaded" // Bytes sent.
+	UsageRender     UsageKind = "render"     // Render CPU-seconds.
+)
+
+const usage_dir = ".usage"
+const usage_day = "2006-01-02"
+
+// no_project is used for files kept outside of any project folder.
+const no_project = "-"
+
+// projects_dir holds the project folders of a member.
+const projects_dir = "Projects"
+
+// UsageEvent is a single journal entry.
+type UsageEvent struct {
+	When    time.Time
+	Login   string
+	Project string
+	Kind    UsageKind
+	Amount  float64
+}
+
+// UsageReport is usage of a project of a member during a day.
+type UsageReport struct {
+	Day             string
+	Login           string
+	Project         string
+	BytesStored     int64
+	BytesUploaded   int64
+	BytesDownloaded int64
+	RenderSeconds   float64
+}
+
+var usage_lock sync.Mutex
+
+// ProjectOf returns the project of a user path.
+func ProjectOf(user_path string) string {
+	project, _ := project_folder(user_path)
+	return project
+}
+
+// project_folder returns the project of a user path and the user path of its folder.
+// Projects are the folders under Projects/, as the desktop keeps them;
+// other top folders, such as the libraries, are accounted as projects of their own.
+func project_folder(user_path string) (string, string) {
+	parts := strings.Split(strings.Trim(slash(user_path), "/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		return no_project, ""
+	}
+	if !strings.EqualFold(parts[0], projects_dir) {
+		return parts[0], parts[0]
+	}
+	if len(parts) < 3 || parts[1] == "" {
+		return no_project, ""
+	}
+	return parts[1], parts[0] + "/" + parts[1]
+}
+
+// Owner finds the member and the user path for a location inside the store.
+func (a *CloudConfig) Owner(os_path string) (login, user_path string, ok bool) {
+	os_path = slash(os_path)
+	for _, mbr := range a.TheMembers {
+		root := slash(a.GetRoot(mbr.Login)) + "/"
+		if strings.HasPrefix(os_path, root) {
+			return mbr.Login, strings.TrimPrefix(os_path, root), true
+		}
+	}
+	return "", "", false
+}
+
+// RecordUsage appends an event to the journal; failures are only logged.
+func (a *CloudConfig) RecordUsage(login, user_path string, kind UsageKind, amount float64) {
+	event := UsageEvent{time.Now(), login, ProjectOf(user_path), kind, amount}
+	data, err := json.Marshal(&event)
+	if err != nil {
+		Log("Unable to account usage: " + err.Error())
+		return
+	}
+
+	usage_lock.Lock()
+	defer usage_lock.Unlock()
+
+	journal := path.Join(a.TheRoot, usage_dir, event.When.Format(usage_day)+".log")
+	if err = os.MkdirAll(path.Dir(journal), 0777); err != nil {
+		Log("Unable to account usage: " + err.Error())
+		return
+	}
+	f, err := os.OpenFile(journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		Log("Unable to account usage: " + err.Error())
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// RecordStored notes how much the project of the user path takes now.
+func (a *CloudConfig) RecordStored(login, user_path string) {
+	project, folder := project_folder(user_path)
+	var size int64
+	if project != no_project {
+		filepath.Walk(a.GetOsPath(login, folder), func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+	} else if info, err := os.Stat(a.GetOsPath(login, user_path)); err == nil && !info.IsDir() {
+		size = info.Size() // Only the file itself is known.
+	}
+	a.RecordUsage(login, user_path, UsageStored, float64(size))
+}
+
+// Usage aggregates the journal for days from..to inclusive.
+// Empty login means all the members.
+// Stored bytes are carried over from earlier days until they change.
+func (a *CloudConfig) Usage(from, to time.Time, login string) ([]UsageReport, error) {
+	first, last := from.Format(usage_day), to.Format(usage_day)
+
+	journals, err := ioutil.ReadDir(path.Join(a.TheRoot, usage_dir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	type key struct{ login, project string }
+	stored := map[key]int64{}
+	rows := map[string]map[key]*UsageReport{}
+
+	get := func(day string, k key) *UsageReport {
+		if rows[day] == nil {
+			rows[day] = map[key]*UsageReport{}
+		}
+		if rows[day][k] == nil {
+			rows[day][k] = &UsageReport{Day: day, Login: k.login, Project: k.project}
+		}
+		return rows[day][k]
+	}
+
+	// carry starts a day with the stored bytes known so far.
+	carry := func(day string) {
+		for k, bytes := range stored {
+			get(day, k).BytesStored = bytes
+		}
+	}
+
+	// Quiet days in the range still take storage, so they are visited too.
+	has_journal := map[string]bool{}
+	for _, journal := range journals {
+		day := strings.TrimSuffix(journal.Name(), ".log")
+		if day != journal.Name() && day <= last {
+			has_journal[day] = true
+		}
+	}
+	days := []string{}
+	for day := range has_journal {
+		days = append(days, day)
+	}
+	for day := from; day.Format(usage_day) <= last; day = day.AddDate(0, 0, 1) {
+		if !has_journal[day.Format(usage_day)] {
+			days = append(days, day.Format(usage_day))
+		}
+	}
+	sort.Strings(days)
+
+	for _, day := range days {
+		in_range := day >= first
+		if in_range {
+			carry(day)
+		}
+		if !has_journal[day] {
+			continue
+		}
+		events, err := read_usage(path.Join(a.TheRoot, usage_dir, day+".log"))
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if login != "" && event.Login != login {
+				continue
+			}
+			k := key{event.Login, event.Project}
+			if event.Kind == UsageStored {
+				stored[k] = int64(event.Amount)
+			}
+			if !in_range {
+				continue
+			}
+			row := get(day, k)
+			switch event.Kind {
+			case UsageStored:
+				row.BytesStored = int64(event.Amount)
+			case UsageUploaded:
+				row.BytesUploaded += int64(event.Amount)
+			case UsageDownloaded:
+				row.BytesDownloaded += int64(event.Amount)
+			case UsageRender:
+				row.RenderSeconds += event.Amount
+			}
+		}
+	}
+
+	result := []UsageReport{}
+	for _, per_day := range rows {
+		for _, row := range per_day {
+			result = append(result, *row)
+		}
+	}
+	sort.Sort(usage_order(result))
+	return result, nil
+}
+
+// read_usage reads all the events from a journal, skipping damaged lines.
+func read_usage(journal string) ([]UsageEvent, error) {
+	f, err := os.Open(journal)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := []UsageEvent{}
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		event := UsageEvent{}
+		if err := json.Unmarshal(scnr.Bytes(), &event); err != nil {
+			Log("Skipping usage entry in " + journal + ": " + err.Error())
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scnr.Err()
+}
+
+type usage_order []UsageReport
+
+func (a usage_order) Len() int      { return len(a) }
+func (a usage_order) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a usage_order) Less(i, j int) bool {
+	switch {
+	case a[i].Day != a[j].Day:
+		return a[i].Day < a[j].Day
+	case a[i].Login != a[j].Login:
+		return a[i].Login < a[j].Login
+	}
+	return a[i].Project < a[j].Project
+}
+
+// WriteUsageCSV exports usage reports for spreadsheets and billing.
+func WriteUsageCSV(w io.Writer, rows []UsageReport) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"day", "login", "project", "bytes_stored", "bytes_uploaded", "bytes_downloaded", "render_seconds"})
+	for _, row := range rows {
+		out.Write([]string{row.Day, row.Login, row.Project,
+			fmt.Sprint(row.BytesStored), fmt.Sprint(row.BytesUploaded), fmt.Sprint(row.BytesDownloaded),
+			fmt.Sprintf("%.1f", row.RenderSeconds)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// ParseUsageRange reads from and to days, defaulting to the last 30 days.
+func ParseUsageRange(from, to string) (time.Time, time.Time, error) {
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	var err error
+	if to != "" {
+		if end, err = time.Parse(usage_day, to); err != nil {
+			return start, end, &CloudError{"Bad date, expected YYYY-MM-DD: " + to}
+		}
+	}
+	if from != "" {
+		if start, err = time.Parse(usage_day, from); err != nil {
+			return start, end, &CloudError{"Bad date, expected YYYY-MM-DD: " + from}
+		}
+	}
+	if start.After(end) {
+		return start, end, &CloudError{"Range starts after it ends"}
+	}
+	return start, end, nil
+}
+
+// ApiUser describes the member with current storage use.
+func (a *CloudConfig) ApiUser(login string) ApiUser {
+	result := ApiUser{Name: login}
+	if mbr := a.GetUser(login); mbr != nil {
+		result.Name = mbr.FullName
+		result.Usage.BytesAllowed = mbr.Storage << 20
+	}
+	if used, _, err := a.DiskUsage(login); err == nil {
+		result.Usage.BytesUsed = int(used)
+	}
+	return result
+}
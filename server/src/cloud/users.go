@@ -63,13 +63,6 @@ func GetUser(login, password string) *User {
 	return &u
 }
 
-var test_guys = Users{
-	User{Login: "sheer", Password: "all", Name: "Sheer Industries"},
-	User{Login: "sheer/abc", Password: "123", Name: "Me"},
-	User{Login: "sheer/asd", Password: "456", Name: "Him"},
-	User{Login: "sheer/important", Password: "7890", Name: "Big CEO"},
-}
-
 func DumpUsers() (result Users) {
 	result = Users{}
 	for _, user := range by_login {
@@ -17,6 +17,8 @@ import (
 	"text/template"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 )
 
 // ConvertError indicates a problem in the conversion process.
@@ -27,7 +29,7 @@ type ConvertError struct {
 
 func (a ConvertError) Error() string {
 	if a.CausedBy != nil {
-		return a.Reason + " [" + a.Error() + "]"
+		return a.Reason + " [" + a.CausedBy.Error() + "]"
 	}
 	return a.Reason
 }
@@ -111,6 +113,94 @@ type XMLShaderParam struct {
 	B float32 `xml:"b,attr"`
 }
 
+// XMLMaterial is the material a designer gave to a part of a model.
+// Ambience is read, but LUX has no use for it: light in the scene does that.
+type XMLMaterial struct {
+	Shininess                   float32 `xml:"shinniness,attr"` // Sic; 0 to 128, as in OpenGL.
+	Diffuse, Ambience, Specular XMLShaderParam
+}
+
+// XMLSubGeode is a group of a model, by name, with its material.
+type XMLSubGeode struct {
+	Name     string `xml:"name,attr"`
+	Material XMLMaterial
+}
+
+// LUX makes the designer's material into a LUX one of that name, over the one the model had:
+// its images stay, tinted by the diffuse colour. Alpha of the diffuse colour is the opacity;
+// without one the material is opaque.
+func (a XMLMaterial) LUX(name string, over LUXMaterial) LUXMaterial {
+	rgb := func(c XMLShaderParam) [3]float32 {
+		return [3]float32{c.R, c.G, c.B}
+	}
+	over.Name = strings.Replace(name, "\"", "", -1)
+	over.Kd, over.Ks = rgb(a.Diffuse), rgb(a.Specular)
+	over.Roughness = float32(math.Sqrt(2 / (float64(a.Shininess) + 2)))
+	over.Glossy = over.Ks != [3]float32{}
+	over.Opacity = a.Diffuse.A
+	if over.Opacity <= 0 || over.Opacity > 1 {
+		over.Opacity = 1
+	}
+	return over
+}
+
+// XMLLight is a light of the scene. Its type is PointSource, SpotSource, DirectionalSource
+// or AreaSource; a cut-off angle under 90 degrees makes a spot of any type.
+type XMLLight struct {
+	Type                string         `xml:"type,attr"`
+	SpotCutOffAngle     float32        `xml:",attr"` // Degrees between the axis and the edge; -1 for none.
+	Intensity           float32        `xml:",attr"` // Times the usual strength; 1 when not given.
+	Size                float32        `xml:",attr"` // Radius of an area light.
+	Position, Direction XMLPosition    // Spot and directional lights shine towards the centre of the view without a direction.
+	Diffuse, Specular   XMLShaderParam // Light is of the diffuse colour; LUX has no separate highlights.
+}
+
+// DefaultAreaSize is the radius of area lights that do not tell.
+var DefaultAreaSize float32 = 10
+
+// LUX makes the light, aimed at centre unless it has a direction.
+func (a XMLLight) LUX(centre [3]float32) LUXScener {
+	from := [3]float32{a.Position.X, a.Position.Y, a.Position.Z}
+	to := centre
+	if a.Direction != (XMLPosition{}) {
+		to = [3]float32{from[0] + a.Direction.X, from[1] + a.Direction.Y, from[2] + a.Direction.Z}
+	}
+	intensity := a.Intensity
+	if intensity <= 0 {
+		intensity = 1
+	}
+	emission := func(usual float32) LUXEmission {
+		return LUXEmission{[3]float32{a.Diffuse.R, a.Diffuse.G, a.Diffuse.B}, usual * intensity}
+	}
+
+	kind := strings.ToLower(a.Type)
+	kind = strings.TrimSuffix(strings.TrimSuffix(kind, "source"), "light")
+	if a.SpotCutOffAngle > 0 && a.SpotCutOffAngle < 90 {
+		kind = "spot"
+	}
+	switch kind {
+	case "spot":
+		cone := a.SpotCutOffAngle
+		if cone <= 0 || cone >= 90 {
+			log.Printf("Spot light cut-off of %g degrees is taken as 30", cone)
+			cone = 30
+		}
+		return LUXSpotLight{from, to, cone, emission(LightGain)}
+	case "directional", "distant":
+		return LUXDistantLight{from, to, emission(DistantGain)}
+	case "area":
+		size := a.Size
+		if size <= 0 {
+			size = DefaultAreaSize
+		}
+		return LUXAreaLight{size, from, emission(AreaPower)}
+	case "point", "":
+	default:
+		log.Printf("Light of type %s is taken as a point light", a.Type)
+	}
+	return LUXLight{from, emission(LightGain)}
+}
+
 // RenderingData specifies the components needed for conversion.
 // The required information is which scene to use, what objects to include,
 // how to position camera and lights.
@@ -120,10 +210,8 @@ type RenderingData struct {
 	LibraryItem []struct {
 	Transform           string
 	Path                string
-	LibraryItemSubGeode []struct {
-	Material struct {
-	Shininess string "xml:shininess,attr"
-}}}}
+	LibraryItemSubGeode []XMLSubGeode
+}}
 	RenderingSettings struct {
 	Camera struct {
 	Quality int
@@ -133,15 +221,15 @@ type RenderingData struct {
 	FOV            int `xml:"fov,attr"`
 	Resolution_X   int `xml:",attr"`
 	Resolution_Y   int `xml:",attr"`
-	AspectRatio_X  float32 `xml:",attr"`
+	AspectRatio_X  float32 `xml:",attr"` // Of a pixel.
 	AspectRatio_Y  float32 `xml:",attr"`
+	OrthoHeight    float32 `xml:",attr"` // As LUXLens.
+	LensRadius     float32 `xml:",attr"`
+	FocalDistance  float32 `xml:",attr"`
 }
 }
 	Lights struct {
-	Lights []struct {
-	Position                                   XMLPosition
-	Diffuse,                          Specular XMLShaderParam
-}
+	Lights []XMLLight
 }
 }
 }
@@ -186,11 +274,70 @@ func ReadConfigurationFile(some string) (res * RenderingData, err error) {
  */
 
 
+// OSGTKind is the type of a value in an OSGT file.
+type OSGTKind int
+
+const (
+	OSGTWord   OSGTKind = iota // Class and property names, enumerations, TRUE and FALSE.
+	OSGTNumber                 // Decimal, or hexadecimal such as masks.
+	OSGTString                 // Quoted.
+)
+
+// OSGTValue is a value of a line, with its text: unquoted for strings.
+type OSGTValue struct {
+	Kind   OSGTKind
+	Text   string
+	Number float64
+}
+
 // OSGTEntry is a node in OSG scene graph (tree, in this case).
 // Each node contains a key and a list of sub-nodes.
+// The key is the line as written, without the braces; Values are its pieces.
 type OSGTEntry struct {
-	Key string
-	Child * OSGT
+	Key    string
+	Child  * OSGT
+	Values []OSGTValue
+	Line   int
+}
+
+// Name is the first value of the entry: the class or the property it is.
+func (a OSGTEntry) Name() string {
+	if len(a.Values) == 0 {
+		return ""
+	}
+	return a.Values[0].Text
+}
+
+// Numbers gives the values of the entry, when they are all numbers, as rows of arrays are.
+func (a OSGTEntry) Numbers() ([]float64, bool) {
+	out := make([]float64, len(a.Values))
+	for i, v := range a.Values {
+		if v.Kind != OSGTNumber {
+			return nil, false
+		}
+		out[i] = v.Number
+	}
+	return out, true
+}
+
+// Quoted gives the first quoted value of the entry, such as a file name.
+func (a OSGTEntry) Quoted() (string, bool) {
+	for _, v := range a.Values {
+		if v.Kind == OSGTString {
+			return v.Text, true
+		}
+	}
+	return "", false
+}
+
+// OSGTError tells where an OSGT file went wrong.
+type OSGTError struct {
+	Line   int
+	Reason string
+}
+
+func (a OSGTError) Error() string {
+	return fmt.Sprintf("line %d: %s", a.Line, a.Reason)
 }
 
 type OSGT struct {
@@ -239,6 +386,29 @@ func (an *OSGT) FindKey(pattern string) string {
 }
 
 
+// Entry gives the first entry of the block that is named so, without looking deeper.
+func (an *OSGT) Entry(name string) (OSGTEntry, bool) {
+	for _, item := range an.List {
+		if item.Name() == name {
+			return item, true
+		}
+	}
+	return OSGTEntry{}, false
+}
+
+// Rows gives the numbers of an array block, a row per entry, or tells the line that is not numbers.
+func (an *OSGT) Rows() ([][]float64, error) {
+	res := make([][]float64, len(an.List))
+	for i, item := range an.List {
+		row, ok := item.Numbers()
+		if !ok || item.Child != nil {
+			return nil, OSGTError{item.Line, "array row " + item.Key + " is not numbers"}
+		}
+		res[i] = row
+	}
+	return res, nil
+}
+
 // print_indent is a simple pretty-printer for OSG tree.
 func (an * OSGT) print_indent(indent string) string {
 	out := ""
@@ -251,10 +421,136 @@ func (an * OSGT) print_indent(indent string) string {
 	return out
 }
 
-// readOSGT reads OSG tree from an io.Reader
+// readOSGT reads OSG tree from an io.Reader.
+// An entry is a line; a brace opens a block of entries for the one before it,
+// on the line or just above, and blocks may be opened and closed on the same line.
+// Quoted strings may have braces, and quotes escaped by a backslash. Comments start with #.
 func readOSGT(some io.Reader) (*OSGT, error) {
+	root := NewOSGT()
+	stack, opened := []*OSGT{root}, []int{} // Blocks being read and the lines they open on
 	scnr := bufio.NewScanner(some)
-	return scanOSGT(scnr)
+	scnr.Buffer(nil, 16*1024*1024) // Long arrays of indices
+	at := 0
+
+	for scnr.Scan() {
+		at++
+		tokens, err := osgt_tokens(scnr.Text())
+		if err != "" {
+			return nil, OSGTError{at, err}
+		}
+		entry, raw := OSGTEntry{Line: at}, []string{}
+		flush := func() {
+			if len(entry.Values) > 0 {
+				entry.Key = strings.Join(raw, " ")
+				top := stack[len(stack)-1]
+				top.List = append(top.List, entry)
+			}
+			entry, raw = OSGTEntry{Line: at}, []string{}
+		}
+		for _, token := range tokens {
+			switch {
+			case !token.quoted && token.text == "{":
+				top := stack[len(stack)-1]
+				if len(entry.Values) == 0 { // For the entry above
+					last := len(top.List) - 1
+					if last < 0 || top.List[last].Child != nil {
+						return nil, OSGTError{at, "block has no name"}
+					}
+					top.List[last].Child = NewOSGT()
+					stack, opened = append(stack, top.List[last].Child), append(opened, at)
+					continue
+				}
+				entry.Child = NewOSGT()
+				child := entry.Child
+				flush()
+				stack, opened = append(stack, child), append(opened, at)
+			case !token.quoted && token.text == "}":
+				flush()
+				if len(stack) == 1 {
+					return nil, OSGTError{at, "} closes no block"}
+				}
+				stack, opened = stack[:len(stack)-1], opened[:len(opened)-1]
+			default:
+				entry.Values = append(entry.Values, token.value())
+				raw = append(raw, token.raw)
+			}
+		}
+		flush()
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	if len(opened) > 0 {
+		return nil, OSGTError{opened[len(opened)-1], "{ is not closed"}
+	}
+	return root, nil
+}
+
+// osgt_token is a piece of a line: a value, or a brace.
+type osgt_token struct {
+	text   string // Unquoted.
+	raw    string // As written.
+	quoted bool
+}
+
+func (a osgt_token) value() OSGTValue {
+	if a.quoted {
+		return OSGTValue{Kind: OSGTString, Text: a.text}
+	}
+	if n, err := strconv.ParseFloat(a.text, 64); err == nil {
+		return OSGTValue{OSGTNumber, a.text, n}
+	}
+	if n, err := strconv.ParseInt(a.text, 0, 64); err == nil { // Such as 0xffffffff
+		return OSGTValue{OSGTNumber, a.text, float64(n)}
+	}
+	if i := strings.Index(a.text, ".#"); i > 0 { // Windows writes 1.#INF, -1.#IND, -1.#QNAN
+		if n, err := strconv.ParseFloat(a.text[:i], 64); err == nil {
+			switch special := a.text[i+2:]; {
+			case strings.HasPrefix(special, "INF"):
+				return OSGTValue{OSGTNumber, a.text, math.Inf(int(n))}
+			case strings.HasPrefix(special, "IND"), strings.HasPrefix(special, "QNAN"), strings.HasPrefix(special, "SNAN"):
+				return OSGTValue{OSGTNumber, a.text, math.NaN()}
+			}
+		}
+	}
+	return OSGTValue{Kind: OSGTWord, Text: a.text}
+}
+
+// osgt_tokens splits a line; it tells what is wrong, if anything.
+func osgt_tokens(line string) ([]osgt_token, string) {
+	out := []osgt_token{}
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			return out, ""
+		case c == '{' || c == '}':
+			out = append(out, osgt_token{line[i : i+1], line[i : i+1], false})
+			i++
+		case c == '"':
+			text, end := []byte{}, i+1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' && end+1 < len(line) {
+					end++
+				}
+				text = append(text, line[end])
+			}
+			if end >= len(line) {
+				return nil, "string is not closed"
+			}
+			out = append(out, osgt_token{string(text), line[i : end+1], true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(line) && !strings.ContainsRune(" \t\r{}\"", rune(line[end])) {
+				end++
+			}
+			out = append(out, osgt_token{line[i:end], line[i:end], false})
+			i = end
+		}
+	}
+	return out, ""
 }
 
 // ReadFileOSGT parses specifed .osgt file into *OSGT structure.
@@ -268,6 +564,7 @@ func ReadFileOSGT(some string) (*OSGT, error) {
 }
 
 // ReadFileOBJ parses specifed .obj file into *OBJ structure.
+// With OBJErrors the model is still given, without the lines in error.
 func ReadFileOBJ(some string) (*OBJ, error) {
 	f, err := os.Open(some)
 	if err != nil {
@@ -279,34 +576,6 @@ func ReadFileOBJ(some string) (*OBJ, error) {
 
 
 
-func scanOSGT(some * bufio.Scanner) (*OSGT, error) {
-
-	out := NewOSGT()
-	for some.Scan() {
-		a_line := some.Text()
-
-		if err := some.Err(); err != nil {
-			return nil, err // Return whatever we have
-		}
-		a_line = strings.Trim(a_line, " \n\t")
-		if strings.Contains(a_line, "}") {
-			return out, nil
-		}
-		var depth * OSGT = nil;
-		if strings.Contains(a_line, "{") {
-			a_line = strings.Replace(a_line, "{", "", 1)
-			a_line = strings.Trim(a_line, " \n\t") // Getting rid of extra space
-			inside, err := scanOSGT(some)
-			if err != nil {
-				return nil, err
-			}
-			depth = inside;
-		}
-		out.List = append(out.List, OSGTEntry{a_line, depth})
-	}
-	return out, nil
-}
-
 // OBJ
 
 type OBJTriad [3]float32
@@ -320,18 +589,45 @@ type OBJFaceVertex struct {
 
 type OBJFace []OBJFaceVertex
 
+// OBJGeode is a run of faces sharing a group, an object and a material.
 type OBJGeode struct {
-	Name  string
-	Faces []OBJFace
+	Name     string // Of the group.
+	Object   string
+	Material string // As named by usemtl, to look up in the Libraries.
+	Faces    []OBJFace
 }
 
 // OBJ structure contains all the components read from .osg file.
 // It is used for generating .lux and .collada files
 type OBJ struct {
-	Vertices []OBJVector
-	Normals  []OBJNormal
-	UWs      []OBJUW
-	Geodes   []OBJGeode
+	Vertices  []OBJVector
+	Normals   []OBJNormal
+	UWs       []OBJUW
+	Geodes    []OBJGeode
+	Libraries []string   // Material libraries, as named by mtllib.
+	Warnings  []OBJError // What was read but is left out of the model.
+
+	Materials map[string]LUXMaterial // By the name geodes use, once loaded.
+}
+
+// OBJError tells what is wrong on a line of an .obj file.
+type OBJError struct {
+	Line   int
+	Reason string
+}
+
+func (a OBJError) Error() string {
+	return fmt.Sprintf("line %d: %s", a.Line, a.Reason)
+}
+
+// OBJErrors are all the errors of a file.
+type OBJErrors []OBJError
+
+func (a OBJErrors) Error() string {
+	if len(a) == 1 {
+		return a[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more)", a[0].Error(), len(a)-1)
 }
 
 func (an * OBJ) boundingBox() (min, max OBJVector) {
@@ -361,58 +657,187 @@ func (an * OBJ) boundingBox() (min, max OBJVector) {
 
 // TODO: move parsing logic into respective parts of the scene
 
-// readOBJ reads .obj format with simplistic scanner and outputs OBJ structure.
+// obj_not_drawn are statements of the format that are known, but have nothing to render.
+var obj_not_drawn = map[string]bool{
+	"l": true, "p": true, "vp": true, "cstype": true, "deg": true, "bmat": true, "step": true,
+	"curv": true, "curv2": true, "surf": true, "parm": true, "trim": true, "hole": true,
+	"scrv": true, "sp": true, "end": true, "con": true, "mg": true, "bevel": true,
+	"c_interp": true, "d_interp": true, "lod": true, "maplib": true, "usemap": true,
+	"shadow_obj": true, "trace_obj": true, "ctech": true, "stech": true,
+}
+
+// readOBJ reads the Wavefront .obj format and outputs OBJ structure.
+// Face vertices are v, v/t, v//n or v/t/n; negative indices count back from the latest
+// definition. The indices are kept one-based and absolute, zero where not given.
+// A new geode starts with each g, o and usemtl. Smoothing groups are checked but not kept,
+// the normals of the file are used as they are.
+// Lines in error are left out: the rest of the model is returned along with OBJErrors.
+// Statements that are not drawn, such as lines and curves, are noted once in Warnings.
 func readOBJ(r io.Reader) (*OBJ, error) {
-	res := &OBJ{ []OBJVector{}, []OBJNormal{}, []OBJUW{}, []OBJGeode{}}
+	res := &OBJ{Vertices: []OBJVector{}, Normals: []OBJNormal{}, UWs: []OBJUW{}, Geodes: []OBJGeode{}}
+	the_geode := OBJGeode{Name: "unnamed", Faces: []OBJFace{}}
+	errs := OBJErrors{}
+	noted := map[string]bool{}
+	at, from := 0, 0 // Line numbers of the current and of the first line of a statement
+
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, OBJError{from, fmt.Sprintf(format, args...)})
+	}
+	note := func(what, format string, args ...interface{}) {
+		if !noted[what] {
+			noted[what] = true
+			res.Warnings = append(res.Warnings, OBJError{from, fmt.Sprintf(format, args...)})
+		}
+	}
+	numbers := func(fields []string, least, most int) ([]float32, bool) {
+		if len(fields)-1 < least || len(fields)-1 > most {
+			fail("%s takes %d to %d numbers, got %d", fields[0], least, most, len(fields)-1)
+			return nil, false
+		}
+		out := make([]float32, 3)
+		for i, field := range fields[1:] {
+			n, err := strconv.ParseFloat(field, 32)
+			if err != nil {
+				fail("%s: %q is not a number", fields[0], field)
+				return nil, false
+			}
+			if i < len(out) {
+				out[i] = float32(n)
+			}
+		}
+		return out, true
+	}
+	index := func(field string, count int, what string) (int, bool) {
+		n, err := strconv.Atoi(field)
+		switch {
+		case err != nil:
+			fail("%s index %q is not an integer", what, field)
+		case n == 0:
+			fail("%s index can not be 0", what)
+		case n > count || -n > count:
+			fail("%s index %d is beyond the %d defined so far", what, n, count)
+		case n < 0:
+			return count + 1 + n, true
+		default:
+			return n, true
+		}
+		return 0, false
+	}
+	next := func() {
+		if len(the_geode.Faces) > 0 {
+			res.Geodes = append(res.Geodes, the_geode)
+			the_geode.Faces = []OBJFace{}
+		}
+	}
+
 	scnr := bufio.NewScanner(r)
-	the_geode := OBJGeode{"unnamed", []OBJFace{}}
+	scnr.Buffer(nil, 16*1024*1024) // Some exporters write very long faces
 	got := ""
-
 	for scnr.Scan() {
-		got = scnr.Text()
-		switch {
-		case strings.HasPrefix(got, "v "):
-			an := OBJVector{}
-			fmt.Sscanf(got, "v %f %f %f", &an[0], &an[1], &an[2])
-			res.Vertices = append(res.Vertices, an)
-		case strings.HasPrefix(got, "vn "):
-			an := OBJNormal{}
-			fmt.Sscanf(got, "vn %f %f %f", &an[0], &an[1], &an[2])
-			res.Normals = append(res.Normals, an)
-		case strings.HasPrefix(got, "vt "):
-			an := OBJUW{}
-			var none float32
-			fmt.Sscanf(got, "vt %f %f %f", &an[0], &an[1], &none)
-			res.UWs = append(res.UWs, an)
-		case strings.HasPrefix(got, "f "):
-			an := OBJFace{}
-			items := strings.Split(got, " ")
-			for _, item := range items {
-				if strings.Contains(item, "//") {
-					point := OBJFaceVertex{}
-					fmt.Sscanf(item, "%d//%d", &point.V, &point.N)
-					an = append(an, point)
-				} else if strings.Contains(item, "/") {
-					point := OBJFaceVertex{}
-					fmt.Sscanf(item, "%d/%d/%d", &point.V, &point.T, &point.N)
-					an = append(an, point)
+		at++
+		if got == "" {
+			from = at
+		}
+		got += scnr.Text()
+		if strings.HasSuffix(got, "\\") { // Continues on the next line
+			got = got[:len(got)-1] + " "
+			continue
+		}
+		if comment := strings.Index(got, "#"); comment >= 0 {
+			got = got[:comment]
+		}
+		fields := strings.Fields(got)
+		got = ""
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "v": // x y z, maybe w or a colour
+			if an, ok := numbers(fields, 3, 7); ok {
+				res.Vertices = append(res.Vertices, OBJVector{an[0], an[1], an[2]})
+			}
+		case "vn":
+			if an, ok := numbers(fields, 3, 3); ok {
+				res.Normals = append(res.Normals, OBJNormal{an[0], an[1], an[2]})
+			}
+		case "vt": // u, maybe v and w
+			if an, ok := numbers(fields, 1, 3); ok {
+				res.UWs = append(res.UWs, OBJUW{an[0], an[1]})
+			}
+		case "f", "fo":
+			if len(fields) < 4 {
+				fail("a face needs at least 3 vertices, got %d", len(fields)-1)
+				continue
+			}
+			an, ok := OBJFace{}, true
+			for _, item := range fields[1:] {
+				parts := strings.Split(item, "/")
+				if len(parts) > 3 {
+					fail("face vertex %q is not one of v, v/t, v//n or v/t/n", item)
+					ok = false
+					break
+				}
+				point := OBJFaceVertex{}
+				if point.V, ok = index(parts[0], len(res.Vertices), "vertex"); ok && len(parts) > 1 && parts[1] != "" {
+					point.T, ok = index(parts[1], len(res.UWs), "texture")
+				}
+				if ok && len(parts) > 2 && parts[2] != "" {
+					point.N, ok = index(parts[2], len(res.Normals), "normal")
+				}
+				if !ok {
+					break
+				}
+				an = append(an, point)
+			}
+			if ok {
+				the_geode.Faces = append(the_geode.Faces, an)
+			}
+		case "g":
+			next()
+			the_geode.Name = strings.Join(fields[1:], " ")
+		case "o":
+			next()
+			the_geode.Object = strings.Join(fields[1:], " ")
+		case "usemtl":
+			next()
+			the_geode.Material = strings.Join(fields[1:], " ")
+		case "mtllib": // File names may have spaces, so the pieces are joined up to .mtl
+			name := ""
+			for _, piece := range fields[1:] {
+				name += piece
+				if strings.HasSuffix(strings.ToLower(piece), ".mtl") {
+					res.Libraries = append(res.Libraries, name)
+					name = ""
+				} else {
+					name += " "
 				}
 			}
-			the_geode.Faces = append(the_geode.Faces, an)
-		case strings.HasPrefix(got, "g "):
-			an := ""
-			fmt.Sscanf(got, "g %s", &an)
-			if len(the_geode.Faces) > 0 {
-				res.Geodes = append(res.Geodes, the_geode)
+			if name = strings.TrimSpace(name); name != "" {
+				res.Libraries = append(res.Libraries, name)
+			}
+		case "s":
+			if len(fields) != 2 {
+				fail("s takes a smoothing group or off")
+			} else if _, err := strconv.Atoi(fields[1]); err != nil && fields[1] != "off" {
+				fail("smoothing group %q is not a number or off", fields[1])
+			}
+		default:
+			if obj_not_drawn[fields[0]] {
+				note(fields[0], "%s statements are not drawn", fields[0])
+			} else {
+				note(fields[0], "unknown statement %s is ignored", fields[0])
 			}
-			the_geode = OBJGeode{an, []OBJFace{}} // Name and use for further updates
 		}
 	}
-
-	if len(the_geode.Faces) > 0 {
-		res.Geodes = append(res.Geodes, the_geode)
+	if err := scnr.Err(); err != nil {
+		return nil, err
 	}
+	next()
 
+	if len(errs) > 0 {
+		return res, errs
+	}
 	return res, nil
 }
 
@@ -470,25 +895,143 @@ type LUXHeader struct {
 
 	// PPX is cut-off samples-per-pixel value, to stor prenderer automatically.
 	PPX                 int
+
+	Lens LUXLens
+}
+
+// LUXLens is how the camera of LUXHeader sees. The zero value is a perspective camera
+// with square pixels, in focus everywhere.
+type LUXLens struct {
+	Ortho         bool    // Orthographic, for elevations.
+	Height        float32 // Seen by an orthographic camera, in scene units; zero is what the FOV sees at the target.
+	PixelAspect   float32 // Width over height of a pixel; zero is square.
+	LensRadius    float32 // Of the depth of field; zero is none.
+	FocalDistance float32 // Zero is the distance to the target.
+}
+
+func (a LUXHeader) distance() float32 {
+	c := a.CameraFromToUp
+	return float32(math.Sqrt(float64((c[3]-c[0])*(c[3]-c[0]) + (c[4]-c[1])*(c[4]-c[1]) + (c[5]-c[2])*(c[5]-c[2]))))
+}
+
+// FrameAspect is the width of the image over its height.
+func (a LUXHeader) FrameAspect() float32 {
+	pixel := a.Lens.PixelAspect
+	if pixel <= 0 {
+		pixel = 1
+	}
+	if a.X <= 0 || a.Y <= 0 {
+		return pixel
+	}
+	return pixel * float32(a.X) / float32(a.Y)
+}
+
+// ScreenWindow is the view, left right bottom top: its height spans the FOV of
+// a perspective camera, as in the designer, or the Height of an orthographic one.
+func (a LUXHeader) ScreenWindow() [4]float32 {
+	half := float32(1)
+	if a.Lens.Ortho {
+		if half = a.Lens.Height / 2; half <= 0 {
+			half = a.distance() * float32(math.Tan(float64(a.FOV)*math.Pi/360))
+		}
+	}
+	aspect := a.FrameAspect()
+	return [4]float32{-half * aspect, half * aspect, -half, half}
+}
+
+// FocalDistance is how far the lens is focused.
+func (a LUXHeader) FocalDistance() float32 {
+	if a.Lens.FocalDistance > 0 {
+		return a.Lens.FocalDistance
+	}
+	return a.distance()
+}
+
+// FilmWriteInterval is how often, in seconds, luxconsole writes the image while rendering;
+// that is what the live image of a job is made of.
+var FilmWriteInterval = 10
+
+// WriteInterval gives FilmWriteInterval to the template.
+func (a LUXHeader) WriteInterval() int {
+	return FilmWriteInterval
+}
+
+// Sampler is what LUXHeader renders with.
+func (a LUXHeader) Sampler() string {
+	return cloud.Samplers[0]
+}
+
+// Format is what LUXHeader renders into; PNG is written whatever it is.
+func (a LUXHeader) Format() string {
+	return cloud.Formats[0]
 }
 
 func (a LUXHeader) Scenify(w io.Writer) error {
 	return LUXHeaderTemplate.Execute(w, a)
 }
 
+// LUXRenderHeader is LUXHeader with a sampler and an output format of choice.
+type LUXRenderHeader struct {
+	LUXHeader
+	Sampler, Format string
+}
+
+func (a LUXRenderHeader) Scenify(w io.Writer) error {
+	return LUXHeaderTemplate.Execute(w, a)
+}
+
+// DefaultResolution is used when the scene does not tell the resolution.
+var DefaultResolution = 150
+
+// HeaderWith overrides the header with the settings, and tells the settings it ends up with.
+// Given only one side of the resolution, the other keeps the aspect of the header.
+func HeaderWith(head LUXHeader, s cloud.RenderSettings) (LUXRenderHeader, cloud.RenderSettings) {
+	if head.X <= 0 || head.Y <= 0 {
+		head.X, head.Y = DefaultResolution, DefaultResolution
+	}
+	switch {
+	case s.Debug:
+		s.Width, s.Height = cloud.DebugResolution, cloud.DebugResolution
+	case s.Width > 0 && s.Height == 0:
+		s.Height = int(math.Max(1, math.Floor(float64(s.Width*head.Y)/float64(head.X)+0.5)))
+	case s.Height > 0 && s.Width == 0:
+		s.Width = int(math.Max(1, math.Floor(float64(s.Height*head.X)/float64(head.Y)+0.5)))
+	case s.Width == 0:
+		s.Width, s.Height = head.X, head.Y
+	}
+	if s.HaltSPP == 0 {
+		s.HaltSPP = head.PPX
+	}
+	if s.FOV == 0 {
+		s.FOV = float64(head.FOV)
+	}
+	if s.Sampler == "" {
+		s.Sampler = head.Sampler()
+	}
+	if s.Format == "" {
+		s.Format = head.Format()
+	}
+	head.X, head.Y, head.PPX, head.FOV = s.Width, s.Height, s.HaltSPP, float32(s.FOV)
+	return LUXRenderHeader{head, s.Sampler, s.Format}, s
+}
+
 var LUXHeaderTemplate = template.Must(template.New("LUXHeader").Parse(`# Taken from the documentation 1.0
 #This is an example of a comment!
 #Global Information
 LookAt {{range .CameraFromToUp}} {{.}} {{end}}
-Camera "perspective" "float fov" [{{.FOV}}]
-
+{{if .Lens.Ortho}}Camera "orthographic"{{else}}Camera "perspective" "float fov" [{{.FOV}}]{{end}}
+	"float screenwindow" [{{range .ScreenWindow}} {{.}} {{end}}] "float frameaspectratio" [{{.FrameAspect}}]
+{{if .Lens.LensRadius}}	"float lensradius" [{{.Lens.LensRadius}}] "float focaldistance" [{{.FocalDistance}}]
+{{end}}
 Film "fleximage"
 "integer xresolution" [{{.X}}] "integer yresolution" [{{.Y}}]
 "integer haltspp" [{{.PPX}}] #Added by kdl
-
+"integer writeinterval" [{{.WriteInterval}}]
+{{if ne .Format "png"}}"bool write_{{.Format}}" ["true"]
+{{end}}
 PixelFilter "mitchell" "float xwidth" [2] "float ywidth" [2] "bool supersample" ["true"]
 
-Sampler "metropolis"
+Sampler "{{.Sampler}}"
 
 #Scene Specific Information
 `))
@@ -535,9 +1078,10 @@ AttributeEnd
 // LUXMeshTemplate generates a mesh component for LUX scene.
 var LUXMeshTemplate = template.Must(template.New("OBJ").Parse(`
 AttributeBegin
-Shape "mesh"
-	      "normal N" [{{range .N}} {{range .}} {{.}} {{end}} {{end}}]
-	      "point P" [{{range .P}} {{range .}} {{.}} {{end}} {{end}}]
+{{if .Material}}NamedMaterial "{{.Material}}"
+{{end}}Shape "mesh"
+{{if .N}}	      "normal N" [{{range .N}} {{range .}} {{.}} {{end}} {{end}}]
+{{end}}	      "point P" [{{range .P}} {{range .}} {{.}} {{end}} {{end}}]
 	      "float uv" [{{range .UV}} {{range .}} {{.}} {{end}} {{end}}]
 	      "integer triindices" [{{range .T}} {{.}} {{end}}]
 AttributeEnd
@@ -549,7 +1093,8 @@ var LUXTexturedMeshTemplate = template.Must(template.New("OBJTextured").Parse(`
 AttributeBegin
 NamedMaterial "{{ .Texture }}"
 Shape "mesh"
-	      "point P" [{{range .P}} {{range .}} {{.}} {{end}} {{end}}]
+{{if .N}}	      "normal N" [{{range .N}} {{range .}} {{.}} {{end}} {{end}}]
+{{end}}	      "point P" [{{range .P}} {{range .}} {{.}} {{end}} {{end}}]
 	      "float uv" [{{range .UV}} {{range .}} {{.}} {{end}} {{end}}]
 	      "integer triindices" [{{range .T}} {{.}} {{end}}]
 AttributeEnd
@@ -571,6 +1116,7 @@ type LUXMesh struct {
 	N,               P [][3]float32
 	UV                 [][2]float32
 	T                  []int
+	Material           string // Named material, if any.
 }
 
 // LUXTexturedMesh is a textured mesh template.
@@ -581,43 +1127,61 @@ type LUXTexturedMesh struct {
 	T                  []int
 }
 
-// Scenify makes OBJ directly includeable in a LUX scene.
-func (an OBJ) Scenify(w io.Writer) error {
+// Meshes triangulates the geodes, a mesh for each, with the material of the geode if loaded.
+// Corners with the same vertex, normal and texture are shared; where some corners have
+// no normal, the mesh gets none.
+func (an OBJ) Meshes() []LUXMesh {
+	meshes := []LUXMesh{}
 	for _, g := range an.Geodes { // Over geodes
-		lm := LUXMesh{[][3]float32{}, [][3]float32{}, [][2]float32{}, []int{}} // Each geode goes through template separately
-		old_2_new := map[int] int {} // Zero-based
+		lm := LUXMesh{[][3]float32{}, [][3]float32{}, [][2]float32{}, []int{}, an.Materials[g.Material].Name} // Each geode goes through template separately
+		old_2_new := map[OBJFaceVertex] int {} // Zero-based
+		normals := true
 		for _, face := range g.Faces { // Each face
 			for i := 1; i < (len(face) - 1); i++ { //
 				for _, v := range []int{0, i, i + 1} { // Triangulate big faces
-					old_index := face[v].V - 1; // Convert to 0-based (?)
-					if new_index, ok := old_2_new[old_index]; ok { // Seen the point already, just push it
+					corner := face[v]
+					if new_index, ok := old_2_new[corner]; ok { // Seen the corner already, just push it
 						lm.T = append(lm.T, new_index)
+						continue
+					}
+					// Sanity check:
+					old_index, old_normal, old_uv := corner.V - 1, corner.N - 1, corner.T - 1 // Convert to 0-based
+					if (old_index < 0) || (len(an.Vertices) < old_index + 1) || (len(an.Normals) < old_normal + 1) || (len(an.UWs) < old_uv + 1) {
+						lm.T = append(lm.T, 0)
+						log.Printf("Bad face: %#v max(V:%d N:%d U:%d)", corner, len(an.Vertices), len(an.Normals), len(an.UWs))
+						continue
+					}
+					// Copying
+					old_2_new[corner] = len(lm.P)
+					lm.P = append(lm.P, an.Vertices[old_index])
+					if old_normal >= 0 {
+						lm.N = append(lm.N, an.Normals[old_normal])
+					} else {
+						normals = false
+					}
+					if old_uv >= 0 {
+						lm.UV = append(lm.UV, an.UWs[old_uv])
 					} else {
-						// Sanity check:
-						old_normal := face[v].N - 1
-						old_uv := face[v].T - 1
-						if (len(an.Vertices) < old_index + 1) || (len(an.Normals) < old_normal + 1) || (len(an.UWs) < old_uv + 1) {
-							lm.T = append(lm.T, 0)
-							log.Printf("Bad face: %#v max(V:%d N:%d U:%d)", face[v], len(an.Vertices), len(an.Normals), len(an.UWs))
-							//							return NewConvertError("Indices/Vertices mismatch", nil)
-						} else {
-							// Copying
-							old_2_new[old_index] = len(lm.P)
-							lm.P = append(lm.P, an.Vertices[old_index])
-							lm.N = append(lm.N, an.Normals[old_normal])
-
-							if old_uv >= 0 {
-								lm.UV = append(lm.UV, an.UWs[old_uv])
-							} else {
-								lm.UV = append(lm.UV, [2]float32{0, 0})
-							}
-
-							lm.T = append(lm.T, old_2_new[old_index])
-						}
+						lm.UV = append(lm.UV, [2]float32{0, 0})
 					}
+					lm.T = append(lm.T, old_2_new[corner])
 				}
 			}
 		}
+		if !normals { // LUX computes them
+			lm.N = [][3]float32{}
+		}
+		meshes = append(meshes, lm)
+	}
+	return meshes
+}
+
+// Scenify makes OBJ directly includeable in a LUX scene.
+func (an OBJ) Scenify(w io.Writer) error {
+	if err := an.materials(w); err != nil {
+		return err
+	}
+	for _, lm := range an.Meshes() {
 		if err := LUXMeshTemplate.Execute(w, lm); err != nil {
 			return NewConvertError("Mesh template failed", err)
 		}
@@ -625,6 +1189,13 @@ func (an OBJ) Scenify(w io.Writer) error {
 	return nil // All ok
 }
 
+func (lm LUXTexturedMesh) Scenify(w io.Writer) error {
+	if err := LUXTexturedMeshTemplate.Execute(w, lm); err != nil {
+		return NewConvertError("Mesh template failed", err)
+	}
+	return nil
+}
+
 // LUXOSGTGeometry specifies an OSG structure to convert to LUX, and what resolver to use to locate texture images.
 type LUXOSGTGeometry struct {
 	Osgt  OSGT
@@ -634,94 +1205,15 @@ type LUXOSGTGeometry struct {
 // Define how it works
 func (cover LUXOSGTGeometry) Scenify(w io.Writer) error {
 
-	an := cover.Osgt
-
-	list := an.Find("Geode")
-
-	if len(list) == 0 {
-		log.Print("There supposed to be geodes in the scene")
-	}
-
 	known_materials := map[string] bool{};
+	graph := cover.Graph()
 
-	for _, geode := range list {
-		vtx := geode.Find("VertexData")
-		if len(vtx) != 1 {
-			log.Print("VertexData not found in geode")
-			continue
-		}
-
-		arr := vtx[0].Find("Array")
-		if len(arr) != 1 {
-			log.Print("Array not found in geode")
-			continue
-		}
-
-		tex := geode.Find("TexCoordData")
-		if len(tex) != 1 {
-			log.Print("TexCoordData not found in geode")
-			continue
-		}
-
-		arr_tex := tex[0].Find("Array")
-		if len(arr_tex) != 1 {
-			log.Print("Array for textures not found in geode")
-			continue
-		}
-
-		if len(arr_tex) != len(arr) {
-			log.Print("Texture coordinates do not match vertices")
-			continue
-		}
-
-		material := geode.Find("Image")
-		material_image := "CairnSmith/Resources/WallTexture4.tga" // Default
-		if len(material) == 1 {
-			name_list := strings.Split(material[0].FindKey("FileName"), "\"")
-			if len(name_list) < 2 {
-				log.Print("Unable to get texture name")
-			} else {
-				material_image = name_list[1]
-			}
-		}
-
-		if nil != cover.Files {
-			lookup, err := cover.Files.Get(material_image)
-			if err == nil {
-				material_image = lookup
-			} else {
-				log.Printf("Unable to look up texture: %s [%s] ", material_image, err.Error())
-			}
-		}
-
-		log.Print("Using material ", material_image)
-
-		if _, ok := known_materials[material_image]; !ok {
-			known_materials[material_image] = true;
-			some  := LUXNamedMaterial{material_image, material_image}
+	for _, lm := range osgt_meshes(graph) {
+		if _, ok := known_materials[lm.Texture]; !ok {
+			known_materials[lm.Texture] = true;
+			some  := LUXNamedMaterial{lm.Texture, lm.Texture}
 			some.Scenify(w);
 		}
-
-
-		lm := LUXTexturedMesh{material_image, [][3]float32{}, [][3]float32{}, [][2]float32{}, []int{}} // Each geode goes through template separately
-		for i, _ := range arr[0].List {
-			a := [3]float32{}
-			t := [2]float32{}
-
-			fmt.Sscanf(arr[0].List[i].Key, "%f %f %f", &a[0], &a[1], &a[2])
-			fmt.Sscanf(arr_tex[0].List[i].Key, "%f %f", &t[0], &t[1])
-			lm.P = append(lm.P, a)
-			lm.UV = append(lm.UV, t)
-		}
-		for tri := 1; tri < len(lm.P) - 1; tri++ {
-			lm.T = append(lm.T, 0, tri, tri + 1)
-		}
-		
-		if err := LUXTexturedMeshTemplate.Execute(w, lm); err != nil {
-			log.Print("Problem: ", err)
-			return err
-		}
-		
 	}
 
 
@@ -744,7 +1236,7 @@ func (cover LUXOSGTGeometry) Scenify(w io.Writer) error {
 	*/
 
 	//	return body.Scenify(w)
-	return nil
+	return graph.Scenify(w)
 
 }
 
@@ -797,17 +1289,52 @@ func (a LUXNamedMaterial) Scenify(w io.Writer) error {
 	return nil
 }
 
+// Strength of lights of intensity 1; a white point light of LightGain is
+// what lit every scene before lights had colours.
+var (
+	LightGain   float32 = 300 // Point and spot lights.
+	DistantGain float32 = 3
+	AreaPower   float32 = 100 // Watts.
+)
+
+// LUXEmission is the colour and the strength of a light.
+type LUXEmission struct {
+	Colour [3]float32 // Zero is white.
+	Gain   float32    // Zero is the usual one of the kind of light.
+}
+
+// L is the colour of the light.
+func (a LUXEmission) L() [3]float32 {
+	if a.Colour == [3]float32{} {
+		return [3]float32{1, 1, 1}
+	}
+	return a.Colour
+}
+
+func (a LUXEmission) gain(usual float32) float32 {
+	if a.Gain == 0 {
+		return usual
+	}
+	return a.Gain
+}
+
 // LUXLight creates a point light.
 type LUXLight struct {
 	Position [3]float32
+	LUXEmission
+}
+
+// Strength is the gain of the light.
+func (an LUXLight) Strength() float32 {
+	return an.gain(LightGain)
 }
 
 var LUXLightTemplate = template.Must(template.New("LUXLight").Parse(`
 AttributeBegin
 LightSource "point"
 "point from" [{{range .Position}} {{.}} {{end}}]
-"color L" [3 3 3]
-"float gain" [100]
+"color L" [{{range .L}} {{.}} {{end}}]
+"float gain" [{{.Strength}}]
 AttributeEnd
 `))
 
@@ -818,9 +1345,84 @@ func (an LUXLight) Scenify(w io.Writer) error {
 	return nil
 }
 
+// LUXSpotLight shines from a point towards another, within the cone.
+type LUXSpotLight struct {
+	From, To [3]float32
+	Cone     float32 // Degrees between the axis and the edge of the light.
+	LUXEmission
+}
+
+// SpotSoftness is the width, in degrees, of the edge of spot lights; at most the cone.
+var SpotSoftness float32 = 5
+
+// Strength is the gain of the light.
+func (an LUXSpotLight) Strength() float32 {
+	return an.gain(LightGain)
+}
+
+// Softness is the width of the edge of the light.
+func (an LUXSpotLight) Softness() float32 {
+	if SpotSoftness > an.Cone {
+		return an.Cone
+	}
+	return SpotSoftness
+}
+
+var LUXSpotLightTemplate = template.Must(template.New("LUXSpotLight").Parse(`
+AttributeBegin
+LightSource "spot"
+"point from" [{{range .From}} {{.}} {{end}}] "point to" [{{range .To}} {{.}} {{end}}]
+"float coneangle" [{{.Cone}}]
+"float conedeltaangle" [{{.Softness}}]
+"color L" [{{range .L}} {{.}} {{end}}]
+"float gain" [{{.Strength}}]
+AttributeEnd
+`))
+
+func (an LUXSpotLight) Scenify(w io.Writer) error {
+	if err := LUXSpotLightTemplate.Execute(w, an); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LUXDistantLight shines everywhere in the same direction, from a point towards another.
+type LUXDistantLight struct {
+	From, To [3]float32
+	LUXEmission
+}
+
+// Strength is the gain of the light.
+func (an LUXDistantLight) Strength() float32 {
+	return an.gain(DistantGain)
+}
+
+var LUXDistantLightTemplate = template.Must(template.New("LUXDistantLight").Parse(`
+AttributeBegin
+LightSource "distant"
+"point from" [{{range .From}} {{.}} {{end}}] "point to" [{{range .To}} {{.}} {{end}}]
+"color L" [{{range .L}} {{.}} {{end}}]
+"float gain" [{{.Strength}}]
+AttributeEnd
+`))
+
+func (an LUXDistantLight) Scenify(w io.Writer) error {
+	if err := LUXDistantLightTemplate.Execute(w, an); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LUXAreaLight is a glowing sphere, which casts soft shadows.
 type LUXAreaLight struct {
 	Size float32
 	Position [3]float32
+	LUXEmission
+}
+
+// Strength is the power of the light, in watts.
+func (an LUXAreaLight) Strength() float32 {
+	return an.gain(AreaPower)
 }
 
 var LUXAreaLightTemplate = template.Must(template.New("LUXAreaLight").Parse(`AttributeBegin #  "Area.002"
@@ -831,9 +1433,9 @@ LightGroup "default"
 
 AreaLightSource "area"
 	"float importance" [1.000000000000000]
-	"float power" [100.000000000000000]
+	"float power" [{{.Strength}}]
 	"float efficacy" [17.000000000000000]
-	"color L" [0.80000001 0.80000001 0.80000001]
+	"color L" [{{range .L}} {{.}} {{end}}]
 	"integer nsamples" [1]
 	"float gain" [1.000000000000000]
 
@@ -849,42 +1451,42 @@ func (an LUXAreaLight) Scenify(w io.Writer) error {
 }
 
 // LUXSceneFull represents complete LUX scene, including a way to resolve all texture files.
+// Settings override what the scene says about the render.
 type LUXSceneFull struct {
-	Files Resolver
-	World RenderingData
+	Files    Resolver
+	World    RenderingData
+	Settings cloud.RenderSettings
 }
 
-var CLOUDDEBUG bool = false
+// Header is the scene header with the settings applied, and the settings it ends up with.
+// A CameraType starting with Ortho is orthographic.
+func (a LUXSceneFull) Header() (LUXRenderHeader, cloud.RenderSettings) {
+	c := a.World.RenderingSettings.Camera
+	d := c.CameraDisplaySettings
+	lens := LUXLens{strings.HasPrefix(strings.ToLower(c.CameraType), "ortho"), d.OrthoHeight, 0, d.LensRadius, d.FocalDistance}
+	if d.AspectRatio_X > 0 && d.AspectRatio_Y > 0 {
+		lens.PixelAspect = d.AspectRatio_X / d.AspectRatio_Y
+	}
+	return HeaderWith(LUXHeader{[9]float32{c.Eye.X, c.Eye.Y, c.Eye.Z,
+		c.Center.X, c.Center.Y, c.Center.Z,
+		c.Up.X, c.Up.Y, c.Up.Z}, float32(d.FOV),
+		d.Resolution_X, d.Resolution_Y, 20 + c.Quality, lens}, a.Settings)
+}
 
-func (a LUXSceneFull) Scenify(w io.Writer) error {
+// Compose reads everything the scene refers to into the world to render.
+func (a LUXSceneFull) Compose() (LUXWorld, error) {
 	
 	scene_file_name, err := a.Files.Get(a.World.Scene)
 	if err != nil {
-		return RenderError{"Unable to locate scene", err}
+		return LUXWorld{}, RenderError{"Unable to locate scene", err}
 	}
 	osgt, err := ReadFileOSGT(scene_file_name)
-	walls_scene := LUXOSGTGeometry{*osgt, a.Files}
-
-	c := a.World.RenderingSettings.Camera
-
-	clamp := func(an * int) {
-		if *an > 1000 || *an < 50 {
-			new := 150
-			log.Print("Incorrect resilution %d; Changed to %d", *an, new)
-			*an = new
-		}
+	if err != nil {
+		return LUXWorld{}, RenderError{"Unable to read scene", err}
 	}
-
-	res_x := a.World.RenderingSettings.Camera.CameraDisplaySettings.Resolution_X
-	res_y := a.World.RenderingSettings.Camera.CameraDisplaySettings.Resolution_Y
-
-	quality := a.World.RenderingSettings.Camera.Quality
-
-	clamp(&res_x)
-	clamp(&res_y)
-
-	if CLOUDDEBUG {
-		res_x, res_y = 100, 100 // Debug
+	walls_scene := LUXOSGTGeometry{*osgt, a.Files}
+	if err := walls_scene.Missing(); err != nil {
+		return LUXWorld{}, RenderError{"Unable to locate texture", err}
 	}
 
 	get_model := func(i int) (scn LUXScener, err error) {
@@ -894,9 +1496,25 @@ func (a LUXSceneFull) Scenify(w io.Writer) error {
 			return nil, RenderError{"Unable to resolve path:", err}
 		}
 		objmodel, err := ReadFileOBJ(real_path)
-		if err != nil {
+		if _, partly := err.(OBJErrors); partly {
+			log.Printf("Model %s is drawn without the lines in error: %v", real_path, err)
+		} else if err != nil {
 			return nil, RenderError{"Failed to read model", err}
 		}
+		for _, warning := range objmodel.Warnings {
+			log.Printf("Model %s: %v", real_path, warning)
+		}
+		if err := objmodel.LoadMaterials(filepath.Dir(real_path), a.Files); missing(err) {
+			return nil, RenderError{"Unable to locate materials of model " + real_path, err}
+		} else if err != nil {
+			log.Printf("Model %s is missing materials: %v", real_path, err)
+		}
+		for _, sub := range item.LibraryItemSubGeode { // What the designer chose
+			name := fmt.Sprintf("%s#%d/%s", filepath.Base(real_path), i, sub.Name)
+			if objmodel.SetMaterial(sub.Name, name, sub.Material) == 0 {
+				log.Printf("Model %s has no group %s for its material", real_path, sub.Name)
+			}
+		}
 
 		tr := [16]float32{}
 		n, err := fmt.Sscanf(item.Transform, "%f %f %f %f %f %f %f %f %f %f %f %f %f %f %f %f",
@@ -927,9 +1545,9 @@ func (a LUXSceneFull) Scenify(w io.Writer) error {
 	lights := a.World.RenderingSettings.Lights.Lights
 	if lights != nil && len(lights) > 0 {
 		objects_light = LUXSequence{};
+		centre := a.World.RenderingSettings.Camera.Center
 		for _, l := range lights {
-			//			objects_light = append(objects_light, LUXAreaLight{50, [3]float32{l.Position.X, l.Position.Y, l.Position.Z}})
-			objects_light = append(objects_light, LUXLight{ [3]float32{l.Position.X, l.Position.Y, l.Position.Z}})
+			objects_light = append(objects_light, l.LUX([3]float32{centre.X, centre.Y, centre.Z}))
 		}
 
 	}
@@ -941,15 +1559,22 @@ func (a LUXSceneFull) Scenify(w io.Writer) error {
 		if err == nil {
 			log.Print("Attempting ", model)
 			objects_scene = append(objects_scene, model)
+		} else if missing(err) { // Not uploaded yet, the render is tried again later.
+			return LUXWorld{}, err
 		} else {
 			log.Print("Problems dealing with model: ", obj.Path)
 		}
 	}
 
-	all := LUXWorld{LUXHeader{[9]float32{c.Eye.X, c.Eye.Y, c.Eye.Z ,
-		c.Center.X, c.Center.Y, c.Center.Z,
-		c.Up.X, c.Up.Y, c.Up.Z}, float32(c.CameraDisplaySettings.FOV), res_x, res_y, 20+quality}, LUXSequence{objects_light, walls_scene, objects_scene}}
+	head, _ := a.Header()
+	return LUXWorld{head, LUXSequence{objects_light, walls_scene, objects_scene}}, nil
+}
 
+func (a LUXSceneFull) Scenify(w io.Writer) error {
+	all, err := a.Compose()
+	if err != nil {
+		return err
+	}
 	return all.Scenify(w)
 }
 
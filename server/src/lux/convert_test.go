@@ -7,6 +7,11 @@ import (
 	"strings"
 	"os"
 	"text/template"
+	"cloud"
+	"path"
+	"fmt"
+	"io/ioutil"
+	"time"
 )
 
 var testconfig string = `<RenderingData><Scene>C:/Users/Sheer Temp 1/Cairnsmith/sheer/abc/Projects/testProj - Copy/Designer/testProj_design_1.osgt</Scene>
@@ -109,6 +114,174 @@ func TestConfigurationLoad(t * testing.T) {
 	t.Logf("Obtained:%v\n", rd)
 }
 
+// TestSubGeodeMaterials gives groups of the chair the materials of the designer.
+func TestSubGeodeMaterials(t * testing.T) {
+	rd, err := readConfiguration(strings.NewReader(testconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := rd.Models.LibraryItem[0].LibraryItemSubGeode[0]
+	if sub.Name != "ChamferBox02" || sub.Material.Shininess != 128 ||
+		sub.Material.Diffuse != (XMLShaderParam{0.8, 0.8, 1, 0.8}) || sub.Material.Ambience.R != 0.2 || sub.Material.Specular.B != 0.2 {
+		t.Fatalf("Material not read: %#v", sub)
+	}
+
+	chair := testReadObj(t, "Chair.obj")
+	if n := chair.SetMaterial("No such group", "none", sub.Material); n != 0 {
+		t.Errorf("No geode should take the material, %d did", n)
+	}
+	if n := chair.SetMaterial(sub.Name, "Chair.obj#0/ChamferBox02", sub.Material); n != 1 {
+		t.Fatalf("The last geode should take the material, %d did", n)
+	}
+	m := chair.Materials["Chair.obj#0/ChamferBox02/02___Default"]
+	if m.Kd != [3]float32{0.8, 0.8, 0.8} || m.Ks != [3]float32{0.2, 0.2, 0.2} || !m.Glossy || m.Clear() || m.Roughness > 0.2 {
+		t.Errorf("Material is %#v", m)
+	}
+	buf := &bytes.Buffer{}
+	chair.Scenify(buf)
+	if strings.Count(buf.String(), "\nNamedMaterial \"Chair.obj#0/ChamferBox02/02___Default\"") != 1 {
+		t.Errorf("The geode should use the material:\n%s", buf.String())
+	}
+
+	// In the whole scene, each chair has its own.
+	files := Resolver{}
+	files.Scan(STORE_PLACE)
+	world, err := ReadConfigurationFile(path.Join(STORE_PLACE, "reference/RenderingData.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := (LUXSceneFull{files, *world, cloud.RenderSettings{}}).Scenify(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"Chair.obj#0/ChamferBox02/02___Default", "Coffe-Table.obj#1/Rectangle02", "Swivel_Chair.obj#2/Plane01"} {
+		if !strings.Contains(buf.String(), "\nNamedMaterial \""+expect+"\"") {
+			t.Errorf("Scene should use %s", expect)
+		}
+	}
+
+	// Models and their libraries that are not uploaded yet are worth another try.
+	alone := path.Join(os.TempDir(), fmt.Sprintf("lux_alone%d", time.Now().UnixNano()))
+	os.MkdirAll(alone, 0777)
+	defer os.RemoveAll(alone)
+	chair_obj, _ := ioutil.ReadFile(path.Join(STORE_PLACE, "reference/Chair.obj"))
+	ioutil.WriteFile(path.Join(alone, "Chair.obj"), chair_obj, 0666)
+	for _, gone := range []string{"Chair.obj", "ANG010026.mtl"} {
+		without := Resolver{}
+		for _, file := range files {
+			switch {
+			case path.Base(file) == gone:
+			case path.Base(file) == "Chair.obj": // Away from its library.
+				without = append(without, path.Join(alone, "Chair.obj"))
+			default:
+				without = append(without, file)
+			}
+		}
+		if _, err := (LUXSceneFull{without, *world, cloud.RenderSettings{}}).Compose(); !missing(err) || !strings.Contains(err.Error(), gone) {
+			t.Errorf("Scene without %s should be missing it, got %v", gone, err)
+		}
+	}
+}
+
+// TestLights makes the lights of the scene into LUX ones.
+func TestLights(t * testing.T) {
+	rd, err := readConfiguration(strings.NewReader(testconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := rd.RenderingSettings.Lights.Lights; len(l) != 1 || l[0].Type != "PointSource" || l[0].SpotCutOffAngle != -1 {
+		t.Fatalf("Lights not read: %#v", l)
+	}
+	centre := [3]float32{0, 0, 0}
+	point := rd.RenderingSettings.Lights.Lights[0].LUX(centre)
+	if l, ok := point.(LUXLight); !ok || l.Colour != [3]float32{1, 0.5, 0.5} || l.Strength() != LightGain {
+		t.Errorf("Expected a pink point light, got %#v", point)
+	}
+
+	lights := []XMLLight{}
+	xml.Unmarshal([]byte(`<Lights>
+  <Lights SpotCutOffAngle="20" type="SpotSource" Intensity="2"><Position x="0" y="0" z="100"/><Direction x="0" y="0" z="-1"/></Lights>
+  <Lights SpotCutOffAngle="45" type="PointSource"><Position x="0" y="0" z="100"/></Lights>
+  <Lights SpotCutOffAngle="-1" type="DirectionalSource"><Position x="0" y="100" z="0"/><Diffuse r="0" g="0" b="1" a="1"/></Lights>
+  <Lights type="AreaSource" Size="25"><Position x="10" y="20" z="30"/></Lights>
+  <Lights type="AreaSource"><Position x="10" y="20" z="30"/></Lights>
+  <Lights type="Glow"><Position x="10" y="20" z="30"/></Lights>
+</Lights>`), &struct{ Lights *[]XMLLight }{&lights})
+	if len(lights) != 6 {
+		t.Fatalf("Lights not read: %#v", lights)
+	}
+	expect := []LUXScener{
+		LUXSpotLight{[3]float32{0, 0, 100}, [3]float32{0, 0, 99}, 20, LUXEmission{Gain: 2 * LightGain}},
+		LUXSpotLight{[3]float32{0, 0, 100}, centre, 45, LUXEmission{Gain: LightGain}},
+		LUXDistantLight{[3]float32{0, 100, 0}, centre, LUXEmission{[3]float32{0, 0, 1}, DistantGain}},
+		LUXAreaLight{25, [3]float32{10, 20, 30}, LUXEmission{Gain: AreaPower}},
+		LUXAreaLight{DefaultAreaSize, [3]float32{10, 20, 30}, LUXEmission{Gain: AreaPower}},
+		LUXLight{[3]float32{10, 20, 30}, LUXEmission{Gain: LightGain}},
+	}
+	for i, l := range lights {
+		if got := l.LUX(centre); got != expect[i] {
+			t.Errorf("Light %d should be %#v, got %#v", i, expect[i], got)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, l := range expect {
+		l.Scenify(buf)
+	}
+	for _, expect := range []string{
+		`LightSource "spot"`, `"float coneangle" [20]`, `"float conedeltaangle" [5]`, `"float gain" [600]`,
+		`LightSource "distant"`, `"color L" [ 0  0  1 ]`, `"float power" [100]`, `"color L" [ 1  1  1 ]`,
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("Expected %s in:\n%s", expect, buf.String())
+		}
+	}
+}
+
+// TestCamera makes perspective and orthographic cameras, with depth of field, from the rendering data.
+func TestCamera(t * testing.T) {
+	scene := func(head LUXHeader) string {
+		buf := &bytes.Buffer{}
+		head.Scenify(buf)
+		return buf.String()
+	}
+	expect := func(got string, lines ...string) {
+		for _, line := range lines {
+			if !strings.Contains(got, line) {
+				t.Errorf("Expected %s in:\n%s", line, got)
+			}
+		}
+	}
+	head := LUXHeader{[9]float32{0, 0, -10, 0, 0, 0, 0, 1, 0}, 90, 400, 200, 25, LUXLens{}}
+	got := scene(head)
+	expect(got, `Camera "perspective" "float fov" [90]`, `"float screenwindow" [ -2  2  -1  1 ] "float frameaspectratio" [2]`)
+	if strings.Contains(got, "lensradius") {
+		t.Errorf("No depth of field expected:\n%s", got)
+	}
+
+	head.Lens = LUXLens{Ortho: true, PixelAspect: 0.5, LensRadius: 0.1}
+	got = scene(head)
+	expect(got, `Camera "orthographic"`, `"float screenwindow" [ -10  10  -10  10 ] "float frameaspectratio" [1]`,
+		`"float lensradius" [0.1] "float focaldistance" [10]`)
+	if strings.Contains(got, "fov") {
+		t.Errorf("Orthographic camera has no field of view:\n%s", got)
+	}
+	head.Lens = LUXLens{Ortho: true, Height: 300, FocalDistance: 5, LensRadius: 1}
+	expect(scene(head), `"float screenwindow" [ -300  300  -150  150 ]`, `"float focaldistance" [5]`)
+
+	config := strings.Replace(testconfig, `CameraType="Prespective"`, `CameraType="Orthographic"`, 1)
+	config = strings.Replace(config, `AspectRatio_X="1"`, `AspectRatio_X="2" OrthoHeight="600" LensRadius="0.5" FocalDistance="400"`, 1)
+	rd, err := readConfiguration(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _ := LUXSceneFull{nil, *rd, cloud.RenderSettings{}}.Header()
+	if full.Lens != (LUXLens{true, 600, 2, 0.5, 400}) {
+		t.Errorf("Lens not read: %#v", full.Lens)
+	}
+	expect(scene(full.LUXHeader), `Camera "orthographic"`, `"float screenwindow" [ -800  800  -300  300 ] "float frameaspectratio" [2.6666667]`)
+}
+
 var testosgt = `                  VertexData {
                     Array TRUE ArrayID 24 Vec3fArray 4 {
                       531.011 -266 300
@@ -163,6 +336,89 @@ func TestOSGTLoadAll(t * testing.T) {
 	}
 }
 
+// TestOSGTSyntax reads braces within a line and in strings, and tells where a file is broken.
+func TestOSGTSyntax(t *testing.T) {
+	rd, err := readOSGT(strings.NewReader(`osg::Geode { # A comment {
+  UniqueID 0x1f
+  Name "Chair {left} \"A\""
+  StateSet TRUE { osg::StateSet { UniqueID 7 } }
+  Image
+  {
+    FileName "texture/Vatrushka-01.tga"
+  }
+  Scale -1.5e2 1
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	geode := rd.Find("osg::Geode")
+	if len(geode) != 1 || len(geode[0].List) != 5 {
+		t.Fatalf("Expected one geode of five entries:\n%s", rd.Print())
+	}
+	entries := geode[0].List
+	if id, ok := geode[0].Entry("UniqueID"); !ok || id.Values[1].Kind != OSGTNumber || id.Values[1].Number != 31 || id.Line != 2 {
+		t.Errorf("UniqueID is %#v", id)
+	}
+	if name, ok := entries[1].Quoted(); !ok || name != `Chair {left} "A"` || entries[1].Key != `Name "Chair {left} \"A\""` {
+		t.Errorf("Name is %#v", entries[1])
+	}
+	if ids := rd.Find("osg::StateSet"); len(ids) != 1 || len(ids[0].List) != 1 || ids[0].List[0].Key != "UniqueID 7" {
+		t.Errorf("StateSet is\n%s", rd.Print())
+	}
+	if image := rd.Find("Image"); len(image) != 1 {
+		t.Errorf("Image is\n%s", rd.Print())
+	} else if file, ok := image[0].Entry("FileName"); !ok || file.Values[1].Kind != OSGTString || file.Values[1].Text != "texture/Vatrushka-01.tga" {
+		t.Errorf("FileName is %#v", file)
+	}
+	if scale, ok := entries[4].Numbers(); ok || entries[4].Name() != "Scale" {
+		t.Errorf("Scale is %#v", entries[4])
+	} else if scale, ok = (OSGTEntry{Values: entries[4].Values[1:]}).Numbers(); !ok || scale[0] != -150 || scale[1] != 1 {
+		t.Errorf("Scale is %v", scale)
+	}
+
+	for text, line := range map[string]int{
+		"a {\n b\n}\n}\n":      4,
+		"a {\n b {\n}\n":       1,
+		"a\n b \"open\n":       2,
+		"{\n}\n":               1,
+		"a {\n}\n{\n}\n":       3,
+		"a { b } c {\n d {\n}": 1,
+	} {
+		_, err := readOSGT(strings.NewReader(text))
+		if e, ok := err.(OSGTError); !ok || e.Line != line {
+			t.Errorf("Expected an error at line %d of %q, got %v", line, text, err)
+		}
+	}
+}
+
+// TestOSGTReference reads the designer files and their geodes.
+func TestOSGTReference(t *testing.T) {
+	for name, geodes := range map[string]int{"KdlProject_design_1.osgt": 19, "testProj_design_1.osgt": 29} {
+		rd, err := ReadFileOSGT(path.Join(STORE_PLACE, "reference", name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if n := len(rd.Find("osg::Geode")); n != geodes {
+			t.Errorf("%s has %d geodes", name, n)
+		}
+		for _, array := range rd.Find("Vec3fArray") {
+			rows, err := array.Rows()
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			for _, row := range rows {
+				if len(row) != 3 {
+					t.Errorf("%s has a vector of %d numbers", name, len(row))
+				}
+			}
+		}
+		if _, err := rd.Rows(); err == nil {
+			t.Errorf("%s is not an array", name)
+		}
+	}
+}
+
 func TestOBJLoad(t * testing.T) {
 	f, err := os.Open("../../../render/reference/Chair.obj")
 	if err != nil {
@@ -188,6 +444,131 @@ func TestOBJLoad(t * testing.T) {
 	t.Logf("BB:%#v:%#v", min, max)
 }
 
+const test_obj = `# All the kinds of faces
+mtllib first.mtl Sheer Wood.mtl
+o box
+v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0 1.0
+vt 0 0
+vt 1 0
+vt 1 1 0
+vn 0 0 1
+g front
+usemtl wood
+s off
+f 1 2 3
+f 1/1 2/2 3/3
+f 1//1 2//1 \
+  3//1
+f -4/-3/-1 -3/-2/-1 -2/-1/-1 -1/-1/-1
+usemtl metal
+s 1
+f 1 3 4
+l 1 2
+l 2 3
+f 1 2
+f 1 2 9
+f 1/x 2 3
+v 1 2
+curv 0 1 1 2
+`
+
+func TestOBJFormats(t * testing.T) {
+	rd, err := readOBJ(strings.NewReader(test_obj))
+	if rd == nil {
+		t.Fatalf("Model should be read besides the errors: %v", err)
+	}
+
+	errs, ok := err.(OBJErrors)
+	expect_errors := []int{25, 26, 27, 28}
+	if !ok || len(errs) != len(expect_errors) {
+		t.Fatalf("Expected errors on lines %v, got %v", expect_errors, err)
+	}
+	for i, line := range expect_errors {
+		if errs[i].Line != line {
+			t.Errorf("Error should be on line %d: %v", line, errs[i])
+		}
+	}
+	if len(rd.Warnings) != 2 || rd.Warnings[0].Line != 23 || rd.Warnings[1].Line != 29 {
+		t.Errorf("Expected warnings for the first line and the curve, got %v", rd.Warnings)
+	}
+
+	if len(rd.Libraries) != 2 || rd.Libraries[0] != "first.mtl" || rd.Libraries[1] != "Sheer Wood.mtl" {
+		t.Errorf("Libraries are %q", rd.Libraries)
+	}
+	if len(rd.Geodes) != 2 {
+		t.Fatalf("Expected a geode for each material, got %#v", rd.Geodes)
+	}
+	for i, material := range []string{"wood", "metal"} {
+		if g := rd.Geodes[i]; g.Name != "front" || g.Object != "box" || g.Material != material {
+			t.Errorf("Geode %d should be box/front in %s, got %s/%s in %s", i, material, g.Object, g.Name, g.Material)
+		}
+	}
+	faces := []OBJFace{
+		{{1, 0, 0}, {2, 0, 0}, {3, 0, 0}},
+		{{1, 0, 1}, {2, 0, 2}, {3, 0, 3}},
+		{{1, 1, 0}, {2, 1, 0}, {3, 1, 0}},
+		{{1, 1, 1}, {2, 1, 2}, {3, 1, 3}, {4, 1, 3}},
+	}
+	if len(rd.Geodes[0].Faces) != len(faces) {
+		t.Fatalf("Expected %d faces, got %v", len(faces), rd.Geodes[0].Faces)
+	}
+	for i, face := range faces {
+		for j, point := range face {
+			if got := rd.Geodes[0].Faces[i][j]; got != point {
+				t.Errorf("Face %d vertex %d should be %v, got %v", i, j, point, got)
+			}
+		}
+	}
+
+	// Some corners have no normal, so LUX is left to work them out.
+	buf := &bytes.Buffer{}
+	if err := rd.Scenify(buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "normal N") {
+		t.Errorf("Normals should be left out: %s", buf.String())
+	}
+}
+
+// TestOBJReference reads the reference models, which should have no problems at all.
+// Groups without faces make no geodes.
+func TestOBJReference(t * testing.T) {
+	for name, geodes := range map[string]int{"Chair.obj": 6, "Coffe-Table.obj": 1, "Dalselv_Bed.obj": 5, "Swivel_Chair.obj": 1} {
+		rd := testReadObj(t, name)
+		if rd == nil {
+			continue
+		}
+		if len(rd.Warnings) != 0 {
+			t.Errorf("%s: %v", name, rd.Warnings)
+		}
+		faces := 0
+		for _, g := range rd.Geodes {
+			faces += len(g.Faces)
+			for _, face := range g.Faces {
+				for _, point := range face {
+					if point.N == 0 {
+						t.Fatalf("%s: every face has normals, %s does not", name, g.Name)
+					}
+				}
+			}
+		}
+		if len(rd.Geodes) != geodes || faces == 0 {
+			t.Errorf("%s: expected %d geodes, got %d with %d faces", name, geodes, len(rd.Geodes), faces)
+		}
+		for _, mesh := range rd.Meshes() {
+			if len(mesh.N) != len(mesh.P) || len(mesh.UV) != len(mesh.P) {
+				t.Errorf("%s: mesh has %d points, %d normals and %d uvs", name, len(mesh.P), len(mesh.N), len(mesh.UV))
+			}
+		}
+	}
+	if rd := testReadObj(t, "Chair.obj"); rd != nil && (len(rd.Libraries) != 1 || rd.Libraries[0] != "ANG010026.mtl" || rd.Geodes[0].Material != "02___Default") {
+		t.Errorf("Chair should use 02___Default of ANG010026.mtl: %q %q", rd.Libraries, rd.Geodes[0].Material)
+	}
+}
+
 func TestTemplate(t * testing.T) {
 	data := struct { X int
 			V [3]float32 }{42, [3]float32{0.1, 0.2, 0.3}}
@@ -196,3 +577,38 @@ func TestTemplate(t * testing.T) {
 	a.Execute(buf, data)
 	t.Logf("[%s]", string(buf.Bytes()))
 }
+
+func TestHeaderWith(t * testing.T) {
+	scene := LUXHeader{[9]float32{0, 0, -1, 0, 0, 0, 0, 1, 0}, 30.0, 400, 200, 25, LUXLens{}}
+	expect := func(asked, used cloud.RenderSettings) {
+		head, got := HeaderWith(scene, asked)
+		if got != used || head.X != used.Width || head.Y != used.Height || head.PPX != used.HaltSPP || head.Sampler != used.Sampler {
+			t.Errorf("%#v should end up %#v, got %#v %#v", asked, used, got, head)
+		}
+	}
+	expect(cloud.RenderSettings{}, cloud.RenderSettings{Width: 400, Height: 200, HaltSPP: 25, Sampler: "metropolis", FOV: 30, Format: "png"})
+	expect(cloud.RenderSettings{Width: 1000, Sampler: "erpt", Format: "exr"},
+		cloud.RenderSettings{Width: 1000, Height: 500, HaltSPP: 25, Sampler: "erpt", FOV: 30, Format: "exr"})
+	expect(cloud.RenderSettings{Height: 50, HaltSPP: 100, FOV: 60},
+		cloud.RenderSettings{Width: 100, Height: 50, HaltSPP: 100, Sampler: "metropolis", FOV: 60, Format: "png"})
+	expect(cloud.RenderSettings{Width: 1000, Debug: true},
+		cloud.RenderSettings{Width: 100, Height: 100, HaltSPP: 25, Sampler: "metropolis", FOV: 30, Format: "png", Debug: true})
+
+	// Resolution of the scene is not clamped any more, only missing ones are made up.
+	scene.X, scene.Y = 3000, 2000
+	expect(cloud.RenderSettings{}, cloud.RenderSettings{Width: 3000, Height: 2000, HaltSPP: 25, Sampler: "metropolis", FOV: 30, Format: "png"})
+	scene.X, scene.Y = 0, 0
+	expect(cloud.RenderSettings{}, cloud.RenderSettings{Width: 150, Height: 150, HaltSPP: 25, Sampler: "metropolis", FOV: 30, Format: "png"})
+
+	head, _ := HeaderWith(scene, cloud.RenderSettings{Sampler: "lowdiscrepancy", Format: "tga"})
+	buf := &bytes.Buffer{}
+	head.Scenify(buf)
+	if !strings.Contains(buf.String(), `Sampler "lowdiscrepancy"`) || !strings.Contains(buf.String(), `"bool write_tga" ["true"]`) {
+		t.Errorf("Header should tell the sampler and the format: %s", buf.String())
+	}
+	buf.Reset()
+	scene.Scenify(buf)
+	if !strings.Contains(buf.String(), `Sampler "metropolis"`) || strings.Contains(buf.String(), "write_") {
+		t.Errorf("Plain header renders as before: %s", buf.String())
+	}
+}
@@ -0,0 +1,536 @@
+package lux
+
+/*
+
+  Draft renders.
+
+  A quick look at the layout: the scene is rasterized here instead of being
+  sampled by the renderer. Walls, models, camera and lights are the ones the
+  render gets; shading is Lambertian, without shadows or reflections.
+
+*/
+
+import (
+	"cloud"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type draft_vec [3]float64
+
+func (a draft_vec) plus(b draft_vec) draft_vec {
+	return draft_vec{a[0] + b[0], a[1] + b[1], a[2] + b[2]}
+}
+
+func (a draft_vec) minus(b draft_vec) draft_vec {
+	return draft_vec{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func (a draft_vec) times(k float64) draft_vec {
+	return draft_vec{a[0] * k, a[1] * k, a[2] * k}
+}
+
+func (a draft_vec) dot(b draft_vec) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func (a draft_vec) cross(b draft_vec) draft_vec {
+	return draft_vec{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a draft_vec) unit() draft_vec {
+	if l := math.Sqrt(a.dot(a)); l > 0 {
+		return a.times(1 / l)
+	}
+	return a
+}
+
+func draft_vec_of(v [3]float32) draft_vec {
+	return draft_vec{float64(v[0]), float64(v[1]), float64(v[2])}
+}
+
+// draft_matrix is column-major, as ConcatTransform takes it.
+type draft_matrix [16]float64
+
+var draft_identity = draft_matrix{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+
+func (a draft_matrix) concat(b [16]float32) draft_matrix {
+	c := draft_matrix{}
+	for col := 0; col < 4; col++ {
+		for row := 0; row < 4; row++ {
+			for k := 0; k < 4; k++ {
+				c[col*4+row] += a[k*4+row] * float64(b[col*4+k])
+			}
+		}
+	}
+	return c
+}
+
+func (a draft_matrix) point(p draft_vec) draft_vec {
+	return draft_vec{
+		a[0]*p[0] + a[4]*p[1] + a[8]*p[2] + a[12],
+		a[1]*p[0] + a[5]*p[1] + a[9]*p[2] + a[13],
+		a[2]*p[0] + a[6]*p[1] + a[10]*p[2] + a[14]}
+}
+
+// normal transforms a normal, which is right for rotations and uniform scales that models are placed with.
+func (a draft_matrix) normal(n draft_vec) draft_vec {
+	return draft_vec{
+		a[0]*n[0] + a[4]*n[1] + a[8]*n[2],
+		a[1]*n[0] + a[5]*n[1] + a[9]*n[2],
+		a[2]*n[0] + a[6]*n[1] + a[10]*n[2]}.unit()
+}
+
+type draft_vertex struct {
+	P, N draft_vec // World position and normal.
+	UV   [2]float64
+}
+
+type draft_triangle struct {
+	V       [3]draft_vertex
+	Smooth  bool      // Normals of the vertices are interpolated, or else the face is flat.
+	Face    draft_vec // Normal of the face.
+	Albedo  draft_vec // Colour, or tint of the texture.
+	Texture image.Image
+}
+
+// draft_light shines from a point, maybe within a cone, or in one direction,
+// or along the view like LUXHeadLight.
+type draft_light struct {
+	P    draft_vec
+	Head bool
+	To   draft_vec // Towards a distant light; zero for the others.
+	Axis draft_vec // Of a spot light; zero for the others.
+	Cone float64   // Cosine of the angle between the axis and the edge of a spot.
+}
+
+// DraftScene is a scene ready to be rasterized.
+type DraftScene struct {
+	Head      LUXHeader // Camera and film.
+	Triangles []draft_triangle
+	Lights    []draft_light
+	Textures  map[string]image.Image // Loaded by file, nil for those that failed.
+}
+
+// Draft shading.
+var (
+	DraftAlbedo     = draft_vec{0.75, 0.75, 0.75} // Colour of surfaces without a texture or material.
+	DraftAmbient    = 0.25                        // Light everywhere, so that nothing is black.
+	DraftBackground = color.RGBA{40, 40, 40, 255} // Where nothing is.
+	draft_near      = 0.01                        // Closer than that to the camera is cut away.
+)
+
+// NewDraftScene collects the triangles, lights and camera of a scene.
+// Literal LUX chunks, except LUXHeadLight, are not understood and are left out.
+func NewDraftScene(s LUXScener) (*DraftScene, error) {
+	d := &DraftScene{
+		Head:     LUXHeader{[9]float32{0, 0, -1, 0, 0, 0, 0, 1, 0}, 30, DefaultResolution, DefaultResolution, 0, LUXLens{}},
+		Textures: map[string]image.Image{},
+	}
+	if _, err := d.add(s, draft_identity); err != nil {
+		return nil, err
+	}
+	if len(d.Lights) == 0 {
+		d.Lights = append(d.Lights, draft_light{Head: true})
+	}
+	return d, nil
+}
+
+// add collects a scener under the transform; it tells the transform for the sceners after it.
+func (a *DraftScene) add(s LUXScener, ctm draft_matrix) (draft_matrix, error) {
+	switch s := s.(type) {
+	case LUXSceneFull:
+		world, err := s.Compose()
+		if err != nil {
+			return ctm, err
+		}
+		return a.add(world, ctm)
+	case LUXWorld:
+		if _, err := a.add(s.Head, ctm); err != nil {
+			return ctm, err
+		}
+		_, err := a.add(s.Rest, ctm)
+		return ctm, err
+	case LUXHeader:
+		a.Head = s
+	case LUXRenderHeader:
+		a.Head = s.LUXHeader
+	case LUXSequence:
+		var err error
+		for _, item := range s {
+			if ctm, err = a.add(item, ctm); err != nil {
+				return ctm, err
+			}
+		}
+	case LUXWrap:
+		_, err := a.add(s.Inner, ctm)
+		return ctm, err
+	case LUXTransform:
+		return ctm.concat(s.Transform), nil
+	case *OBJ:
+		return a.add(*s, ctm)
+	case OBJ:
+		for i, mesh := range s.Meshes() {
+			albedo, texture := DraftAlbedo, image.Image(nil)
+			if m, ok := s.Materials[s.Geodes[i].Material]; ok {
+				albedo = draft_vec_of(m.Kd) // Tints the image, if any
+				if m.KdFile != "" {
+					texture = a.texture(m.KdFile)
+				}
+			}
+			a.mesh(mesh.P, mesh.N, mesh.UV, mesh.T, albedo, texture, ctm)
+		}
+	case LUXOSGTGeometry:
+		_, err := a.add(s.Graph(), ctm)
+		return ctm, err
+	case LUXTexturedMesh:
+		albedo, texture := DraftAlbedo, a.texture(s.Texture)
+		if texture != nil {
+			albedo = draft_vec{1, 1, 1}
+		}
+		a.mesh(s.P, s.N, s.UV, s.T, albedo, texture, ctm)
+	case LUXLight:
+		a.Lights = append(a.Lights, draft_light{P: ctm.point(draft_vec_of(s.Position))})
+	case LUXSpotLight:
+		from, to := ctm.point(draft_vec_of(s.From)), ctm.point(draft_vec_of(s.To))
+		a.Lights = append(a.Lights, draft_light{P: from, Axis: to.minus(from).unit(), Cone: math.Cos(float64(s.Cone) * math.Pi / 180)})
+	case LUXDistantLight:
+		from, to := ctm.point(draft_vec_of(s.From)), ctm.point(draft_vec_of(s.To))
+		a.Lights = append(a.Lights, draft_light{To: from.minus(to).unit()})
+	case LUXAreaLight:
+		a.Lights = append(a.Lights, draft_light{P: ctm.point(draft_vec_of(s.Position))})
+	case LUXStringScene:
+		if s == LUXHeadLight {
+			a.Lights = append(a.Lights, draft_light{Head: true})
+		} else {
+			log.Print("Literal LUX is left out of the draft")
+		}
+	default:
+		log.Printf("%T is left out of the draft", s)
+	}
+	return ctm, nil
+}
+
+// mesh adds the triangles of a mesh; normals are used when there is one for each point.
+func (a *DraftScene) mesh(p, n [][3]float32, uv [][2]float32, t []int, albedo draft_vec, texture image.Image, ctm draft_matrix) {
+	smooth := len(n) == len(p)
+	for i := 0; i+2 < len(t); i += 3 {
+		tri, bad := draft_triangle{Smooth: smooth, Albedo: albedo, Texture: texture}, false
+		for k := 0; k < 3 && !bad; k++ {
+			index := t[i+k]
+			if bad = index < 0 || index >= len(p); bad {
+				log.Printf("Bad triangle index %d of %d points", index, len(p))
+				continue
+			}
+			v := draft_vertex{P: ctm.point(draft_vec_of(p[index]))}
+			if smooth {
+				v.N = ctm.normal(draft_vec_of(n[index]))
+			}
+			if index < len(uv) {
+				v.UV = [2]float64{float64(uv[index][0]), float64(uv[index][1])}
+			}
+			tri.V[k] = v
+		}
+		if bad {
+			continue
+		}
+		tri.Face = tri.V[1].P.minus(tri.V[0].P).cross(tri.V[2].P.minus(tri.V[0].P)).unit()
+		a.Triangles = append(a.Triangles, tri)
+	}
+}
+
+// texture loads an image once; those that fail to load are drawn plain.
+func (a *DraftScene) texture(file string) image.Image {
+	if img, seen := a.Textures[file]; seen {
+		return img
+	}
+	a.Textures[file] = nil
+	f, err := os.Open(file)
+	if err != nil {
+		log.Print("Draft without texture: " + err.Error())
+		return nil
+	}
+	defer f.Close()
+	var img image.Image
+	if strings.EqualFold(path.Ext(file), ".tga") {
+		img, err = DecodeTGA(f)
+	} else {
+		img, _, err = image.Decode(f)
+	}
+	if err != nil {
+		log.Printf("Draft without texture %s: %s", file, err.Error())
+		return nil
+	}
+	a.Textures[file] = img
+	return img
+}
+
+// draft_camera projects world points into the screen window of the header, as luxconsole does.
+// The depth of field of the lens is not drafted.
+type draft_camera struct {
+	eye, right, up, dir draft_vec
+	ortho               bool
+	fx, fy, cx, cy      float64 // Pixels of the screen window, and its centre.
+}
+
+func new_draft_camera(h LUXHeader) draft_camera {
+	c := h.CameraFromToUp
+	eye := draft_vec{float64(c[0]), float64(c[1]), float64(c[2])}
+	dir := draft_vec{float64(c[3]), float64(c[4]), float64(c[5])}.minus(eye).unit()
+	right := draft_vec{float64(c[6]), float64(c[7]), float64(c[8])}.cross(dir).unit()
+	screen, unit := h.ScreenWindow(), 1.0
+	if !h.Lens.Ortho {
+		unit = math.Tan(float64(h.FOV) * math.Pi / 360)
+	}
+	return draft_camera{eye, right, dir.cross(right), dir, h.Lens.Ortho,
+		float64(h.X) / 2 / (float64(screen[1]) * unit), float64(h.Y) / 2 / (float64(screen[3]) * unit),
+		float64(h.X) / 2, float64(h.Y) / 2}
+}
+
+// project gives the pixel of a point in camera space.
+func (a draft_camera) project(p draft_vec) (x, y float64) {
+	k := 1 / p[2]
+	if a.ortho {
+		k = 1
+	}
+	return a.cx + p[0]*k*a.fx, a.cy - p[1]*k*a.fy
+}
+
+// draft_clip is a vertex in camera space, while clipping.
+type draft_clip struct {
+	C draft_vec
+	V draft_vertex
+}
+
+func (a draft_clip) lerp(b draft_clip, t float64) draft_clip {
+	mix := func(x, y draft_vec) draft_vec { return x.plus(y.minus(x).times(t)) }
+	return draft_clip{mix(a.C, b.C), draft_vertex{mix(a.V.P, b.V.P), mix(a.V.N, b.V.N),
+		[2]float64{a.V.UV[0] + (b.V.UV[0]-a.V.UV[0])*t, a.V.UV[1] + (b.V.UV[1]-a.V.UV[1])*t}}}
+}
+
+// clip_near cuts the polygon where it is behind the near plane.
+func clip_near(poly []draft_clip) []draft_clip {
+	out := []draft_clip{}
+	for i, a := range poly {
+		b := poly[(i+1)%len(poly)]
+		a_in, b_in := a.C[2] >= draft_near, b.C[2] >= draft_near
+		if a_in {
+			out = append(out, a)
+		}
+		if a_in != b_in {
+			out = append(out, a.lerp(b, (draft_near-a.C[2])/(b.C[2]-a.C[2])))
+		}
+	}
+	return out
+}
+
+// Draft rasterizes the scene into an image of the resolution of its header.
+func (a *DraftScene) Draft() *image.RGBA {
+	img, _ := a.DraftUntil(nil)
+	return img
+}
+
+// DraftUntil is Draft which asks stop, when given, before each triangle whether to go on;
+// its error tells why not, and the image is left as far as it got.
+func (a *DraftScene) DraftUntil(stop func() error) (*image.RGBA, error) {
+	w, h := a.Head.X, a.Head.Y
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = DraftBackground.R, DraftBackground.G, DraftBackground.B, DraftBackground.A
+	}
+	depth := make([]float64, w*h) // Of 1/z, nearer is more; 0 is nothing.
+	cam := new_draft_camera(a.Head)
+
+	for t := range a.Triangles {
+		if stop != nil {
+			if err := stop(); err != nil {
+				return img, err
+			}
+		}
+		tri := &a.Triangles[t]
+		poly := make([]draft_clip, 3)
+		for k, v := range tri.V {
+			rel := v.P.minus(cam.eye)
+			poly[k] = draft_clip{draft_vec{rel.dot(cam.right), rel.dot(cam.up), rel.dot(cam.dir)}, v}
+		}
+		poly = clip_near(poly)
+		for k := 1; k+1 < len(poly); k++ {
+			a.raster(img, depth, cam, tri, [3]draft_clip{poly[0], poly[k], poly[k+1]})
+		}
+	}
+	return img, nil
+}
+
+// raster fills the pixels of a triangle in front of the camera.
+func (a *DraftScene) raster(img *image.RGBA, depth []float64, cam draft_camera, tri *draft_triangle, v [3]draft_clip) {
+	w, h := a.Head.X, a.Head.Y
+	sx, sy, iz := [3]float64{}, [3]float64{}, [3]float64{}
+	for k := range v {
+		iz[k] = 1 / v[k].C[2]
+		sx[k], sy[k] = cam.project(v[k].C)
+	}
+	area := (sx[1]-sx[0])*(sy[2]-sy[0]) - (sx[2]-sx[0])*(sy[1]-sy[0])
+	if math.Abs(area) < 1e-12 {
+		return
+	}
+	x0, x1 := int(math.Max(0, math.Floor(math.Min(sx[0], math.Min(sx[1], sx[2]))))), int(math.Min(float64(w-1), math.Ceil(math.Max(sx[0], math.Max(sx[1], sx[2])))))
+	y0, y1 := int(math.Max(0, math.Floor(math.Min(sy[0], math.Min(sy[1], sy[2]))))), int(math.Min(float64(h-1), math.Ceil(math.Max(sy[0], math.Max(sy[1], sy[2])))))
+	for y := y0; y <= y1; y++ {
+		py := float64(y) + 0.5
+		for x := x0; x <= x1; x++ {
+			px := float64(x) + 0.5
+			b := [3]float64{
+				((sx[2]-sx[1])*(py-sy[1]) - (sy[2]-sy[1])*(px-sx[1])) / area,
+				((sx[0]-sx[2])*(py-sy[2]) - (sy[0]-sy[2])*(px-sx[2])) / area,
+				((sx[1]-sx[0])*(py-sy[0]) - (sy[1]-sy[0])*(px-sx[0])) / area,
+			}
+			if b[0] < 0 || b[1] < 0 || b[2] < 0 {
+				continue
+			}
+			z := b[0]*iz[0] + b[1]*iz[1] + b[2]*iz[2]
+			if cam.ortho { // Depth is linear on the screen
+				z = 1 / (b[0]*v[0].C[2] + b[1]*v[1].C[2] + b[2]*v[2].C[2])
+			}
+			if z <= depth[y*w+x] {
+				continue
+			}
+			depth[y*w+x] = z
+
+			// Perspective-correct weights of the vertices.
+			pw := [3]float64{b[0] * iz[0] / z, b[1] * iz[1] / z, b[2] * iz[2] / z}
+			if cam.ortho {
+				pw = b
+			}
+			at := draft_vertex{}
+			for k := range v {
+				at.P = at.P.plus(v[k].V.P.times(pw[k]))
+				at.N = at.N.plus(v[k].V.N.times(pw[k]))
+				at.UV[0] += v[k].V.UV[0] * pw[k]
+				at.UV[1] += v[k].V.UV[1] * pw[k]
+			}
+			img.SetRGBA(x, y, a.shade(cam, tri, at))
+		}
+	}
+}
+
+// shade lights a point of a triangle; surfaces are lit from both sides.
+func (a *DraftScene) shade(cam draft_camera, tri *draft_triangle, at draft_vertex) color.RGBA {
+	albedo := tri.Albedo
+	if tri.Texture != nil {
+		bounds := tri.Texture.Bounds()
+		u, v := at.UV[0]-math.Floor(at.UV[0]), at.UV[1]-math.Floor(at.UV[1])
+		tx := bounds.Min.X + int(math.Min(u*float64(bounds.Dx()), float64(bounds.Dx()-1)))
+		ty := bounds.Min.Y + int(math.Min((1-v)*float64(bounds.Dy()), float64(bounds.Dy()-1)))
+		r, g, b, _ := tri.Texture.At(tx, ty).RGBA()
+		albedo = draft_vec{albedo[0] * float64(r) / 0xffff, albedo[1] * float64(g) / 0xffff, albedo[2] * float64(b) / 0xffff}
+	}
+	n := tri.Face
+	if tri.Smooth {
+		n = at.N.unit()
+	}
+	light := 0.0
+	for _, l := range a.Lights {
+		to := cam.dir.times(-1)
+		switch {
+		case l.Head:
+		case l.To != (draft_vec{}):
+			to = l.To
+		default:
+			to = l.P.minus(at.P).unit()
+			if l.Axis != (draft_vec{}) && to.dot(l.Axis) > -l.Cone { // Outside the cone
+				continue
+			}
+		}
+		light += math.Abs(n.dot(to))
+	}
+	k := DraftAmbient + (1-DraftAmbient)*math.Min(light, 1)
+	channel := func(c float64) uint8 { return uint8(math.Min(255, c*k*255+0.5)) }
+	return color.RGBA{channel(albedo[0]), channel(albedo[1]), channel(albedo[2]), 255}
+}
+
+// DoDraftScene rasterizes the scene into output, a .png or a .tga, and notes how it went in status.
+// A .tga gets its .png along, as luxconsole writes.
+// ctl, when given, may cancel it; its Timeout is TimeoutBase unless told.
+// A draft that was stopped is written as far as it got.
+func DoDraftScene(s LUXScener, output, status string, ctl *RenderControl) (RenderStats, error) {
+	stats := RenderStats{}
+	started := time.Now()
+	f, err := os.OpenFile(status, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	format := strings.TrimPrefix(path.Ext(output), ".")
+	if format != "png" && format != "tga" {
+		return stats, RenderError{"Drafts are only written as *.png or *.tga files", nil}
+	}
+	scene, err := NewDraftScene(s)
+	if err != nil {
+		return stats, err
+	}
+	fmt.Fprintf(f, "Draft of %d triangles, %d lights, %dx%d\n", len(scene.Triangles), len(scene.Lights), scene.Head.X, scene.Head.Y)
+	img, stopped := scene.DraftUntil(draft_stop(ctl, started))
+	if stopped != nil {
+		fmt.Fprintf(f, "Draft stopped: %s\n", stopped.Error())
+	}
+
+	err = write_draft(output, img)
+	if err == nil && format != "png" {
+		err = write_draft(cloud.PNGOf(output), img) // Shown while and after it renders, as luxconsole does.
+	}
+	stats.Wall = time.Since(started)
+	stats.CPU = stats.Wall
+	fmt.Fprintf(f, "Draft done in %v\n", stats.Wall)
+	if stopped != nil {
+		return stats, stopped
+	}
+	return stats, err
+}
+
+// write_draft writes the image as a .png or a .tga, after the name of the file.
+func write_draft(output string, img *image.RGBA) error {
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if path.Ext(output) == ".png" {
+		err = png.Encode(out, img)
+	} else {
+		err = write_tga(out, img)
+	}
+	if close_err := out.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+// draft_stop tells a draft begun at started to stop when ctl is cancelled or its time is up.
+func draft_stop(ctl *RenderControl, started time.Time) func() error {
+	if ctl == nil {
+		return nil
+	}
+	limit := ctl.Timeout
+	if limit == 0 {
+		limit = TimeoutBase
+	}
+	return func() error {
+		select {
+		case <-ctl.Cancel:
+			return RenderCancelled
+		default:
+		}
+		if limit > 0 && time.Since(started) > limit {
+			return RenderTimedOut
+		}
+		return nil
+	}
+}
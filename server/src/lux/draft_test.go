@@ -0,0 +1,234 @@
+package lux
+
+import (
+	"bytes"
+	"cloud"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDecodeTGA(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.SetRGBA(0, 0, color.RGBA{255, 0, 0, 255})
+	img.SetRGBA(2, 1, color.RGBA{0, 0, 255, 255})
+	tga := bytes.Buffer{}
+	write_tga(&tga, img)
+	back, err := DecodeTGA(&tga)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, at := range []image.Point{{0, 0}, {1, 0}, {2, 1}} {
+		r, g, b, _ := back.At(at.X, at.Y).RGBA()
+		r0, g0, b0, _ := img.At(at.X, at.Y).RGBA()
+		if r != r0 || g != g0 || b != b0 {
+			t.Errorf("Pixel %v should survive TGA", at)
+		}
+	}
+
+	// Run-length encoded and stored bottom up, as the desktop application writes them.
+	textures := Resolver{}
+	textures.Scan(path.Join(STORE_PLACE, "reference/texture"))
+	if len(textures) == 0 {
+		t.Skip("Reference textures are not available")
+	}
+	for _, file := range textures {
+		f, _ := os.Open(file)
+		img, err := DecodeTGA(f)
+		f.Close()
+		if err != nil || img.Bounds().Dx() < 100 {
+			t.Errorf("Unable to read %s: %v", file, err)
+		}
+	}
+	if _, err := DecodeTGA(bytes.NewReader([]byte{0, 0, 10, 0})); err == nil {
+		t.Error("Truncated image must be refused")
+	}
+}
+
+// draft_quad is a square of two triangles in the z=0 plane, facing the camera.
+var draft_quad = OBJ{
+	Vertices: []OBJVector{{-1, -1, 0}, {1, -1, 0}, {1, 1, 0}, {-1, 1, 0}},
+	Normals:  []OBJNormal{{0, 0, -1}},
+	UWs:      []OBJUW{{0, 0}},
+	Geodes:   []OBJGeode{{Name: "quad", Faces: []OBJFace{{{1, 1, 1}, {2, 1, 1}, {3, 1, 1}, {4, 1, 1}}}}},
+}
+
+func TestDraft(t *testing.T) {
+	background := func(img *image.RGBA, x, y int) bool {
+		return img.RGBAAt(x, y) == DraftBackground
+	}
+	head := LUXHeader{[9]float32{0, 0, -5, 0, 0, 0, 0, 1, 0}, 30, 64, 48, 1, LUXLens{}}
+	scene, err := NewDraftScene(LUXWorld{head, LUXSequence{LUXHeadLight, draft_quad}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	img := scene.Draft()
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 48 || len(scene.Triangles) != 2 {
+		t.Fatalf("Unexpected draft %v of %d triangles", img.Bounds(), len(scene.Triangles))
+	}
+	if lit := img.RGBAAt(32, 24); lit.R != 191 || lit.G != 191 {
+		t.Errorf("Facing the head light, the quad is as bright as it gets: %v", lit)
+	}
+	if !background(img, 1, 1) || !background(img, 62, 46) {
+		t.Error("Corners should be empty")
+	}
+
+	// Looking along +z with y up, luxconsole has +x on the right.
+	moved := LUXWrap{LUXSequence{LUXTransform{[16]float32{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 1.2, 0, 0, 1}}, draft_quad}, "Transform"}
+	scene, _ = NewDraftScene(LUXWorld{head, LUXSequence{moved, LUXLight{Position: [3]float32{0, 0, -10}}}})
+	img = scene.Draft()
+	if !background(img, 14, 24) || background(img, 50, 24) {
+		t.Error("Transform should move the quad")
+	}
+
+	// Nearer hides farther, whatever the order.
+	near := LUXWrap{LUXSequence{LUXTransform{[16]float32{0.5, 0, 0, 0, 0, 0.5, 0, 0, 0, 0, 0.5, 0, 0, 0, -1, 1}}, draft_quad}, "Transform"}
+	behind := LUXWrap{LUXSequence{LUXTransform{[16]float32{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}}, draft_quad}, "Transform"}
+	red := image.NewUniform(color.RGBA{255, 0, 0, 255})
+	for _, order := range []LUXSequence{{near, behind}, {behind, near}} {
+		scene, _ = NewDraftScene(LUXWorld{head, order})
+		for i := range scene.Triangles {
+			if scene.Triangles[i].V[0].P[2] == -1 {
+				scene.Triangles[i].Texture = red
+			}
+		}
+		img = scene.Draft()
+		if center, edge := img.RGBAAt(32, 24), img.RGBAAt(32, 6); center.G != 0 || center.R == 0 || edge.G == 0 {
+			t.Errorf("Nearer quad should be seen in front: %v %v", center, edge)
+		}
+	}
+
+	// A spot lights only within its cone, a distant light only from its side.
+	spot := LUXSpotLight{From: [3]float32{0, 0, -3}, Cone: 10}
+	scene, _ = NewDraftScene(LUXWorld{head, LUXSequence{spot, draft_quad}})
+	img = scene.Draft()
+	if centre, corner := img.RGBAAt(32, 24), img.RGBAAt(48, 8); centre.R != 191 || corner.R != 48 {
+		t.Errorf("Spot should light the centre only: %v %v", centre, corner)
+	}
+	for from, expect := range map[[3]float32]uint8{{0, 0, -1}: 191, {1, 0, 0}: 48} {
+		scene, _ = NewDraftScene(LUXWorld{head, LUXSequence{LUXDistantLight{From: from}, draft_quad}})
+		if lit := scene.Draft().RGBAAt(48, 8); lit.R != expect {
+			t.Errorf("Distant light from %v should give %d, got %v", from, expect, lit)
+		}
+	}
+
+	// The field of view spans the height, whatever the shape of the image.
+	tall := head
+	tall.X, tall.Y = 36, 48
+	scene, _ = NewDraftScene(LUXWorld{tall, draft_quad})
+	img = scene.Draft()
+	if background(img, 18, 24+16) || !background(img, 18, 24+19) || background(img, 18-16, 24) {
+		t.Error("Quad should be as tall as in a wide image")
+	}
+
+	// An orthographic camera sees as much from anywhere.
+	for _, distance := range []float32{-5, -50} {
+		ortho := head
+		ortho.CameraFromToUp[2] = distance
+		ortho.Lens = LUXLens{Ortho: true, Height: 4}
+		scene, _ = NewDraftScene(LUXWorld{ortho, draft_quad})
+		img = scene.Draft()
+		if background(img, 32, 24+11) || !background(img, 32, 24+13) || background(img, 32+11, 24) || !background(img, 32+13, 24) {
+			t.Errorf("Quad should be half as tall as the view at %g", distance)
+		}
+	}
+
+	// Behind the camera is cut away.
+	head.CameraFromToUp = [9]float32{0, 0, 0.5, 0, 0, 1, 0, 1, 0}
+	scene, _ = NewDraftScene(LUXWorld{head, draft_quad})
+	if img = scene.Draft(); !background(img, 32, 24) {
+		t.Error("Nothing should be seen looking away")
+	}
+}
+
+func TestDraftReference(t *testing.T) {
+	files := Resolver{}
+	if err := files.Scan(STORE_PLACE); err != nil {
+		t.Skip("Reference scenes are not available: " + err.Error())
+	}
+	file, err := files.Get("reference/RenderingData.xml")
+	if err != nil {
+		t.Skip("Reference scenes are not available: " + err.Error())
+	}
+	world, err := ReadConfigurationFile(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	started := time.Now()
+	scene, err := NewDraftScene(LUXSceneFull{files, *world, cloud.RenderSettings{Width: 320}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	img := scene.Draft()
+	if time.Since(started) > 30*time.Second {
+		t.Errorf("Draft should be quick, took %v", time.Since(started))
+	}
+	textured := 0
+	for _, tri := range scene.Triangles {
+		if tri.Texture != nil {
+			textured++
+		}
+	}
+	if img.Bounds().Dx() != 320 || img.Bounds().Dy() != 240 || textured == 0 || textured == len(scene.Triangles) || len(scene.Lights) != 1 {
+		t.Errorf("Walls, models and the light should be drafted, got %v: %d triangles, %d textured, %d lights", img.Bounds(), len(scene.Triangles), textured, len(scene.Lights))
+	}
+	drawn := 0
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			if img.RGBAAt(x, y) != DraftBackground {
+				drawn++
+			}
+		}
+	}
+	if drawn < 320*240/10 {
+		t.Errorf("Too little is drawn: %d pixels", drawn)
+	}
+}
+
+func TestDraftJob(t *testing.T) {
+	osgt, err := ioutil.ReadFile(path.Join(STORE_PLACE, "reference/KdlProject_design_1.osgt"))
+	if err != nil {
+		t.Skip("Reference scene is not available: " + err.Error())
+	}
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_draft%d", time.Now().UnixNano()))
+	os.MkdirAll(place, 0777)
+	in := path.Join(place, "scene.osgt")
+	ioutil.WriteFile(in, osgt, 0666)
+	defer fake_renderer(place, "exit 1\n")() // Drafts do not need it.
+
+	reporter := &live_reporter{}
+	settings := cloud.RenderSettings{Width: 200, Draft: true}
+	if err := render_job(in, in+".png", in+".log", Resolver{}, RenderControl{Settings: settings}, reporter); err != nil {
+		t.Fatal(err.Error())
+	}
+	if reporter.outcome.State != cloud.JobSucceeded || !reporter.outcome.Settings.Draft {
+		t.Errorf("Unexpected outcome: %#v", reporter.outcome)
+	}
+	data, _ := ioutil.ReadFile(in + ".png")
+	if img, err := png.Decode(bytes.NewReader(data)); err != nil || img.Bounds().Dx() != 200 {
+		t.Errorf("Draft should be written: %v", err)
+	}
+
+	cancel := make(chan bool)
+	close(cancel)
+	scene, _, _ := SceneFor(in, Resolver{}, settings, func(string) {})
+	os.Remove(in + ".png")
+	if _, err := DoDraftScene(scene, in+".tga", in+".log", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(in + ".png"); err != nil {
+		t.Error("A tga draft should have its png along")
+	}
+	if _, err := DoDraftScene(scene, in+".png", in+".log", &RenderControl{Cancel: cancel}); err != RenderCancelled {
+		t.Errorf("Draft should be cancelled, got %v", err)
+	}
+	if _, err := DoDraftScene(scene, in+".png", in+".log", &RenderControl{Timeout: time.Nanosecond}); err != RenderTimedOut {
+		t.Errorf("Draft should time out, got %v", err)
+	}
+}
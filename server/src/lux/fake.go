@@ -0,0 +1,169 @@
+package lux
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// FakeRenderer stands in for luxconsole where it is not installed, such as in tests.
+// It reads the film of the scene and draws a picture made of the scene text,
+// so the same scene always gives the same picture and log.
+type FakeRenderer struct {
+	Delay time.Duration // How long a render pretends to take.
+}
+
+func init() {
+	RegisterRenderer(FakeRenderer{})
+}
+
+// fake_steps is how many times the fake tells its progress.
+const fake_steps = 4
+
+// fake_time stamps the log lines, which are the same each time.
+const fake_time = "2000-Jan-01 00:00:00"
+
+var (
+	fake_resolution = regexp.MustCompile(`"integer ([xy])resolution"\s*\[\s*(\d+)\s*\]`)
+	fake_write      = regexp.MustCompile(`"bool write_(png|tga|exr)"\s*\[\s*"true"\s*\]`)
+	fake_shape      = regexp.MustCompile(`(?m)^\s*Shape\s`)
+	fake_light      = regexp.MustCompile(`(?m)^\s*(LightSource|AreaLightSource)\s`)
+)
+
+func (a FakeRenderer) Name() string {
+	return "fake"
+}
+
+func (a FakeRenderer) Check() error {
+	return nil
+}
+
+// FakeFilm is what the fake reads from a scene.
+type FakeFilm struct {
+	X, Y          int
+	HaltSPP       int
+	Formats       []string // Besides png.
+	Shapes, Light int
+	Hash          uint32 // Of the whole scene.
+}
+
+// ReadFakeFilm reads the film of a scene, with the luxconsole defaults for what it does not tell.
+func ReadFakeFilm(scene []byte) FakeFilm {
+	film := FakeFilm{X: 800, Y: 600, HaltSPP: HaltSamplesPerPixelOf(scene)}
+	for _, found := range fake_resolution.FindAllSubmatch(scene, -1) {
+		n, _ := strconv.Atoi(string(found[2]))
+		if string(found[1]) == "x" {
+			film.X = n
+		} else {
+			film.Y = n
+		}
+	}
+	for _, found := range fake_write.FindAllSubmatch(scene, -1) {
+		if format := string(found[1]); format != "png" {
+			film.Formats = append(film.Formats, format)
+		}
+	}
+	film.Shapes = len(fake_shape.FindAll(scene, -1))
+	film.Light = len(fake_light.FindAll(scene, -1))
+	hash := fnv.New32a()
+	hash.Write(scene)
+	film.Hash = hash.Sum32()
+	return film
+}
+
+// Image draws the picture of the film: a shade of the colour of the scene hash,
+// lighter towards the bottom, in a checker with a row more than the scene has shapes.
+func (a FakeFilm) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, a.X, a.Y))
+	base := [3]uint32{a.Hash >> 16 & 0xff, a.Hash >> 8 & 0xff, a.Hash & 0xff}
+	cell := a.Y / (a.Shapes + 1)
+	if cell < 1 {
+		cell = 1
+	}
+	for y := 0; y < a.Y; y++ {
+		for x := 0; x < a.X; x++ {
+			shade := uint32(128 + 127*y/a.Y)
+			if (x/cell+y/cell)%2 == 1 {
+				shade /= 2
+			}
+			img.SetRGBA(x, y, color.RGBA{uint8(base[0] * shade / 255), uint8(base[1] * shade / 255), uint8(base[2] * shade / 255), 255})
+		}
+	}
+	return img
+}
+
+// Render writes the pictures once the Delay is over, telling the progress as luxconsole does.
+func (a FakeRenderer) Render(run RenderRun) (time.Duration, error) {
+	started := time.Now()
+	say := func(level, format string, args ...interface{}) {
+		fmt.Fprintf(run.Out, "[Lux %s %s : 0] %s\n", fake_time, level, fmt.Sprintf(format, args...))
+	}
+	scene, err := ioutil.ReadFile(run.Scene)
+	if err != nil {
+		say("SEVERE", "Unable to read scenefile '%s'", run.Scene)
+		return 0, RenderError{"Fake renderer can not read the scene", err}
+	}
+	film := ReadFakeFilm(scene)
+	for _, format := range film.Formats {
+		if format == "exr" {
+			say("SEVERE", "EXR is not written by the fake renderer")
+			return 0, RenderError{"Fake renderer does not write EXR", nil}
+		}
+	}
+	if film.X <= 0 || film.Y <= 0 || film.X > 1<<14 || film.Y > 1<<14 {
+		say("SEVERE", "Bad resolution %dx%d", film.X, film.Y)
+		return 0, RenderError{fmt.Sprintf("Bad resolution %dx%d", film.X, film.Y), nil}
+	}
+	threads := run.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+	say("INFO", "Fake rendering %dx%d: %d shapes, %d lights", film.X, film.Y, film.Shapes, film.Light)
+
+	halt := float64(film.HaltSPP)
+	if halt <= 0 {
+		halt = fake_steps
+	}
+	for step := 1; step <= fake_steps; step++ {
+		select {
+		case err := <-run.Abort:
+			return time.Since(started), err
+		case <-time.After(a.Delay / fake_steps):
+		}
+		elapsed := int((a.Delay * time.Duration(step) / fake_steps).Seconds())
+		say("INFO", "%ds [%.1f%% Complete]: %d threads, %.2f S/p  0.00k S/s", elapsed, float64(100*step)/fake_steps, threads, halt*float64(step)/fake_steps)
+	}
+
+	img := film.Image()
+	for _, format := range append([]string{"png"}, film.Formats...) {
+		name := run.OutputBase + "." + format
+		f, err := os.Create(name)
+		if err != nil {
+			return time.Since(started), err
+		}
+		picture := bytes.Buffer{}
+		if format == "png" {
+			err = png.Encode(&picture, img)
+		} else {
+			err = write_tga(&picture, img)
+		}
+		if err == nil {
+			_, err = f.Write(picture.Bytes())
+		}
+		f.Close()
+		if err != nil {
+			return time.Since(started), err
+		}
+		say("INFO", "Writing Tonemapped %s image to file '%s'", format, name)
+	}
+	say("INFO", "Rendering done.")
+	return time.Since(started), nil
+}
@@ -0,0 +1,67 @@
+package lux
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// LuxConsole renders with the LUX command line tool, which must be on the PATH.
+type LuxConsole struct{}
+
+func init() {
+	RegisterRenderer(LuxConsole{})
+}
+
+func (a LuxConsole) Name() string {
+	return "luxconsole"
+}
+
+func (a LuxConsole) Check() error {
+	path, err := exec.LookPath(LUX)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found renderer at %s", path)
+	return nil
+}
+
+// Render runs luxconsole, which writes the pictures every FilmWriteInterval.
+// An abort kills it with whatever it spawned.
+func (a LuxConsole) Render(run RenderRun) (time.Duration, error) {
+	path, err := exec.LookPath(LUX)
+	if err != nil {
+		return 0, err
+	}
+
+	args := []string{run.Scene, "-o", run.OutputBase, "-V"}
+	if run.Threads > 0 {
+		args = append(args, "-t", fmt.Sprint(run.Threads))
+	}
+	cmd := exec.Command(path, args...)
+	log.Printf("Initiating: %s %s %s %s", path, run.Scene, "-o", run.OutputBase)
+	cmd.Stdout, cmd.Stderr = run.Out, run.Out
+	own_group(cmd)
+
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+	finished := make(chan error, 1)
+	go func() {
+		finished <- cmd.Wait()
+	}()
+	select {
+	case err = <-finished:
+	case err = <-run.Abort:
+		if err := kill_tree(cmd); err != nil {
+			log.Print("Failed to stop the renderer: " + err.Error())
+		}
+		<-finished
+	}
+	cpu := time.Duration(0)
+	if cmd.ProcessState != nil {
+		cpu = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	return cpu, err
+}
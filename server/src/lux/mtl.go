@@ -0,0 +1,400 @@
+package lux
+
+/*
+
+  Material libraries.
+
+  Models come with Wavefront .mtl libraries that tell the colour, shininess,
+  transparency and images of their surfaces. Each material a model uses is made
+  into a LUX named material, with the images as imagemap textures.
+
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// MTLMaterial is a material of a library.
+type MTLMaterial struct {
+	Name    string
+	Kd, Ks  [3]float32 // Diffuse and specular colours.
+	Ns      float32    // Specular exponent, 0 to 1000.
+	D       float32    // Dissolve; 1 is opaque.
+	Illum   int        // Illumination model; 0 and 1 have no highlights.
+	MapKd   string     // Diffuse image, as the library names it.
+	MapBump string     // Bump image.
+}
+
+// MTL is a material library by material name.
+type MTL map[string]MTLMaterial
+
+// mtl_options are the options of map statements, with how many values they take;
+// -1 is up to three numbers.
+var mtl_options = map[string]int{
+	"-blendu": 1, "-blendv": 1, "-boost": 1, "-cc": 1, "-clamp": 1, "-imfchan": 1,
+	"-texres": 1, "-type": 1, "-bm": 1, "-mm": 2, "-o": -1, "-s": -1, "-t": -1,
+}
+
+// readMTL reads the Wavefront .mtl format. Kd, Ks, Ns, d (or Tr), illum, map_Kd and
+// map_Bump (or bump) are kept; other statements are of no use to LUX and are skipped.
+// As with readOBJ, lines in error are left out and returned as OBJErrors with the rest.
+func readMTL(r io.Reader) (MTL, error) {
+	res := MTL{}
+	errs := OBJErrors{}
+	var the_material *MTLMaterial
+	at := 0
+
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, OBJError{at, fmt.Sprintf(format, args...)})
+	}
+	number := func(field string, least, most float64) (float32, bool) {
+		n, err := strconv.ParseFloat(field, 32)
+		if err != nil || n < least || n > most {
+			fail("%q is not a number from %g to %g", field, least, most)
+			return 0, false
+		}
+		return float32(n), true
+	}
+	colour := func(fields []string) ([3]float32, bool) {
+		if len(fields) != 2 && len(fields) != 4 { // A grey or r g b
+			fail("%s takes 1 or 3 numbers, spectral and xyz colours are not supported", fields[0])
+			return [3]float32{}, false
+		}
+		out := [3]float32{}
+		for i := range out {
+			n, ok := number(fields[1+i%(len(fields)-1)], 0, math.MaxFloat32)
+			if !ok {
+				return out, false
+			}
+			out[i] = n
+		}
+		return out, true
+	}
+	image := func(fields []string) (string, bool) {
+		i := 1
+		for i < len(fields) {
+			takes, option := mtl_options[fields[i]]
+			if !option {
+				break
+			}
+			i++
+			if takes < 0 { // Up to three numbers
+				for k := 0; k < 3 && i < len(fields); k, i = k+1, i+1 {
+					if _, err := strconv.ParseFloat(fields[i], 32); err != nil {
+						break
+					}
+				}
+			} else {
+				i += takes
+			}
+		}
+		if i >= len(fields) {
+			fail("%s names no image", fields[0])
+			return "", false
+		}
+		return strings.Join(fields[i:], " "), true // Names may have spaces
+	}
+
+	scnr := bufio.NewScanner(r)
+	for scnr.Scan() {
+		at++
+		got := scnr.Text()
+		if comment := strings.Index(got, "#"); comment >= 0 {
+			got = got[:comment]
+		}
+		fields := strings.Fields(got)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "newmtl" {
+			name := strings.Join(fields[1:], " ")
+			if name == "" {
+				fail("newmtl needs a name")
+				the_material = nil
+				continue
+			}
+			if _, seen := res[name]; seen {
+				fail("material %s is defined again", name)
+			}
+			m := MTLMaterial{Name: name, Kd: [3]float32{0.8, 0.8, 0.8}, D: 1, Illum: 2}
+			the_material = &m
+			res[name] = m
+			continue
+		}
+		if the_material == nil {
+			fail("%s before any newmtl", fields[0])
+			continue
+		}
+		m := the_material
+		switch strings.ToLower(fields[0]) {
+		case "kd":
+			if c, ok := colour(fields); ok {
+				m.Kd = c
+			}
+		case "ks":
+			if c, ok := colour(fields); ok {
+				m.Ks = c
+			}
+		case "ns":
+			if len(fields) != 2 {
+				fail("Ns takes a number")
+			} else if n, ok := number(fields[1], 0, 1000); ok {
+				m.Ns = n
+			}
+		case "d": // Maybe with -halo, which is drawn as plain dissolve
+			if len(fields) < 2 {
+				fail("d takes a number")
+			} else if n, ok := number(fields[len(fields)-1], 0, 1); ok {
+				m.D = n
+			}
+		case "tr":
+			if len(fields) != 2 {
+				fail("Tr takes a number")
+			} else if n, ok := number(fields[1], 0, 1); ok {
+				m.D = 1 - n
+			}
+		case "illum":
+			n, err := strconv.Atoi(strings.Join(fields[1:], " "))
+			if err != nil || n < 0 || n > 10 {
+				fail("illum takes a model from 0 to 10")
+			} else {
+				m.Illum = n
+			}
+		case "map_kd":
+			if file, ok := image(fields); ok {
+				m.MapKd = file
+			}
+		case "map_bump", "bump":
+			if file, ok := image(fields); ok {
+				m.MapBump = file
+			}
+		}
+		res[m.Name] = *m
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(errs) > 0 {
+		return res, errs
+	}
+	return res, nil
+}
+
+// ReadFileMTL parses specified .mtl file.
+// With OBJErrors the library is still given, without the lines in error.
+func ReadFileMTL(some string) (MTL, error) {
+	f, err := os.Open(some)
+	if err != nil {
+		return nil, RenderError{"Failed to read MTL file", err}
+	}
+	defer f.Close()
+	return readMTL(f)
+}
+
+// LUXMaterial is a material made ready for a LUX scene, with its images located.
+type LUXMaterial struct {
+	Name             string
+	Kd, Ks           [3]float32
+	Roughness        float32 // Of glossy materials, 0 to 1.
+	Opacity          float32
+	Glossy           bool
+	KdFile, BumpFile string // Empty for none; Kd tints the image.
+}
+
+// LUX makes the material into a LUX one of that name. It is glossy when the library
+// asks for highlights, with the roughness taken from the specular exponent.
+func (a MTLMaterial) LUX(name string) LUXMaterial {
+	return LUXMaterial{
+		Name:      strings.Replace(name, "\"", "", -1),
+		Kd:        a.Kd,
+		Ks:        a.Ks,
+		Roughness: float32(math.Sqrt(2 / (float64(a.Ns) + 2))),
+		Opacity:   a.D,
+		Glossy:    a.Illum >= 2 && a.Ks != [3]float32{},
+	}
+}
+
+// Clear tells if some light goes through the material.
+func (a LUXMaterial) Clear() bool {
+	return a.Opacity < 1
+}
+
+// LUXMaterialTemplate makes the textures and the named material. The diffuse image
+// is tinted by the diffuse colour, and a clear material is mixed with the null one.
+var LUXMaterialTemplate = template.Must(template.New("LUXMaterial").Parse(`
+{{if .KdFile}}Texture "{{.Name}}_image" "color" "imagemap"
+	"string filename" ["{{.KdFile}}"]
+	"string wrap" ["repeat"]
+	"float gamma" [2.2]
+Texture "{{.Name}}_Kd" "color" "scale"
+	"texture tex1" ["{{.Name}}_image"]
+	"color tex2" [{{range .Kd}} {{.}} {{end}}]
+{{end}}{{if .BumpFile}}Texture "{{.Name}}_bump" "float" "imagemap"
+	"string filename" ["{{.BumpFile}}"]
+	"string wrap" ["repeat"]
+	"float gamma" [1]
+{{end}}MakeNamedMaterial "{{.Name}}{{if .Clear}}_opaque{{end}}"
+	"string type" [{{if .Glossy}}"glossy"{{else}}"matte"{{end}}]
+	{{if .KdFile}}"texture Kd" ["{{.Name}}_Kd"]{{else}}"color Kd" [{{range .Kd}} {{.}} {{end}}]{{end}}
+{{if .Glossy}}	"color Ks" [{{range .Ks}} {{.}} {{end}}]
+	"float uroughness" [{{.Roughness}}]
+	"float vroughness" [{{.Roughness}}]
+	"float index" [0]
+	"bool multibounce" ["false"]
+{{end}}{{if .BumpFile}}	"texture bumpmap" ["{{.Name}}_bump"]
+{{end}}{{if .Clear}}
+MakeNamedMaterial "{{.Name}}_clear"
+	"string type" ["null"]
+
+MakeNamedMaterial "{{.Name}}"
+	"string type" ["mix"]
+	"string namedmaterial1" ["{{.Name}}_clear"]
+	"string namedmaterial2" ["{{.Name}}_opaque"]
+	"float amount" [{{.Opacity}}]
+{{end}}`))
+
+func (a LUXMaterial) Scenify(w io.Writer) error {
+	if err := LUXMaterialTemplate.Execute(w, a); err != nil {
+		return NewConvertError("Material template failed", err)
+	}
+	return nil
+}
+
+// LoadMaterials reads the material libraries of the model, found in dir or else through
+// the resolver, and makes the materials its geodes use, named after library and material.
+// Images are looked up the same way from the directory of their library.
+// Names that would leave the directory, absolute or going up, are only looked up through the resolver,
+// which knows the files of the job alone.
+// All that can not be found is told in the error, caused by the first file missing if any;
+// geodes without a material are drawn plain.
+func (an *OBJ) LoadMaterials(dir string, files Resolver) error {
+	locate := func(dir, name string) (string, error) {
+		if below(name) {
+			here := filepath.Join(dir, filepath.FromSlash(strings.Replace(name, "\\", "/", -1)))
+			if _, err := os.Stat(here); err == nil {
+				return here, nil
+			}
+		}
+		return files.Get(name)
+	}
+	problems := []string{}
+	var gone error // The first file that was not found, so that the render may be tried again.
+	problem := func(err error) {
+		if gone == nil && missing(err) {
+			gone = err
+			return
+		}
+		problems = append(problems, err.Error())
+	}
+
+	all, from := MTL{}, map[string]string{} // Materials and the libraries they come from
+	for _, name := range an.Libraries {
+		file, err := locate(dir, name)
+		if err != nil {
+			problem(RenderError{"Material library " + name + " not found", err})
+			continue
+		}
+		library, err := ReadFileMTL(file)
+		if err != nil {
+			problem(RenderError{"Material library " + file, err})
+		}
+		for material_name, m := range library {
+			if _, seen := all[material_name]; !seen { // The first library has it
+				all[material_name], from[material_name] = m, file
+			}
+		}
+	}
+
+	an.Materials = map[string]LUXMaterial{}
+	for _, g := range an.Geodes {
+		if _, done := an.Materials[g.Material]; done || g.Material == "" {
+			continue
+		}
+		m, ok := all[g.Material]
+		if !ok {
+			problem(NewConvertError("Material "+g.Material+" is not in the libraries", nil))
+			continue
+		}
+		lm := m.LUX(filepath.Base(from[m.Name]) + "/" + m.Name)
+		image := func(name string) string {
+			if name == "" {
+				return ""
+			}
+			file, err := locate(filepath.Dir(from[m.Name]), name)
+			if err != nil {
+				problem(RenderError{"Image of material " + m.Name + " not found", err})
+			}
+			return file
+		}
+		lm.KdFile, lm.BumpFile = image(m.MapKd), image(m.MapBump)
+		an.Materials[g.Material] = lm
+	}
+	if len(problems) > 0 || gone != nil {
+		return NewConvertError("Materials are incomplete: "+strings.Join(problems, "; "), gone)
+	}
+	return nil
+}
+
+// below tells if a name of a library or image is relative and stays inside the directory it is read from.
+func below(name string) bool {
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") || strings.Contains(name, ":") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// materials makes the materials of the model, in order of name.
+func (an OBJ) materials(w io.Writer) error {
+	names := []string{}
+	for name := range an.Materials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := an.Materials[name].Scenify(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMaterial gives the geodes of a group the material, over the one they had,
+// under the name, or the name and the old material where there was one.
+// It tells how many geodes took it.
+func (an *OBJ) SetMaterial(group, name string, m XMLMaterial) int {
+	if an.Materials == nil {
+		an.Materials = map[string]LUXMaterial{}
+	}
+	n := 0
+	for i, g := range an.Geodes {
+		if g.Name != group {
+			continue
+		}
+		key := name
+		if g.Material != "" {
+			key += "/" + g.Material
+		}
+		if _, done := an.Materials[key]; !done {
+			an.Materials[key] = m.LUX(key, an.Materials[g.Material])
+		}
+		an.Geodes[i].Material = key
+		n++
+	}
+	return n
+}
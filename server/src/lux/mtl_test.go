@@ -0,0 +1,161 @@
+package lux
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const test_mtl = `# Two materials
+Kd 1 1 1
+newmtl red
+Kd 1 0 0
+Ks 0.5
+Ns 200
+illum 2
+newmtl Sheer Wood
+Ka 0.2 0.2 0.2
+Kd 0.5 0.4 0.3
+Tr 0.25
+illum 1
+map_Kd -s 2 2 -bm 0.5 texture/Vatrushka-01.tga
+bump -mm 0 1 Wood Bump.tga
+Ns lots
+Kd spectral wood.rfl
+`
+
+func TestReadMTL(t *testing.T) {
+	lib, err := readMTL(strings.NewReader(test_mtl))
+	errs, ok := err.(OBJErrors)
+	if !ok || len(errs) != 3 || errs[0].Line != 2 || errs[1].Line != 15 || errs[2].Line != 16 {
+		t.Errorf("Expected errors on lines 2, 15 and 16, got %v", err)
+	}
+	red, wood := lib["red"], lib["Sheer Wood"]
+	if red.Kd != [3]float32{1, 0, 0} || red.Ks != [3]float32{0.5, 0.5, 0.5} || red.Ns != 200 || red.D != 1 || red.Illum != 2 {
+		t.Errorf("Red is %#v", red)
+	}
+	if wood.Kd != [3]float32{0.5, 0.4, 0.3} || wood.D != 0.75 || wood.Illum != 1 ||
+		wood.MapKd != "texture/Vatrushka-01.tga" || wood.MapBump != "Wood Bump.tga" {
+		t.Errorf("Wood is %#v", wood)
+	}
+
+	if m := red.LUX("red"); !m.Glossy || m.Clear() || m.Roughness < 0.09 || m.Roughness > 0.11 {
+		t.Errorf("Red should be a smooth glossy: %#v", m)
+	}
+	if m := wood.LUX("wood"); m.Glossy || !m.Clear() {
+		t.Errorf("Wood should be a clear matte: %#v", m)
+	}
+}
+
+// TestOBJMaterialsConfined keeps libraries from reading images of other members.
+func TestOBJMaterialsConfined(t *testing.T) {
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_mtl_confined%d", time.Now().UnixNano()))
+	os.MkdirAll(path.Join(place, "member", "models"), 0777)
+	os.MkdirAll(path.Join(place, "other"), 0777)
+	defer os.RemoveAll(place)
+	secret := path.Join(place, "other", "secret.tga")
+	ioutil.WriteFile(secret, []byte("private"), 0666)
+	ioutil.WriteFile(path.Join(place, "member", "models", "sneaky.mtl"), []byte("newmtl up\nmap_Kd ../../other/secret.tga\nnewmtl abs\nmap_Kd "+secret+"\n"), 0666)
+
+	rd, err := readOBJ(strings.NewReader("mtllib sneaky.mtl\nv 0 0 0\nv 1 0 0\nv 1 1 0\nusemtl up\nf 1 2 3\nusemtl abs\nf 3 2 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := Resolver{}
+	files.Scan(path.Join(place, "member"))
+	if err := rd.LoadMaterials(path.Join(place, "member", "models"), files); err == nil || !strings.Contains(err.Error(), "secret.tga") {
+		t.Errorf("Images of other members should not be found, got %v", err)
+	}
+	for name, m := range rd.Materials {
+		if m.KdFile == secret || strings.Contains(m.KdFile, "..") {
+			t.Errorf("Material %s reads %s", name, m.KdFile)
+		}
+	}
+	for name, inside := range map[string]bool{"texture/a.tga": true, "a..b.tga": true, "../a.tga": false, "x\\..\\a.tga": false, "/etc/a": false, "C:\\a.tga": false} {
+		if below(name) != inside {
+			t.Errorf("%s should be inside: %v", name, inside)
+		}
+	}
+}
+
+// TestOBJMaterials looks up a library through the resolver and the images next to it.
+func TestOBJMaterials(t *testing.T) {
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_mtl%d", time.Now().UnixNano()))
+	os.MkdirAll(path.Join(place, "library", "texture"), 0777)
+	defer os.RemoveAll(place)
+	tga, err := ioutil.ReadFile(path.Join(STORE_PLACE, "reference/texture/Vatrushka-01.tga"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(place, "library", "texture", "Vatrushka-01.tga"), tga, 0666)
+	ioutil.WriteFile(path.Join(place, "library", "Sheer Things.mtl"), []byte(test_mtl), 0666)
+
+	rd, err := readOBJ(strings.NewReader(`mtllib Sheer Things.mtl
+v 0 0 0
+v 1 0 0
+v 1 1 0
+vt 0 0
+usemtl red
+f 1 2 3
+usemtl Sheer Wood
+f 1/1 2/1 3/1
+usemtl gold
+f 3 2 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := Resolver{}
+	files.Scan(place)
+	err = rd.LoadMaterials(path.Join(place, "elsewhere"), files)
+	if err == nil || !strings.Contains(err.Error(), "gold") {
+		t.Errorf("Gold should be missing, got %v", err)
+	}
+	if !missing(err) || !strings.Contains(err.Error(), "Wood Bump.tga") {
+		t.Errorf("The bump map is not uploaded yet, got %v", err)
+	}
+	if len(rd.Materials) != 2 {
+		t.Fatalf("Expected red and wood, got %#v", rd.Materials)
+	}
+	if wood := rd.Materials["Sheer Wood"]; wood.Name != "Sheer Things.mtl/Sheer Wood" ||
+		wood.KdFile != path.Join(place, "library", "texture", "Vatrushka-01.tga") || wood.BumpFile != "" {
+		t.Errorf("Wood is %#v", wood)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := rd.Scenify(buf); err != nil {
+		t.Fatal(err)
+	}
+	scene := buf.String()
+	for _, expect := range []string{
+		`MakeNamedMaterial "Sheer Things.mtl/red"`,
+		`"color Kd" [ 1  0  0 ]`,
+		`"string type" ["glossy"]`,
+		`Texture "Sheer Things.mtl/Sheer Wood_image" "color" "imagemap"`,
+		`"texture tex1" ["Sheer Things.mtl/Sheer Wood_image"]`,
+		`"string namedmaterial2" ["Sheer Things.mtl/Sheer Wood_opaque"]`,
+		"\nNamedMaterial \"Sheer Things.mtl/red\"",
+		"\nNamedMaterial \"Sheer Things.mtl/Sheer Wood\"",
+	} {
+		if !strings.Contains(scene, expect) {
+			t.Errorf("Expected %s in:\n%s", expect, scene)
+		}
+	}
+	if strings.Count(scene, "\nNamedMaterial \"") != 2 || strings.Count(scene, "Shape \"mesh\"") != 3 {
+		t.Errorf("Gold should be drawn plain:\n%s", scene)
+	}
+
+	draft, err := NewDraftScene(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(draft.Triangles) != 3 || draft.Triangles[0].Albedo != (draft_vec{1, 0, 0}) ||
+		draft.Triangles[1].Texture == nil || draft.Triangles[2].Albedo != DraftAlbedo {
+		t.Errorf("Draft should be red, wood and plain: %#v", draft.Triangles)
+	}
+}
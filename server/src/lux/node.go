@@ -0,0 +1,141 @@
+package lux
+
+import (
+	"cloud"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// RenderNode renders jobs of a remote server in a local work folder.
+type RenderNode struct {
+	Client *cloud.NodeClient
+	Pool   RenderPool
+	Work   string // Local folder for jobs being rendered.
+}
+
+// node_reporter keeps the job records on the server.
+type node_reporter struct {
+	client  *cloud.NodeClient
+	job     *cloud.Job
+	picture string
+	log     string
+}
+
+func (a node_reporter) Beat(progress cloud.JobProgress) (bool, error) {
+	return a.client.Heartbeat(a.job.ID, progress)
+}
+
+func (a node_reporter) Live(data []byte) error {
+	return a.client.Upload(a.job.ID, "live", data)
+}
+
+// Done sends back whatever was produced, even when the render failed or was cancelled.
+func (a node_reporter) Done(report cloud.JobReport) error {
+	if data, err := ioutil.ReadFile(a.picture); err == nil {
+		if err := a.client.Upload(a.job.ID, "image", data); err != nil {
+			log.Print("Unable to upload the image: " + err.Error())
+		}
+	}
+	if alongside := cloud.PNGOf(a.picture); alongside != a.picture {
+		if data, err := ioutil.ReadFile(alongside); err == nil {
+			if err := a.client.Upload(a.job.ID, "png", data); err != nil {
+				log.Print("Unable to upload the png: " + err.Error())
+			}
+		}
+	}
+	if data, err := ioutil.ReadFile(a.log); err == nil {
+		if err := a.client.Upload(a.job.ID, "log", data); err != nil {
+			log.Print("Unable to upload the log: " + err.Error())
+		}
+	}
+	return a.client.Finish(a.job.ID, report)
+}
+
+// fetch downloads the files of a job into its own work folder.
+func (a *RenderNode) fetch(job *cloud.Job, files []string) (string, error) {
+	place := path.Join(a.Work, string(job.ID))
+	for _, user_path := range files {
+		if strings.Contains(user_path, "..") {
+			return place, RenderError{"Illegal file name: " + user_path, nil}
+		}
+		data, err := a.Client.Fetch(job.ID, user_path)
+		if err != nil {
+			return place, err
+		}
+		local := path.Join(place, user_path)
+		if err := os.MkdirAll(path.Dir(local), 0777); err != nil {
+			return place, err
+		}
+		if err := ioutil.WriteFile(local, data, 0666); err != nil {
+			return place, err
+		}
+	}
+	return place, nil
+}
+
+// render fetches, renders and reports a job leased for the slot, then cleans up after it.
+func (a *RenderNode) render(job *cloud.Job, files []string, slot int) {
+	started := time.Now()
+	place, err := a.fetch(job, files)
+	defer os.RemoveAll(place)
+
+	reporter := node_reporter{a.Client, job, path.Join(place, job.Output), path.Join(place, job.Log)}
+	if err != nil {
+		log.Printf("Slot %d: unable to fetch job %s: %s", slot, job.ID, err.Error())
+		// The server or the network may be back soon.
+		reporter.Done(cloud.JobReport{State: cloud.JobFailed, Error: "Unable to fetch the scene: " + err.Error(), Transient: true})
+		return
+	}
+
+	local := Resolver{}
+	local.Scan(place)
+	err = render_job(path.Join(place, job.Scene), reporter.picture, reporter.log, local, JobControl(job, a.Pool.Threads), reporter)
+	if err != nil {
+		log.Printf("Slot %d: job %s ended after %v: %s", slot, job.ID, time.Since(started), err.Error())
+	} else {
+		log.Printf("Slot %d: job %s ended after %v", slot, job.ID, time.Since(started))
+	}
+}
+
+// Run registers the node and renders leased jobs, up to Pool.Slots at once.
+// It only returns when the node can not start.
+func (a *RenderNode) Run() error {
+	if a.Pool.Slots < 1 {
+		a.Pool.Slots = 1
+	}
+	if err := os.MkdirAll(a.Work, 0777); err != nil {
+		return err
+	}
+	if err := a.Client.Register(a.Pool.Slots); err != nil {
+		return err
+	}
+	log.Printf("Node %s rendering for %s with %d slots", a.Client.Name, a.Client.Server, a.Pool.Slots)
+
+	free := make(chan int, a.Pool.Slots)
+	for slot := 1; slot <= a.Pool.Slots; slot++ {
+		free <- slot
+	}
+
+	for {
+		slot := <-free
+		job, files, err := a.Client.Lease(slot)
+		if err != nil {
+			log.Print("Unable to lease a job: " + err.Error())
+		}
+		if job == nil {
+			free <- slot
+			time.Sleep(ScanPause)
+			continue
+		}
+
+		log.Printf("Slot %d: starting job %s of %s: %s", slot, job.ID, job.Owner, job.Scene)
+		go func() {
+			a.render(job, files, slot)
+			free <- slot
+		}()
+	}
+}
@@ -0,0 +1,79 @@
+package lux
+
+import (
+	"cloud"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRenderNodes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a shell")
+	}
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_nodes%d", time.Now().UnixNano()))
+	defer fake_renderer(path.Join(place, "bin"), "echo \"[Lux 2013-Nov-24 18:10:14 INFO : 0] 1s [1 threads]: 2.00 S/p  8.00k S/s\"\nsleep 1\necho image > \"$3.png\"\n")()
+
+	pause, poll := ScanPause, JobPoll
+	ScanPause, JobPoll = 100*time.Millisecond, 200*time.Millisecond
+	defer func() { ScanPause, JobPoll = pause, poll }()
+
+	// The server side; the cloud package tests keep port 8080.
+	cfg := cloud.OpenConfig(path.Join(place, "store"))
+	cfg.AddMember(cloud.Member{FullName: "Tester", Login: "tester", Password: "pw"})
+	go cloud.ServeWith(cloud.ServeOptions{Port: "8082", Static: "."})
+	time.Sleep(100 * time.Millisecond)
+
+	osgt, err := ioutil.ReadFile("../../../render/reference/KdlProject_design_1.osgt")
+	if err != nil {
+		t.Skip("Reference scene is not available: " + err.Error())
+	}
+	ids := []cloud.JobID{}
+	for i := 0; i < 3; i++ {
+		scene := fmt.Sprintf("p%d/scene.osgt", i)
+		os.MkdirAll(path.Dir(cfg.GetOsPath("tester", scene)), 0777)
+		ioutil.WriteFile(cfg.GetOsPath("tester", scene), osgt, 0666)
+		job, err := cfg.Jobs().Submit("tester", scene)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, job.ID)
+	}
+
+	// Nodes would be separate processes on other machines.
+	for _, name := range []string{"n1", "n2"} {
+		node, err := cfg.Nodes().Add(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		client, _ := cloud.NewNodeClient("http://localhost:8082", name, node.Token, "")
+		go (&RenderNode{client, RenderPool{1, 1}, path.Join(place, name)}).Run()
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for _, id := range ids {
+		for {
+			job, _ := cfg.Jobs().Get(id)
+			if job.State.Final() {
+				if job.State != cloud.JobSucceeded || job.Progress.Percent != 100 || job.Progress.SamplesPerPixel != 2 {
+					t.Errorf("Unexpected outcome: %#v", job)
+				}
+				if data, err := ioutil.ReadFile(cfg.GetOsPath("tester", job.Output)); err != nil || string(data) != "image\n" {
+					t.Errorf("Image should be uploaded: %s %v", data, err)
+				}
+				if _, err := os.Stat(cfg.GetOsPath("tester", job.Log)); err != nil {
+					t.Error("Log should be uploaded")
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Job is not done in time: %#v", job)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package lux
+
+/*
+
+  Geometry of OSGT scenes.
+
+  The designer's geodes hold drawables. An osg::Geometry has arrays of vertices,
+  normals and texture coordinates, and primitive sets that tell how the vertices
+  make triangles, strips, fans, quads or polygons. Each geometry is made into a
+  mesh; points and lines have no surface and are left out. Meshes stay under the
+  matrix and position-attitude transforms of the graph, so that what the designer
+  placed in a group is drawn where it was put.
+
+*/
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+// osgt_arrays are the arrays of a file by ArrayID; an array used again is only referred to.
+type osgt_arrays map[int][][]float64
+
+// array reads "Array TRUE ArrayID 1 Vec3fArray 4 { rows }", or "Array TRUE ArrayID 1" for one
+// given before. "Array FALSE" gives no rows.
+func (arrays osgt_arrays) array(entry OSGTEntry) ([][]float64, error) {
+	v := entry.Values
+	if len(v) < 2 || v[1].Text != "TRUE" {
+		return nil, nil
+	}
+	id := -1
+	if len(v) >= 4 && v[2].Text == "ArrayID" && v[3].Kind == OSGTNumber {
+		id = int(v[3].Number)
+	}
+	if entry.Child == nil {
+		rows, ok := arrays[id]
+		if !ok {
+			return nil, OSGTError{entry.Line, fmt.Sprintf("array %d was not given before", id)}
+		}
+		return rows, nil
+	}
+	rows, err := entry.Child.Rows()
+	if err != nil {
+		return nil, err
+	}
+	if id >= 0 {
+		arrays[id] = rows
+	}
+	return rows, nil
+}
+
+// attribute reads an array property of a geometry, such as VertexData, with its binding.
+// Indexed arrays are resolved into a row for each index.
+func (arrays osgt_arrays) attribute(block *OSGT) ([][]float64, string, error) {
+	rows, binding := [][]float64(nil), "BIND_PER_VERTEX"
+	if entry, ok := block.Entry("Array"); ok {
+		var err error
+		if rows, err = arrays.array(entry); err != nil {
+			return nil, "", err
+		}
+	}
+	if entry, ok := block.Entry("Indices"); ok {
+		indices, err := arrays.array(entry)
+		if err != nil {
+			return nil, "", err
+		}
+		if indices != nil {
+			resolved := [][]float64{}
+			for _, index := range osgt_flat(indices) {
+				if index < 0 || index >= len(rows) {
+					return nil, "", OSGTError{entry.Line, fmt.Sprintf("index %d of %d rows", index, len(rows))}
+				}
+				resolved = append(resolved, rows[index])
+			}
+			rows = resolved
+		}
+	}
+	if entry, ok := block.Entry("Binding"); ok && len(entry.Values) > 1 {
+		binding = entry.Values[1].Text
+	}
+	return rows, binding, nil
+}
+
+// osgt_flat gives the numbers of an array that has several on a row, such as indices.
+func osgt_flat(rows [][]float64) []int {
+	out := []int{}
+	for _, row := range rows {
+		for _, n := range row {
+			out = append(out, int(n))
+		}
+	}
+	return out
+}
+
+// osgt_triangles gives the corners of the triangles a primitive of the mode makes,
+// keeping the winding of strips. It tells if the mode is known.
+func osgt_triangles(mode string, v []int) ([]int, bool) {
+	out := []int{}
+	switch mode {
+	case "GL_POINTS", "GL_LINES", "GL_LINE_STRIP", "GL_LINE_LOOP":
+	case "GL_TRIANGLES":
+		out = append(out, v[:len(v)/3*3]...)
+	case "GL_TRIANGLE_STRIP":
+		for i := 0; i+2 < len(v); i++ {
+			if i%2 == 0 {
+				out = append(out, v[i], v[i+1], v[i+2])
+			} else {
+				out = append(out, v[i+1], v[i], v[i+2])
+			}
+		}
+	case "GL_TRIANGLE_FAN", "GL_POLYGON":
+		for i := 1; i+1 < len(v); i++ {
+			out = append(out, v[0], v[i], v[i+1])
+		}
+	case "GL_QUADS":
+		for i := 0; i+3 < len(v); i += 4 {
+			out = append(out, v[i], v[i+1], v[i+2], v[i], v[i+2], v[i+3])
+		}
+	case "GL_QUAD_STRIP":
+		for i := 0; i+3 < len(v); i += 2 {
+			out = append(out, v[i], v[i+1], v[i+3], v[i], v[i+3], v[i+2])
+		}
+	default:
+		return nil, false
+	}
+	return out, true
+}
+
+// osgt_primitives gives the triangles of each primitive set of a geometry, by the vertices they use:
+// DrawArrays, DrawArrayLengths and DrawElementsUByte, UShort or UInt.
+func osgt_primitives(block *OSGT) ([][]int, error) {
+	entry, ok := block.Entry("PrimitiveSetList")
+	if !ok || entry.Child == nil {
+		return nil, nil
+	}
+	sets := [][]int{}
+	for _, set := range entry.Child.List {
+		v := set.Values
+		number := func(i int) (int, error) {
+			if i >= len(v) || v[i].Kind != OSGTNumber || v[i].Number < 0 {
+				return 0, OSGTError{set.Line, set.Name() + " is short of numbers"}
+			}
+			return int(v[i].Number), nil
+		}
+		elements := func() ([]int, error) {
+			if set.Child == nil {
+				return nil, OSGTError{set.Line, set.Name() + " has no elements"}
+			}
+			rows, err := set.Child.Rows()
+			return osgt_flat(rows), err
+		}
+		if len(v) < 2 {
+			return nil, OSGTError{set.Line, "primitive set has no mode"}
+		}
+		mode, primitives := v[1].Text, [][]int{}
+		switch set.Name() { // Mode and instances, then what is drawn
+		case "DrawArrays", "DrawArrayLengths":
+			first, err := number(3)
+			if err != nil {
+				return nil, err
+			}
+			lengths := []int{}
+			if set.Name() == "DrawArrays" {
+				count, err := number(4)
+				if err != nil {
+					return nil, err
+				}
+				lengths = append(lengths, count)
+			} else if lengths, err = elements(); err != nil {
+				return nil, err
+			}
+			for _, length := range lengths {
+				primitive := make([]int, length)
+				for i := range primitive {
+					primitive[i] = first + i
+				}
+				primitives, first = append(primitives, primitive), first+length
+			}
+		case "DrawElementsUByte", "DrawElementsUShort", "DrawElementsUInt":
+			indices, err := elements()
+			if err != nil {
+				return nil, err
+			}
+			primitives = append(primitives, indices)
+		default:
+			return nil, OSGTError{set.Line, "unknown primitive set " + set.Name()}
+		}
+		triangles := []int{}
+		for _, primitive := range primitives {
+			more, known := osgt_triangles(mode, primitive)
+			if !known {
+				return nil, OSGTError{set.Line, "unknown mode " + mode}
+			}
+			triangles = append(triangles, more...)
+		}
+		sets = append(sets, triangles)
+	}
+	return sets, nil
+}
+
+// geometry makes a mesh of an osg::Geometry. Normals are kept when bound overall, per vertex
+// or per primitive set; corners are shared unless their normals differ. Texture coordinates
+// are of the first unit.
+func (arrays osgt_arrays) geometry(block *OSGT) (LUXTexturedMesh, error) {
+	lm := LUXTexturedMesh{"", [][3]float32{}, [][3]float32{}, [][2]float32{}, []int{}}
+	vector := func(row []float64) [3]float32 {
+		out := [3]float32{}
+		for i := 0; i < 3 && i < len(row); i++ {
+			if !math.IsNaN(row[i]) && !math.IsInf(row[i], 0) { // Zero otherwise
+				out[i] = float32(row[i])
+			}
+		}
+		return out
+	}
+	property := func(name string) ([][]float64, string, error) {
+		entry, ok := block.Entry(name)
+		if !ok || entry.Child == nil {
+			return nil, "BIND_OFF", nil
+		}
+		return arrays.attribute(entry.Child)
+	}
+
+	vertices, _, err := property("VertexData")
+	if err != nil {
+		return lm, err
+	}
+	if len(vertices) == 0 {
+		return lm, NewConvertError("Geometry has no vertices", nil)
+	}
+	normals, normal_binding, err := property("NormalData")
+	if err != nil {
+		return lm, err
+	}
+	uv := [][]float64(nil)
+	if entry, ok := block.Entry("TexCoordData"); ok && entry.Child != nil {
+		if unit, ok := entry.Child.Entry("Data"); ok && unit.Child != nil {
+			if uv, _, err = arrays.attribute(unit.Child); err != nil {
+				return lm, err
+			}
+		}
+	}
+	if uv != nil && len(uv) != len(vertices) {
+		log.Printf("%d texture coordinates for %d vertices are left out", len(uv), len(vertices))
+		uv = nil
+	}
+	sets, err := osgt_primitives(block)
+	if err != nil {
+		return lm, err
+	}
+
+	old_2_new := map[[2]int]int{} // Vertex and normal
+	smooth := len(normals) > 0
+	for set, triangles := range sets {
+		for _, v := range triangles {
+			if v < 0 || v >= len(vertices) {
+				return lm, NewConvertError(fmt.Sprintf("Vertex %d of %d in a primitive set", v, len(vertices)), nil)
+			}
+			n := -1
+			switch normal_binding {
+			case "BIND_OVERALL":
+				n = 0
+			case "BIND_PER_VERTEX":
+				n = v
+			case "BIND_PER_PRIMITIVE_SET":
+				n = set
+			}
+			if n < 0 || n >= len(normals) {
+				smooth, n = false, -1
+			}
+			corner := [2]int{v, n}
+			if new_index, ok := old_2_new[corner]; ok {
+				lm.T = append(lm.T, new_index)
+				continue
+			}
+			old_2_new[corner] = len(lm.P)
+			lm.T = append(lm.T, len(lm.P))
+			lm.P = append(lm.P, vector(vertices[v]))
+			if n >= 0 {
+				lm.N = append(lm.N, vector(normals[n]))
+			}
+			if uv != nil {
+				t := vector(uv[v])
+				lm.UV = append(lm.UV, [2]float32{t[0], t[1]})
+			} else {
+				lm.UV = append(lm.UV, [2]float32{0, 0})
+			}
+		}
+	}
+	if !smooth { // LUX computes them
+		lm.N = [][3]float32{}
+	}
+	return lm, nil
+}
+
+// texture locates the image of a drawable, or else of its geode, through Files.
+func (cover LUXOSGTGeometry) texture(drawable, geode *OSGT) string {
+	material_image := "CairnSmith/Resources/WallTexture4.tga" // Default
+	places := drawable.Find("Image")
+	if state, ok := geode.Entry("StateSet"); ok && state.Child != nil {
+		places = append(places, state.Child.Find("Image")...)
+	}
+	for _, place := range places {
+		if file, ok := place.Entry("FileName"); ok {
+			if name, ok := file.Quoted(); ok {
+				material_image = name
+				break
+			}
+		}
+		log.Print("Unable to get texture name")
+	}
+
+	if nil != cover.Files {
+		lookup, err := cover.Files.Get(material_image)
+		if err == nil {
+			material_image = lookup
+		} else {
+			log.Printf("Unable to look up texture: %s [%s] ", material_image, err.Error())
+		}
+	}
+	return material_image
+}
+
+// Missing tells of the first image the scene names that Files does not know.
+func (cover LUXOSGTGeometry) Missing() error {
+	for _, place := range cover.Osgt.Find("Image") {
+		if file, ok := place.Entry("FileName"); ok {
+			if name, ok := file.Quoted(); ok {
+				if _, err := cover.Files.Get(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// geode makes a mesh of each geometry of a geode; other drawables, such as shapes, are left out.
+func (cover LUXOSGTGeometry) geode(geode *OSGT, arrays osgt_arrays) LUXSequence {
+	drawables, ok := geode.Entry("Drawables")
+	if !ok || drawables.Child == nil {
+		log.Print("Drawables not found in geode")
+		return nil
+	}
+	out := LUXSequence{}
+	for _, drawable := range drawables.Child.List {
+		if drawable.Name() != "osg::Geometry" || drawable.Child == nil {
+			log.Printf("%s at line %d is not drawn", drawable.Name(), drawable.Line)
+			continue
+		}
+		lm, err := arrays.geometry(drawable.Child)
+		if err != nil {
+			log.Printf("Geometry at line %d is not drawn: %v", drawable.Line, err)
+			continue
+		}
+		lm.Texture = cover.texture(drawable.Child, geode)
+		log.Print("Using material ", lm.Texture)
+		out = append(out, lm)
+	}
+	return out
+}
+
+// osgt_transform gives the transform of a node as ConcatTransform takes it, if it has one:
+// the Matrix of a MatrixTransform (draggers are ones too), or the Position, Attitude,
+// Scale and Pivot of a PositionAttitudeTransform. OSG matrices are written in that order.
+func osgt_transform(class string, node *OSGT) ([16]float32, bool, error) {
+	tr := [16]float32{}
+	if entry, ok := node.Entry("Matrix"); ok && entry.Child != nil {
+		rows, err := entry.Child.Rows()
+		if err != nil {
+			return tr, false, err
+		}
+		flat := []float64{}
+		for _, row := range rows {
+			flat = append(flat, row...)
+		}
+		if len(flat) != 16 {
+			return tr, false, OSGTError{entry.Line, "matrix is not 4 by 4"}
+		}
+		for i, n := range flat {
+			tr[i] = float32(n)
+		}
+		return tr, true, nil
+	}
+	if !strings.HasSuffix(class, "PositionAttitudeTransform") {
+		return tr, false, nil
+	}
+
+	position, attitude, scale, pivot := []float64{0, 0, 0}, []float64{0, 0, 0, 1}, []float64{1, 1, 1}, []float64{0, 0, 0}
+	for name, into := range map[string][]float64{"Position": position, "Attitude": attitude, "Scale": scale, "Pivot": pivot} {
+		entry, ok := node.Entry(name)
+		if !ok {
+			continue
+		}
+		v, ok := (OSGTEntry{Values: entry.Values[1:]}).Numbers()
+		if !ok || len(v) != len(into) {
+			return tr, false, OSGTError{entry.Line, fmt.Sprintf("%s takes %d numbers", name, len(into))}
+		}
+		copy(into, v)
+	}
+	x, y, z, w := attitude[0], attitude[1], attitude[2], attitude[3] // A quaternion
+	k := x*x + y*y + z*z + w*w
+	if k == 0 {
+		return tr, false, NewConvertError("Attitude is not a rotation", nil)
+	}
+	k = 2 / k
+	r := [3][3]float64{ // Rows, as OSG has them
+		{1 - k*(y*y+z*z), k * (x*y + w*z), k * (x*z - w*y)},
+		{k * (x*y - w*z), 1 - k*(x*x+z*z), k * (y*z + w*x)},
+		{k * (x*z + w*y), k * (y*z - w*x), 1 - k*(x*x+y*y)},
+	}
+	for j := 0; j < 3; j++ { // Away from the pivot, scaled, turned and put in position
+		t := position[j]
+		for i := 0; i < 3; i++ {
+			tr[i*4+j] = float32(scale[i] * r[i][j])
+			t -= pivot[i] * scale[i] * r[i][j]
+		}
+		tr[12+j] = float32(t)
+	}
+	tr[15] = 1
+	return tr, true, nil
+}
+
+// node gives what a node of the graph draws: the meshes of a geode, or what is under it,
+// within the transform of the node if it has one. Hidden nodes, of NodeMask 0, draw nothing.
+func (cover LUXOSGTGeometry) node(entry OSGTEntry, arrays osgt_arrays) LUXSequence {
+	if mask, ok := entry.Child.Entry("NodeMask"); ok {
+		if v, ok := (OSGTEntry{Values: mask.Values[1:]}).Numbers(); ok && len(v) == 1 && v[0] == 0 {
+			return nil
+		}
+	}
+	inner := LUXSequence{}
+	if strings.HasSuffix(entry.Name(), "Geode") {
+		inner = cover.geode(entry.Child, arrays)
+	} else {
+		inner = cover.walk(entry.Child, arrays)
+	}
+	if len(inner) == 0 {
+		return nil
+	}
+	tr, ok, err := osgt_transform(entry.Name(), entry.Child)
+	if err != nil {
+		log.Printf("Transform of %s at line %d is left out: %v", entry.Name(), entry.Line, err)
+	}
+	if !ok {
+		return inner
+	}
+	return LUXSequence{LUXDoTransform(tr, inner)}
+}
+
+// walk gives what the nodes of a block draw, as children or in other properties.
+func (cover LUXOSGTGeometry) walk(block *OSGT, arrays osgt_arrays) LUXSequence {
+	out := LUXSequence{}
+	for _, entry := range block.List {
+		if entry.Child == nil {
+			continue
+		}
+		if strings.Contains(entry.Name(), "::") { // A class
+			out = append(out, cover.node(entry, arrays)...)
+		} else {
+			out = append(out, cover.walk(entry.Child, arrays)...)
+		}
+	}
+	return out
+}
+
+// osgt_meshes gives the meshes of a graph, without their transforms.
+func osgt_meshes(s LUXScener) []LUXTexturedMesh {
+	switch s := s.(type) {
+	case LUXTexturedMesh:
+		return []LUXTexturedMesh{s}
+	case LUXWrap:
+		return osgt_meshes(s.Inner)
+	case LUXSequence:
+		out := []LUXTexturedMesh{}
+		for _, item := range s {
+			out = append(out, osgt_meshes(item)...)
+		}
+		return out
+	}
+	return nil
+}
+
+// Graph gives the meshes of the geometries, with the texture images located by Files,
+// within the transforms of the nodes above them.
+func (cover LUXOSGTGeometry) Graph() LUXSequence {
+	graph := cover.walk(&cover.Osgt, osgt_arrays{})
+	if len(graph) == 0 {
+		log.Print("There supposed to be geodes in the scene")
+	}
+	return graph
+}
+
+// Meshes gives the meshes of the geometries, in the coordinates of their geodes.
+func (cover LUXOSGTGeometry) Meshes() []LUXTexturedMesh {
+	return osgt_meshes(cover.Graph())
+}
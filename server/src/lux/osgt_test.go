@@ -0,0 +1,269 @@
+package lux
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+)
+
+// test_geode has a strip and quads with a fan, normals bound three ways, a shared array and a shape.
+const test_geode = `osg::Geode {
+  Drawables 3 {
+    osg::Geometry {
+      PrimitiveSetList 1 {
+        DrawElementsUByte GL_TRIANGLE_STRIP 0 4 {
+          0 1 2 3
+        }
+      }
+      VertexData {
+        Array TRUE ArrayID 1 Vec3fArray 4 {
+          0 0 0
+          1 0 0
+          0 1 0
+          1 1 0
+        }
+        Indices FALSE
+        Binding BIND_PER_VERTEX
+      }
+      NormalData {
+        Array TRUE ArrayID 2 Vec3fArray 1 {
+          0 0 1
+        }
+        Binding BIND_OVERALL
+      }
+      TexCoordData 1 {
+        Data {
+          Array TRUE ArrayID 3 Vec2fArray 4 {
+            0 0
+            1 0
+            0 1
+            -1.#QNAN -1.#QNAN
+          }
+          Binding BIND_PER_VERTEX
+        }
+      }
+    }
+    osg::Geometry {
+      PrimitiveSetList 3 {
+        DrawArrays GL_QUADS 0 0 4
+        DrawArrayLengths GL_TRIANGLE_FAN 0 0 2 {
+          1 3
+        }
+        DrawArrays GL_LINES 0 0 2
+      }
+      VertexData {
+        Array TRUE ArrayID 1
+        Binding BIND_PER_VERTEX
+      }
+      NormalData {
+        Array TRUE ArrayID 4 Vec3fArray 3 {
+          0 0 1
+          0 0 -1
+          1 0 0
+        }
+        Binding BIND_PER_PRIMITIVE_SET
+      }
+    }
+    osg::ShapeDrawable {
+      Shape TRUE {
+        osg::Box {
+        }
+      }
+    }
+  }
+}
+`
+
+func TestOSGTGeometry(t *testing.T) {
+	rd, err := readOSGT(strings.NewReader(test_geode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meshes := LUXOSGTGeometry{*rd, nil}.Meshes()
+	if len(meshes) != 2 {
+		t.Fatalf("Expected two geometries, got %#v", meshes)
+	}
+
+	strip := meshes[0]
+	if len(strip.P) != 4 || len(strip.N) != 4 || len(strip.UV) != 4 {
+		t.Errorf("Strip should share its corners: %#v", strip)
+	}
+	if got := fmt.Sprint(strip.T); got != "[0 1 2 2 1 3]" {
+		t.Errorf("Strip should keep its winding, got %s", got)
+	}
+	if strip.UV[3] != [2]float32{0, 0} || strip.N[2] != [3]float32{0, 0, 1} {
+		t.Errorf("Strip has %v and %v", strip.UV, strip.N)
+	}
+
+	quads := meshes[1] // Two triangles of the quad, one of the fans; lines have no surface
+	if len(quads.T) != 9 || len(quads.N) != len(quads.P) {
+		t.Fatalf("Quads are %#v", quads)
+	}
+	if len(quads.P) != 7 || quads.N[0] != [3]float32{0, 0, 1} || quads.N[len(quads.N)-1] != [3]float32{0, 0, -1} {
+		t.Errorf("Each set should have its own corners: %#v", quads)
+	}
+	if quads.Texture != strip.Texture || quads.UV[0] != [2]float32{0, 0} {
+		t.Errorf("Without images, the default one is used: %#v", quads)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := (LUXOSGTGeometry{*rd, nil}).Scenify(buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), `"normal N"`); n != 2 {
+		t.Errorf("Expected normals for both meshes:\n%s", buf.String())
+	}
+
+	for text, drawn := range map[string]int{
+		strings.Replace(test_geode, "DrawArrays GL_QUADS 0 0 4", "DrawArrays GL_QUADS 0 0 8", 1):             1,
+		strings.Replace(test_geode, "GL_TRIANGLE_STRIP", "GL_WIGGLE", 1):                                     1,
+		strings.Replace(test_geode, "Array TRUE ArrayID 1 Vec3fArray", "Array TRUE ArrayID 5 Vec3fArray", 1): 1,
+	} {
+		rd, err := readOSGT(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len((LUXOSGTGeometry{*rd, nil}).Meshes()); n != drawn {
+			t.Errorf("Expected %d geometries drawn, got %d", drawn, n)
+		}
+	}
+}
+
+// TestOSGTReferenceGeometry draws the walls and floors of the designer files.
+func TestOSGTReferenceGeometry(t *testing.T) {
+	for name, triangles := range map[string]int{"KdlProject_design_1.osgt": 37, "testProj_design_1.osgt": 54} {
+		rd, err := ReadFileOSGT(path.Join(STORE_PLACE, "reference", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, mesh := range (LUXOSGTGeometry{*rd, nil}).Meshes() {
+			n += len(mesh.T) / 3
+			if len(mesh.N) != len(mesh.P) {
+				t.Errorf("%s should have normals: %#v", name, mesh)
+			}
+		}
+		if n != triangles {
+			t.Errorf("%s has %d triangles instead of %d", name, n, triangles)
+		}
+	}
+}
+
+// test_graph puts a triangle under a matrix and a position-attitude transform,
+// next to a hidden one and one at the root.
+const test_graph = `osg::Group {
+  Children 3 {
+    osg::MatrixTransform {
+      Children 1 {
+        osg::PositionAttitudeTransform {
+          Children 1 {
+            %[1]s
+          }
+          Position 0 0 5
+          Attitude 0 0 0.707107 0.707107
+          Scale 2 2 2
+        }
+      }
+      Matrix {
+        1 0 0 0
+        0 1 0 0
+        0 0 1 0
+        10 0 0 1
+      }
+    }
+    osg::MatrixTransform {
+      NodeMask 0
+      Children 1 {
+        %[1]s
+      }
+      Matrix {
+        1 0 0 0
+      }
+    }
+    %[1]s
+  }
+}
+`
+
+const test_triangle = `osg::Geode {
+  Drawables 1 {
+    osg::Geometry {
+      PrimitiveSetList 1 {
+        DrawArrays GL_TRIANGLES 0 0 3
+      }
+      VertexData {
+        Array TRUE Vec3fArray 3 {
+          1 0 0
+          0 1 0
+          0 0 1
+        }
+      }
+    }
+  }
+}`
+
+func TestOSGTTransforms(t *testing.T) {
+	rd, err := readOSGT(strings.NewReader(fmt.Sprintf(test_graph, test_triangle)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	geometry := LUXOSGTGeometry{*rd, nil}
+	if n := len(geometry.Meshes()); n != 2 {
+		t.Errorf("Expected the hidden triangle to be left out, got %d", n)
+	}
+	buf := &bytes.Buffer{}
+	if err := geometry.Scenify(buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "ConcatTransform"); n != 2 || strings.Count(buf.String(), "TransformBegin") != 2 {
+		t.Errorf("Expected two nested transforms:\n%s", buf.String())
+	}
+
+	draft, err := NewDraftScene(geometry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(draft.Triangles) != 2 {
+		t.Fatalf("Expected two triangles, got %d", len(draft.Triangles))
+	}
+	near := func(a, b draft_vec) bool {
+		return a.minus(b).dot(a.minus(b)) < 1e-6
+	}
+	placed, plain := draft.Triangles[0], draft.Triangles[1]
+	// Scaled, turned a quarter about z, raised and moved along x
+	for i, expect := range []draft_vec{{10, 2, 5}, {8, 0, 5}, {10, 0, 7}} {
+		if !near(placed.V[i].P, expect) {
+			t.Errorf("Corner %d is at %v instead of %v", i, placed.V[i].P, expect)
+		}
+	}
+	if !near(plain.V[0].P, draft_vec{1, 0, 0}) {
+		t.Errorf("Triangle at the root should stay, got %v", plain.V[0].P)
+	}
+}
+
+func TestOSGTTransformPivot(t *testing.T) {
+	rd, err := readOSGT(strings.NewReader(`osg::PositionAttitudeTransform {
+  Position 1 2 3
+  Pivot 1 0 0
+  Scale 3 3 3
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, ok, err := osgt_transform("osg::PositionAttitudeTransform", rd.List[0].Child)
+	if !ok || err != nil {
+		t.Fatal(err)
+	}
+	if p := draft_identity.concat(tr).point(draft_vec{2, 0, 0}); p != (draft_vec{4, 2, 3}) {
+		t.Errorf("Pivot should be put at the position, got %v", p)
+	}
+	rd, err = readOSGT(strings.NewReader("osg::PositionAttitudeTransform {\n  Scale 1 1\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := osgt_transform("osg::PositionAttitudeTransform", rd.List[0].Child); ok || err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Scale of two numbers should fail at line 2, got %v", err)
+	}
+}
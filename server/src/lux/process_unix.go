@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package lux
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// own_group makes the renderer lead a process group of its own,
+// so it can be stopped together with whatever it spawns.
+func own_group(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// kill_tree stops the renderer and all its children.
+func kill_tree(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
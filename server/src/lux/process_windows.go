@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package lux
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// own_group is not needed on Windows; taskkill follows the tree by itself.
+func own_group(cmd *exec.Cmd) {
+}
+
+// kill_tree stops the renderer and all its children.
+func kill_tree(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
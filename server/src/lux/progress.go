@@ -0,0 +1,132 @@
+package lux
+
+import (
+	"bytes"
+	"cloud"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progress_messages limits errors and warnings kept, the first ones usually tell the cause.
+const progress_messages = 20
+
+var (
+	// [Lux 2013-Nov-24 18:10:14 INFO : 0] 10s [20.4% Complete]: 4 threads, 2.04 S/p  8.16k S/s ...
+	lux_line     = regexp.MustCompile(`^\[Lux [^\]]*?\b(DEBUG|INFO|WARNING|ERROR|SEVERE)\s*:\s*\d+\]\s*(.*)$`)
+	lux_elapsed  = regexp.MustCompile(`^(?:(\d+)h\s*)?(?:(\d+)m\s*)?(\d+)s\b`)
+	lux_spp      = regexp.MustCompile(`([\d.]+)\s*S/p\b`)
+	lux_complete = regexp.MustCompile(`([\d.]+)%\s*[Cc]omplete`)
+	lux_halt_spp = regexp.MustCompile(`"integer haltspp"\s*\[\s*(\d+)\s*\]`)
+)
+
+// HaltSamplesPerPixel reads the samples per pixel target of a scene file, 0 when there is none.
+func HaltSamplesPerPixel(scene string) int {
+	data, err := ioutil.ReadFile(scene)
+	if err != nil {
+		return 0
+	}
+	return HaltSamplesPerPixelOf(data)
+}
+
+// HaltSamplesPerPixelOf reads the samples per pixel target of the text of a scene, 0 when there is none.
+func HaltSamplesPerPixelOf(data []byte) int {
+	if found := lux_halt_spp.FindSubmatch(data); found != nil {
+		halt, _ := strconv.Atoi(string(found[1]))
+		return halt
+	}
+	return 0
+}
+
+// ProgressParser follows luxconsole output and keeps the progress it tells about.
+// It is an io.Writer, to be put next to the log of the render.
+type ProgressParser struct {
+	Progress cloud.JobProgress
+	Changed  func(cloud.JobProgress) // Called after each line that told something, may be nil.
+	pending  []byte
+}
+
+// NewProgressParser starts following a render towards halt_spp samples per pixel.
+func NewProgressParser(halt_spp int, changed func(cloud.JobProgress)) *ProgressParser {
+	return &ProgressParser{Progress: cloud.JobProgress{HaltSamplesPerPixel: halt_spp}, Changed: changed}
+}
+
+func (a *ProgressParser) Write(p []byte) (int, error) {
+	a.pending = append(a.pending, p...)
+	for {
+		end := bytes.IndexAny(a.pending, "\r\n")
+		if end < 0 {
+			break
+		}
+		a.line(string(a.pending[:end]))
+		a.pending = a.pending[end+1:]
+	}
+	return len(p), nil
+}
+
+// Flush parses the last line when the output did not end with a new line.
+func (a *ProgressParser) Flush() {
+	if len(a.pending) > 0 {
+		a.line(string(a.pending))
+		a.pending = nil
+	}
+}
+
+// line parses a single line of output.
+func (a *ProgressParser) line(text string) {
+	found := lux_line.FindStringSubmatch(strings.TrimSpace(text))
+	if found == nil {
+		return
+	}
+	level, message := found[1], found[2]
+	p := &a.Progress
+	changed := false
+
+	switch level {
+	case "ERROR", "SEVERE":
+		if len(p.Errors) < progress_messages {
+			p.Errors = append(p.Errors, message)
+			changed = true
+		}
+	case "WARNING":
+		if len(p.Warnings) < progress_messages {
+			p.Warnings = append(p.Warnings, message)
+			changed = true
+		}
+	}
+
+	if elapsed := lux_elapsed.FindStringSubmatch(message); elapsed != nil {
+		h, _ := strconv.Atoi("0" + elapsed[1])
+		m, _ := strconv.Atoi("0" + elapsed[2])
+		s, _ := strconv.Atoi(elapsed[3])
+		p.Elapsed = float64(h*3600 + m*60 + s)
+		changed = true
+	}
+	if spp := lux_spp.FindStringSubmatch(message); spp != nil {
+		p.SamplesPerPixel, _ = strconv.ParseFloat(spp[1], 64)
+		changed = true
+	}
+
+	switch complete := lux_complete.FindStringSubmatch(message); {
+	case p.HaltSamplesPerPixel > 0:
+		p.Percent = 100 * p.SamplesPerPixel / float64(p.HaltSamplesPerPixel)
+	case complete != nil:
+		p.Percent, _ = strconv.ParseFloat(complete[1], 64)
+	}
+	if p.Percent > 100 {
+		p.Percent = 100
+	}
+	p.ETA = 0
+	if p.Percent > 0 && p.Percent < 100 {
+		p.ETA = p.Elapsed * (100 - p.Percent) / p.Percent
+	}
+
+	if changed {
+		p.Updated = time.Now()
+		if a.Changed != nil {
+			a.Changed(a.Progress)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package lux
+
+import (
+	"cloud"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var lux_output = `Lux version 1.3.1 of Nov 24 2013 at 18:10:04
+[Lux 2013-Nov-24 18:10:04 INFO : 0] Loading scene file: 'scene.lsx'...
+[Lux 2013-Nov-24 18:10:05 WARNING : 40] Unknown parameter "float shininess"
+[Lux 2013-Nov-24 18:10:14 INFO : 0] 10s [4 threads]: 2.00 S/p  81.92k S/s
+[Lux 2013-Nov-24 18:10:15 ERROR : 15] Unable to read texture 'wood.png'
+[Lux 2013-Nov-24 18:11:14 INFO : 0] 1m 10s [4 threads]: 4.00 S/p  82.10k S/s`
+
+func TestProgressParser(t *testing.T) {
+	reports := []cloud.JobProgress{}
+	parser := NewProgressParser(8, func(p cloud.JobProgress) {
+		reports = append(reports, p)
+	})
+	// Output comes in chunks regardless of lines.
+	for _, chunk := range strings.SplitAfter(lux_output, "S/") {
+		fmt.Fprint(parser, chunk)
+	}
+	parser.Flush()
+
+	p := parser.Progress
+	switch {
+	case len(reports) != 4:
+		t.Errorf("Four lines tell something, got %d reports", len(reports))
+	case p.SamplesPerPixel != 4 || p.Percent != 50:
+		t.Errorf("Half way expected: %#v", p)
+	case p.Elapsed != 70 || p.ETA != 70:
+		t.Errorf("Unexpected timing: %#v", p)
+	case len(p.Errors) != 1 || !strings.Contains(p.Errors[0], "wood.png"):
+		t.Errorf("Unexpected errors: %v", p.Errors)
+	case len(p.Warnings) != 1:
+		t.Errorf("Unexpected warnings: %v", p.Warnings)
+	}
+}
+
+func TestProgressComplete(t *testing.T) {
+	parser := NewProgressParser(0, nil)
+	fmt.Fprintln(parser, "[Lux 2014-Feb-11 12:00:10 INFO : 0] 10s [20% Complete]: 4 threads, 2.04 S/p  8.16k S/s")
+	if p := parser.Progress; p.Percent != 20 || p.ETA != 40 {
+		t.Errorf("Renderer estimate should be used without a target: %#v", p)
+	}
+	if HaltSamplesPerPixel("nothing-here.lsx") != 0 {
+		t.Error("Missing scene has no target")
+	}
+}
@@ -7,15 +7,21 @@ Rendering conversion and control.
 package lux
 
 import (
+	"bytes"
+	"image/png"
 	"os/exec"
 	"log"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"path"
 	"time"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"sync"
+	"cloud"
 )
 
 // LUX is a name of LuxRender command line tool.
@@ -37,17 +43,93 @@ func (a RenderError) Error() string {
 	return a.Cause
 }
 
-// DoRender takes file names of scene itself, where to put the resulting png and where to dump stderr and stdout of the renderer.
-// It will not return until render is complete, so use go.
+// RenderCancelled is returned when a render was stopped on request.
+var RenderCancelled = RenderError{"Render cancelled", nil}
+
+// RenderControl lets the caller steer a render in progress.
+type RenderControl struct {
+	Cancel   <-chan bool             // Closing it kills the renderer with its children.
+	Progress func(cloud.JobProgress) // Called as the renderer reports progress.
+	Threads  int                     // CPU threads for the renderer, 0 lets it decide.
+	Timeout  time.Duration           // Wall-clock limit, 0 guesses it with DefaultTimeout, negative for none.
+	Settings cloud.RenderSettings    // Overrides of the scene, for renders of scene files.
+	Limits   cloud.RenderLimits      // What the settings of the scene may end up with.
+}
+
+// RenderRun is a render of a scene file, as a Renderer is asked for it.
+type RenderRun struct {
+	Scene      string       // LUX scene file.
+	OutputBase string       // Where the pictures go, without the extension.
+	Out        io.Writer    // Output of the renderer, in the form luxconsole writes it, progress is parsed from it.
+	Threads    int          // CPU threads, 0 lets the renderer decide.
+	Abort      <-chan error // Tells why to stop at once: RenderCancelled or RenderTimedOut.
+}
+
+// Renderer turns LUX scene files into pictures. Whatever the scene asks for,
+// a .png is written at the output base, updated now and then while rendering if it can.
+type Renderer interface {
+	// Name tells the renderer in logs and flags.
+	Name() string
+	// Check tells if the renderer is able to run here.
+	Check() error
+	// Render renders until the scene is done or aborted, the error then tells why.
+	// It returns the CPU time spent.
+	Render(run RenderRun) (time.Duration, error)
+}
+
+// Renderers known by name.
+var Renderers = map[string]Renderer{}
+
+// RegisterRenderer makes the renderer known by its name.
+func RegisterRenderer(r Renderer) {
+	Renderers[r.Name()] = r
+}
+
+// TheRenderer renders everything, luxconsole unless told otherwise.
+var TheRenderer Renderer = LuxConsole{}
+
+// UseRenderer picks TheRenderer by its name.
+func UseRenderer(name string) error {
+	r, ok := Renderers[name]
+	if !ok {
+		names := []string{}
+		for known := range Renderers {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return RenderError{fmt.Sprintf("Unknown renderer %s, expected one of %v", name, names), nil}
+	}
+	TheRenderer = r
+	return nil
+}
+
+// RenderStats tells how much a render has cost and how far it went.
+type RenderStats struct {
+	CPU, Wall time.Duration
+	Progress  cloud.JobProgress
+}
+
+// DoRender takes file names of scene itself, where to put the resulting image and where to dump stderr and stdout of the renderer.
+// The image is .png, .tga or .exr, as the scene asks; a .png next to it is written anyway.
+// TheRenderer does the work. It will not return until render is complete, so use go.
 func DoRender(scene, output_png, output_log  string) error {
+	_, err := DoRenderStats(scene, output_png, output_log, nil)
+	return err
+}
+
+// DoRenderStats is DoRender which also reports the time spent by the renderer.
+// ctl may be nil, which renders without a limit. Whatever was written before a cancel or a timeout is kept.
+func DoRenderStats(scene, output_png, output_log  string, ctl *RenderControl) (RenderStats, error) {
+	stats := RenderStats{}
 
 	// get_output_base checks that the location of the file is valid.
 	// if no explicit location given, CWD is added as per luxconsole requrements.
 	get_output_base := func() (string, error) {
 		result := ""
 		var err error
-		if !strings.HasSuffix(output_png, ".png") {
-			return "", RenderError{"Can only render into *.png files", nil}
+		format := strings.TrimPrefix(path.Ext(output_png), ".")
+		if !known_format(format) {
+			return "", RenderError{"Can only render into *.png, *.tga or *.exr files", nil}
 		}
 		if strings.ContainsAny(output_png, "/\\") { // Must be good full path
 			result = path.Dir(output_png)
@@ -58,50 +140,80 @@ func DoRender(scene, output_png, output_log  string) error {
 			}
 		}
 		result = path.Join(result, path.Base(output_png))
-		result = strings.TrimSuffix(result, ".png")
+		result = strings.TrimSuffix(result, "." + format)
 		return result, nil
 	}
 
-	path, err := exec.LookPath(LUX);
-	if err != nil {
-		return err
-	}
-
 	output_base, err := get_output_base()
 	if err != nil {
-		return err
+		return stats, err
 	}
 
-	cmd := exec.Command(path, scene, "-o", output_base, "-V")
-	log.Printf("Initiating: %s %s %s %s", path, scene, "-o", output_base)
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
 	f, err := os.OpenFile(output_log, os.O_CREATE | os.O_RDWR, 0666)
 	if err != nil {
-		return err
+		return stats, err
 	}
 	defer f.Close()
-	go io.Copy(f, stdout)
-	go io.Copy(f, stderr)
+	var cancel <-chan bool
+	var progress func(cloud.JobProgress)
+	var expired <-chan time.Time
+	run := RenderRun{Scene: scene, OutputBase: output_base}
+	if ctl != nil {
+		cancel, progress, run.Threads = ctl.Cancel, ctl.Progress, ctl.Threads
+		limit := ctl.Timeout
+		if limit == 0 {
+			limit = DefaultTimeout(scene)
+		}
+		if limit > 0 {
+			log.Printf("Render of %s is limited to %v", scene, limit)
+			timer := time.NewTimer(limit)
+			defer timer.Stop()
+			expired = timer.C
+		}
+	}
 
-	return cmd.Run()
+	parser := NewProgressParser(HaltSamplesPerPixel(scene), progress)
+	run.Out = io.MultiWriter(f, parser)
+
+	// The renderer is told once why to stop.
+	abort, finished := make(chan error, 1), make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-finished:
+		case <-cancel:
+			log.Printf("Cancelling render of %s", scene)
+			abort <- RenderCancelled
+		case <-expired:
+			log.Printf("Render of %s took too long", scene)
+			abort <- RenderTimedOut
+		}
+	}()
+	run.Abort = abort
+
+	started := time.Now()
+	stats.CPU, err = TheRenderer.Render(run)
+	stats.Wall = time.Since(started)
+	parser.Flush()
+	stats.Progress = parser.Progress
+	return stats, err
 }
 
 // DoRenderScene takes LUXScener, saves its output in a proper location, and renders
 // into requested .png with log going to status
 func DoRenderScene(s LUXScener, output, status string) error {
+	_, err := DoRenderSceneStats(s, output, status, nil)
+	return err
+}
+
+// DoRenderSceneStats is DoRenderScene which also reports the time spent by the renderer.
+func DoRenderSceneStats(s LUXScener, output, status string, ctl *RenderControl) (RenderStats, error) {
 	create_scene_file := func() (string, error) {
-		temp_scene := path.Join(os.TempDir(), fmt.Sprintf("scene%d.lsx", time.Now().Unix()))
-		f, err := os.Create(temp_scene)
+		f, err := ioutil.TempFile("", "scene*.lsx") // Unique, as renders run in parallel.
 		if err != nil {
 			return "", err
 		}
+		temp_scene := f.Name()
 		if err := s.Scenify(f); err != nil {
 			return "", err
 		}
@@ -112,22 +224,22 @@ func DoRenderScene(s LUXScener, output, status string) error {
 
 	scene, err := create_scene_file()
 	if err != nil {
-		return RenderError{"Error writing scene:", err}
+		return RenderStats{}, RenderError{"Error writing scene:", err}
 	}
 
 	info, err := os.Stat(scene)
 	if err != nil {
-		return RenderError{"Scene for rendering was not created:", err}
+		return RenderStats{}, RenderError{"Scene for rendering was not created:", err}
 	}
 
 	if info.Size() == 0 {
-		return RenderError{"Zero size scene is not expected", nil}
+		return RenderStats{}, RenderError{"Zero size scene is not expected", nil}
 	}
 
 	log.Printf("Generated: %s %s %s", scene, output, status)
-	err = DoRender(scene, output, status)
+	stats, err := DoRenderStats(scene, output, status, ctl)
 	if err != nil {
-		return err
+		return stats, err
 	}
 
 	/*
@@ -137,7 +249,7 @@ func DoRenderScene(s LUXScener, output, status string) error {
 	}
     */
 
-	return nil
+	return stats, nil
 }
 
 // CheckPod checks that POD format convertor is available.
@@ -150,14 +262,9 @@ func CheckPod() error {
 	return nil
 }
 
-// CheckLux checks that Lux render is available.
+// CheckLux checks that TheRenderer is available.
 func CheckLux() error {
-	path, err := exec.LookPath(LUX)
-	if err != nil {
-		return err
-	}
-	log.Printf("Found renderer at %s", path)
-	return nil
+	return TheRenderer.Check()
 }
 
 // Resolver scans a location for file list.
@@ -201,7 +308,29 @@ func (a Resolver) Get(some string) (string, error) {
 			return a[i], nil
 		}
 	}
-	return "", RenderError{"Unable to locate file [" + some + "] in the list", nil}
+	return "", MissingFile{some}
+}
+
+// MissingFile is what the resolver does not know; it may yet be uploaded.
+type MissingFile struct {
+	Name string
+}
+
+func (a MissingFile) Error() string {
+	return "Unable to locate file [" + a.Name + "] in the list"
+}
+
+// missing tells if err comes of a file the resolver does not know.
+func missing(err error) bool {
+	switch failure := err.(type) {
+	case MissingFile:
+		return true
+	case RenderError:
+		return missing(failure.CausedBy)
+	case ConvertError:
+		return missing(failure.CausedBy)
+	}
+	return false
 }
 
 // EndsWith lists files with the specified suffix.
@@ -261,63 +390,336 @@ func DoFindRender(a * Resolver, renderfunc func (string)) error {
 	return nil
 }
 
-// WatchAndRender looks for .xml.job and starts rendering for each.
-// .png anf .jobout are generated for image and job standard output/error respecively.
-func WatchAndRender(some_dir string) error {
-	log.Printf("Scanning %s", some_dir)
-	a := Resolver{}
+// known_format tells if luxconsole can write images of the format.
+func known_format(format string) bool {
+	for _, known := range cloud.Formats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// SceneFor reads a scene file into a LUXScener; files are used to locate everything it refers to.
+// The settings override what the scene says; it tells the settings the render ends up with.
+// Progress notes go to say.
+func SceneFor(scene_file string, files Resolver, settings cloud.RenderSettings, say func(string)) (LUXScener, cloud.RenderSettings, error) {
+	switch {
+	case strings.HasSuffix(scene_file, ".osgt"):
+		say("OSGT format; fixed camera")
+		osg, err := ReadFileOSGT(scene_file)
+		if err != nil {
+			return nil, cloud.RenderSettings{}, err
+		}
+		// If it is just .osgt, then we have to come up with camera information.
+		head, used := HeaderWith(LUXHeader{[9]float32{1220, 100, 1220, 0, 0, 0, -1, 0, 0}, 31.0, 0, 0, 20, LUXLens{}}, settings)
+		return LUXWorld{head, LUXSequence{LUXHeadLight, LUXOSGTGeometry{*osg, nil}}}, used, nil
+	case strings.HasSuffix(scene_file, ".xml"):
+		say("Full format; controlled camera")
+		cfg, err := ReadConfigurationFile(scene_file)
+		if err != nil {
+			return nil, cloud.RenderSettings{}, err
+		}
+		scene := LUXSceneFull{files, *cfg, settings}
+		_, used := scene.Header()
+		return scene, used, nil
+	}
+	return nil, cloud.RenderSettings{}, RenderError{"Unknown scene format for [" + scene_file + "]", nil}
+}
+
+// JobPoll is how often a running job reports progress and learns it is cancelled.
+var JobPoll = 2 * time.Second
+
+// LiveInterval is how often, at most, the image of a running job is published.
+var LiveInterval = 10 * time.Second
+
+// JobReporter carries the state of a job between its render and the job records,
+// which are either in the store or on a remote server.
+type JobReporter interface {
+	// Beat keeps the lease with the progress so far and tells if the job is to be cancelled.
+	Beat(progress cloud.JobProgress) (cancelled bool, err error)
+	// Live publishes the intermediate image, a complete PNG, so far.
+	Live(data []byte) error
+	// Done records how the attempt ended.
+	Done(report cloud.JobReport) error
+}
 
+// store_reporter keeps the job records of the store itself.
+type store_reporter struct {
+	jobs   *cloud.JobStore
+	id     cloud.JobID
+	worker string
+}
 
-	// Now simple forward, should include job control as well
-	render := func(a LUXScener, where, log string) {
-		DoRenderScene(a, where, log)
+func (a store_reporter) Beat(progress cloud.JobProgress) (bool, error) {
+	job, err := a.jobs.Beat(a.id, a.worker, progress)
+	if err != nil {
+		return false, err
 	}
+	return job.CancelRequested, nil
+}
 
-	for {
-		a.Scan(some_dir)
-		DoFindRender(&a, func(scene_file string) {
-				scene_log := scene_file + ".jobout"
-				scene_picture := scene_file + ".png"
-				var scene LUXScener
-				say := func(what string) {
-					f, err := os.OpenFile(scene_log, os.O_APPEND | os.O_WRONLY, 0666)
-					if err != nil {
-						f, err = os.Create(scene_log)
-						log.Printf("Creating log: [%s] [%s]", what, scene_log)
-						if err != nil {
-							log.Print("Failed to create log:" + err.Error())
-						}
-					}
-					defer f.Close()
-					fmt.Fprintf(f, "[%s]\n", what)
+func (a store_reporter) Live(data []byte) error {
+	job, err := a.jobs.Get(a.id)
+	if err != nil {
+		return err
+	}
+	place := a.jobs.OsPath(job, job.Live)
+	temp := place + ".tmp" // Readers must never see it half-written.
+	if err := ioutil.WriteFile(temp, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(temp, place)
+}
+
+func (a store_reporter) Done(report cloud.JobReport) error {
+	_, err := a.jobs.Complete(a.id, a.worker, report)
+	return err
+}
+
+// RenderJob renders the scene of a job claimed by the worker and records the outcome.
+// The lease of the job is kept alive while the renderer runs,
+// and the renderer is stopped once the job is cancelled or runs past its time limit.
+func RenderJob(cfg *cloud.CloudConfig, files Resolver, job *cloud.Job, worker string, threads int) error {
+	jobs := cfg.Jobs()
+	return render_job(jobs.OsPath(job, job.Scene), jobs.OsPath(job, job.Output), jobs.OsPath(job, job.Log),
+		files, JobControl(job, threads), store_reporter{jobs, job.ID, worker})
+}
+
+// JobControl tells how the renders of the job are steered; the time limit of the job, if any, wins over the guess.
+// Its overrides apply within the limits of its owner.
+func JobControl(job *cloud.Job, threads int) RenderControl {
+	return RenderControl{Threads: threads, Timeout: time.Duration(job.TimeLimit * float64(time.Second)),
+		Settings: job.Overrides, Limits: job.Limits}
+}
+
+// render_job renders a scene file into the picture, telling the reporter how it goes.
+// ctl gives the threads, the time limit and the settings, the rest of it is filled here.
+// Scenes that end up beyond the limits are not rendered.
+func render_job(scene_file, scene_picture, scene_log string, files Resolver, ctl RenderControl, reporter JobReporter) error {
+	say := func(what string) {
+		f, err := os.OpenFile(scene_log, os.O_APPEND | os.O_WRONLY, 0666)
+		if err != nil {
+			f, err = os.Create(scene_log)
+			log.Printf("Creating log: [%s] [%s]", what, scene_log)
+			if err != nil {
+				log.Print("Failed to create log:" + err.Error())
+				return
+			}
+		}
+		defer f.Close()
+		fmt.Fprintf(f, "[%s]\n", what)
+	}
+
+	var latest_lock sync.Mutex
+	latest := cloud.JobProgress{}
+	report := func(progress cloud.JobProgress) {
+		latest_lock.Lock()
+		defer latest_lock.Unlock()
+		latest = progress
+	}
+
+	// luxconsole rewrites the .png now and then while it renders.
+	live := cloud.PNGOf(scene_picture)
+	started, published := time.Now(), time.Time{}
+	publish := func() {
+		info, err := os.Stat(live)
+		if err != nil || !info.ModTime().After(started) || !info.ModTime().After(published) {
+			return
+		}
+		data, err := ioutil.ReadFile(live)
+		if err != nil {
+			return
+		}
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			return // Still being written, next time then.
+		}
+		if err := reporter.Live(data); err != nil {
+			log.Print("Unable to publish the live image: " + err.Error())
+			return
+		}
+		published = info.ModTime()
+	}
+
+	done, cancel, stopped := make(chan bool), make(chan bool), make(chan bool)
+	go func() {
+		defer close(stopped)
+		poll := time.NewTicker(JobPoll)
+		defer poll.Stop()
+		last_live := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-poll.C:
+				if time.Since(last_live) >= LiveInterval {
+					publish()
+					last_live = time.Now()
 				}
-				say("Picking " + scene_file)
-				switch {
-				case strings.HasSuffix(scene_file, ".osgt"):
-					say("OSGT format; fixed camera")
-					osg, err := ReadFileOSGT(scene_file)
-					if err != nil {
-						log.Printf("Failed to read scene [%s]", scene)
-						say(err.Error())
-						return
-					}
-					// If it is just .osgt, then we have to come up with camera information.
-					scene = LUXWorld{LUXHeader{[9]float32{1220, 100, 1220, 0, 0, 0, -1, 0, 0}, 31.0, 150, 150, 20},
-						LUXSequence{LUXHeadLight, LUXOSGTGeometry{*osg, nil}}}
-				case strings.HasSuffix(scene_file, ".xml"):
-					say("Full format; controlled camera")
-					cfg, err := ReadConfigurationFile(scene_file)
-					if err != nil {
-						log.Printf("Failed to read full scene [%s]", scene)
-						say(err.Error())
-						return
-					}
-					scene = LUXSceneFull{a, *cfg}
-				default:
-					log.Printf("Unknown scene format for [%s]", scene)
+				latest_lock.Lock()
+				progress := latest
+				latest_lock.Unlock()
+				cancelled, err := reporter.Beat(progress)
+				if err != nil {
+					log.Print(err.Error())
+				}
+				if cancelled {
+					close(cancel)
 					return
 				}
-				render(scene, scene_picture, scene_log)
-			})
+			}
+		}
+	}()
+
+	say("Picking " + scene_file)
+	stats := RenderStats{}
+	scene, used, err := SceneFor(scene_file, files, ctl.Settings, say)
+	if err == nil {
+		err = ctl.Limits.Check(used)
+	}
+	if err == nil {
+		say(fmt.Sprintf("Rendering %dx%d, %d samples per pixel, %s sampler, into %s", used.Width, used.Height, used.HaltSPP, used.Sampler, used.Format))
+		ctl.Cancel, ctl.Progress = cancel, report
+		if used.Draft {
+			stats, err = DoDraftScene(scene, scene_picture, scene_log, &ctl)
+		} else {
+			stats, err = DoRenderSceneStats(scene, scene_picture, scene_log, &ctl)
+		}
+	}
+	close(done)
+	<-stopped // Nothing is to be published after the outcome.
+
+	stats.Progress.Elapsed, stats.Progress.ETA, stats.Progress.Updated = stats.Wall.Seconds(), 0, time.Now()
+	outcome := cloud.JobReport{State: cloud.JobSucceeded, CPUSeconds: stats.CPU.Seconds()}
+	switch {
+	case err == RenderCancelled:
+		say("Cancelled; partial output is kept")
+		outcome.State, outcome.Error = cloud.JobCancelled, "Cancelled while rendering"
+	case err == RenderTimedOut:
+		say("Timed out; partial output is kept")
+		outcome.State, outcome.Error = cloud.JobFailed, fmt.Sprintf("Timed out after %v", stats.Wall.Round(time.Second))
+	case err != nil:
+		say(err.Error())
+		outcome.State, outcome.Error, outcome.Transient = cloud.JobFailed, err.Error(), Transient(err, stats.Progress)
+	default:
+		stats.Progress.Percent = 100
+	}
+	outcome.Progress, outcome.Settings = stats.Progress, used
+
+	if done_err := reporter.Done(outcome); done_err != nil {
+		return done_err
+	}
+	if err == RenderCancelled {
+		return nil
+	}
+	return err
+}
+
+// ScanWorker names the scanner of this host in job records.
+func ScanWorker() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return host + "/scan"
+}
+
+// RenderPool tells how much rendering scan mode runs at once.
+type RenderPool struct {
+	Slots   int // Renders at once.
+	Threads int // CPU threads per render, 0 lets the renderer decide.
+}
+
+// ScanPause is how long a render node waits when there is nothing to lease.
+var ScanPause = time.Second
+
+// WatchAndRender picks up queued jobs of the store and renders them one by one.
+func WatchAndRender(some_dir string) error {
+	return WatchAndRenderPool(some_dir, RenderPool{1, 0})
+}
+
+// job_files resolves against the files of a job, the same ones a node is sent.
+func job_files(jobs *cloud.JobStore, job *cloud.Job) Resolver {
+	files := Resolver{}
+	user_paths, err := jobs.Files(job)
+	if err != nil {
+		log.Print("Unable to list the files of job " + string(job.ID) + ": " + err.Error())
+	}
+	for _, user_path := range user_paths {
+		files = append(files, jobs.OsPath(job, user_path))
+	}
+	return files
+}
+
+// RescanInterval is how often the scanner walks the whole store, for .job markers made by hand
+// and for leases that have expired; queued jobs wake it up by themselves.
+var RescanInterval = time.Minute
+
+// WatchAndRenderPool picks up queued jobs of the store and renders up to pool.Slots of them at once.
+// It waits for jobs to be queued, either in this process or by the server in another one.
+// .job markers without a job, such as created by hand, are queued at start and on each rescan.
+// .png anf .jobout are generated for image and job standard output/error respecively.
+func WatchAndRenderPool(some_dir string, pool RenderPool) error {
+	if pool.Slots < 1 {
+		pool.Slots = 1
+	}
+	log.Printf("Scanning %s with %d slots", some_dir, pool.Slots)
+	cfg := cloud.OpenConfig(some_dir)
+	jobs := cfg.Jobs()
+	worker := ScanWorker()
+	watcher := jobs.Watcher()
+
+	// Whatever was running here before is not running any more.
+	jobs.Release(worker)
+
+	reported := map[string]bool{} // Markers that can not be adopted, told about once.
+	rescan := func() {
+		jobs.RequeueExpired()
+		all := Resolver{}
+		all.Scan(some_dir)
+		for _, marker := range all.EndsWith(cloud.JOB_SUFFIX) {
+			if _, err := jobs.AdoptMarker(marker); err != nil && !reported[marker] {
+				log.Print(err.Error())
+				reported[marker] = true
+			}
+		}
+	}
+
+	free := make(chan int, pool.Slots)
+	for slot := 1; slot <= pool.Slots; slot++ {
+		free <- slot
+	}
+
+	rescan()
+	rescanned := time.Now()
+	for {
+		if time.Since(rescanned) >= RescanInterval {
+			rescan()
+			rescanned = time.Now()
+		}
+
+		slot := <-free
+		slot_worker := cloud.SlotWorker(worker, slot)
+		job, err := jobs.Claim(slot_worker)
+		if err != nil {
+			log.Print("Unable to claim a job: " + err.Error())
+		}
+		if job == nil {
+			free <- slot
+			watcher.Wait(RescanInterval - time.Since(rescanned))
+			continue
+		}
+
+		log.Printf("Slot %d: starting job %s of %s: %s", slot, job.ID, job.Owner, job.Scene)
+		go func(job *cloud.Job) {
+			started := time.Now()
+			RenderJob(cfg, job_files(jobs, job), job, slot_worker, pool.Threads)
+			state := "lost"
+			if done, err := jobs.Get(job.ID); err == nil {
+				state = string(done.State)
+			}
+			log.Printf("Slot %d: job %s %s after %v", slot, job.ID, state, time.Since(started))
+			free <- slot
+		}(job)
 	}
 }
@@ -10,15 +10,24 @@ import (
 	"bytes"
 	"strings"
 	"path"
+	"runtime"
+	"time"
+	"fmt"
+	"cloud"
+	"image"
+	"image/png"
 )
 
 
+var STORE_PLACE = "../../../render"
+
+// Without luxconsole the renders are fake.
 func init() {
-	CLOUDDEBUG = true
+	if CheckLux() != nil {
+		TheRenderer = FakeRenderer{}
+	}
 }
 
-var STORE_PLACE = "C:/github/sheercloud/render"
-
 var scene = `
 # Taken from the documentation 1.0
 #This is an example of a comment!
@@ -124,6 +133,256 @@ func TestDoRender(t * testing.T) {
 	}
 }
 
+// fake_renderer puts a shell script in place of luxconsole; the result puts the renderer back.
+func fake_renderer(place, script string) func() {
+	os.MkdirAll(place, 0777)
+	renderer := path.Join(place, "fakelux")
+	ioutil.WriteFile(renderer, []byte("#!/bin/sh\n" + script), 0777)
+	lux, was := LUX, TheRenderer
+	LUX, TheRenderer = renderer, LuxConsole{}
+	return func() { LUX, TheRenderer = lux, was }
+}
+
+func TestFakeRenderer(t * testing.T) {
+	was := TheRenderer
+	defer func() { TheRenderer = was }()
+	if err := UseRenderer("nothing"); err == nil {
+		t.Error("Unknown renderers must be refused")
+	}
+	if err := UseRenderer("fake"); err != nil || CheckLux() != nil {
+		t.Fatal("Fake renderer is always there")
+	}
+
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_fake%d", time.Now().UnixNano()))
+	os.MkdirAll(place, 0777)
+	in := path.Join(place, "in.lsx")
+	ioutil.WriteFile(in, []byte(strings.Replace(scene, "PixelFilter", "\"bool write_tga\" [\"true\"]\nPixelFilter", 1)), 0666)
+
+	outputs := [][]byte{}
+	for _, out := range []string{"a", "b"} {
+		stats, err := DoRenderStats(in, path.Join(place, out + ".tga"), path.Join(place, out + ".log"), nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if stats.Progress.Percent != 100 || stats.Progress.SamplesPerPixel != 1 {
+			t.Errorf("Progress should be told as by luxconsole: %#v", stats.Progress)
+		}
+		for _, ext := range []string{".png", ".tga", ".log"} {
+			data, err := ioutil.ReadFile(path.Join(place, out + ext))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			outputs = append(outputs, data)
+		}
+	}
+	if !bytes.Equal(outputs[0], outputs[3]) || !bytes.Equal(outputs[1], outputs[4]) {
+		t.Error("Same scene should give the same picture")
+	}
+	if !bytes.Equal(bytes.Replace(outputs[2], []byte("/a."), []byte("/b."), -1), outputs[5]) {
+		t.Errorf("Same scene should give the same log:\n%s\n%s", outputs[2], outputs[5])
+	}
+	if img, err := png.Decode(bytes.NewReader(outputs[0])); err != nil || img.Bounds().Dx() != 100 || img.Bounds().Dy() != 100 {
+		t.Errorf("Picture should have the resolution of the film: %v", err)
+	}
+	if len(outputs[1]) != 18 + 100 * 100 * 3 {
+		t.Errorf("Unexpected TGA of %d bytes", len(outputs[1]))
+	}
+
+	TheRenderer = FakeRenderer{Delay: time.Minute}
+	cancel := make(chan bool)
+	close(cancel)
+	if _, err := DoRenderStats(in, path.Join(place, "c.png"), path.Join(place, "c.log"), &RenderControl{Cancel: cancel}); err != RenderCancelled {
+		t.Errorf("Fake render should be cancelled: %v", err)
+	}
+}
+
+func TestRenderCancel(t * testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a shell")
+	}
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_cancel%d", time.Now().UnixNano()))
+
+	// Writes a partial image, then waits on a child like luxconsole threads would.
+	defer fake_renderer(place, "echo partial > \"$3.png\"\necho started\nsleep 30 &\nwait\n")()
+
+	in, pix, luxlog := path.Join(place, "in.lsx"), path.Join(place, "out.png"), path.Join(place, "out.log")
+	ioutil.WriteFile(in, []byte(scene), 0666)
+
+	cancel := make(chan bool)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		close(cancel)
+	}()
+	started := time.Now()
+	_, err := DoRenderStats(in, pix, luxlog, &RenderControl{Cancel: cancel})
+	if err != RenderCancelled {
+		t.Errorf("Render should be cancelled, got %v", err)
+	}
+	if time.Since(started) > 10 * time.Second {
+		t.Error("Renderer was not stopped")
+	}
+	for _, f := range []string{pix, luxlog} {
+		check_file(t, f, true)
+	}
+}
+
+func TestRenderTimeout(t * testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a shell")
+	}
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_timeout%d", time.Now().UnixNano()))
+	defer fake_renderer(place, "echo partial > \"$3.png\"\nsleep 30 &\nwait\n")()
+
+	in, pix, luxlog := path.Join(place, "in.lsx"), path.Join(place, "out.png"), path.Join(place, "out.log")
+	ioutil.WriteFile(in, []byte(scene), 0666)
+
+	started := time.Now()
+	_, err := DoRenderStats(in, pix, luxlog, &RenderControl{Timeout: 500 * time.Millisecond})
+	if err != RenderTimedOut {
+		t.Errorf("Render should time out, got %v", err)
+	}
+	if time.Since(started) > 10 * time.Second {
+		t.Error("Renderer was not stopped")
+	}
+	check_file(t, pix, true)
+
+	// Killed by someone else, such as the out of memory killer.
+	fake_renderer(place, "kill -9 $$\n")
+	_, err = DoRenderStats(in, pix, luxlog, &RenderControl{Timeout: -1})
+	if err == nil || !Transient(err, cloud.JobProgress{}) {
+		t.Errorf("Killed renderer is worth another try: %v", err)
+	}
+	if Transient(RenderTimedOut, cloud.JobProgress{}) || Transient(RenderError{"Broken scene", nil}, cloud.JobProgress{}) {
+		t.Error("Only passing failures are transient")
+	}
+	if !Transient(RenderError{"Unable to resolve path:", MissingFile{"Chair.obj"}}, cloud.JobProgress{}) {
+		t.Error("Model that is not uploaded yet is worth another try")
+	}
+}
+
+func TestDefaultTimeout(t * testing.T) {
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_limit%d", time.Now().UnixNano()))
+	os.MkdirAll(place, 0777)
+	write := func(header string) string {
+		in := path.Join(place, "in.lsx")
+		ioutil.WriteFile(in, []byte(header), 0666)
+		return in
+	}
+
+	small := DefaultTimeout(write(scene))
+	large := DefaultTimeout(write(strings.Replace(scene, "[100]", "[2000]", -1)))
+	if small <= TimeoutBase || small >= large || large > TimeoutMax {
+		t.Errorf("Larger scenes need more time: %v %v", small, large)
+	}
+	if limit := DefaultTimeout(write(`Film "fleximage" "integer halttime" [60]`)); limit != TimeoutBase + time.Minute {
+		t.Errorf("Halt time should be respected: %v", limit)
+	}
+	if limit := DefaultTimeout(write(`Film "fleximage"`)); limit != TimeoutMax {
+		t.Errorf("Scenes that never halt get the most: %v", limit)
+	}
+}
+
+// live_reporter keeps what a render tells about its job.
+type live_reporter struct {
+	lives   [][]byte
+	outcome cloud.JobReport
+}
+
+func (a *live_reporter) Beat(progress cloud.JobProgress) (bool, error) { return false, nil }
+func (a *live_reporter) Live(data []byte) error { a.lives = append(a.lives, data); return nil }
+func (a *live_reporter) Done(report cloud.JobReport) error { a.outcome = report; return nil }
+
+func TestRenderLive(t * testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a shell")
+	}
+	osgt, err := ioutil.ReadFile("../../../render/reference/KdlProject_design_1.osgt")
+	if err != nil {
+		t.Skip("Reference scene is not available: " + err.Error())
+	}
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_live%d", time.Now().UnixNano()))
+	os.MkdirAll(place, 0777)
+	in := path.Join(place, "scene.osgt")
+	ioutil.WriteFile(in, osgt, 0666)
+
+	// The image is broken first, as if caught while being written.
+	picture := bytes.Buffer{}
+	png.Encode(&picture, image.NewGray(image.Rect(0, 0, 4, 4)))
+	ioutil.WriteFile(path.Join(place, "live.png"), picture.Bytes(), 0666)
+	defer fake_renderer(place, "echo broken > \"$3.png\"\nsleep 1\ncp " + path.Join(place, "live.png") + " \"$3.png\"\nsleep 1\n")()
+
+	poll, live := JobPoll, LiveInterval
+	JobPoll, LiveInterval = 100 * time.Millisecond, 300 * time.Millisecond
+	defer func() { JobPoll, LiveInterval = poll, live }()
+
+	reporter := &live_reporter{}
+	if err := render_job(in, in + ".png", in + ".log", Resolver{}, RenderControl{Timeout: -1}, reporter); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reporter.lives) != 1 || !bytes.Equal(reporter.lives[0], picture.Bytes()) {
+		t.Errorf("Only the complete image should be published, once: %d", len(reporter.lives))
+	}
+	if reporter.outcome.State != cloud.JobSucceeded {
+		t.Errorf("Unexpected outcome: %#v", reporter.outcome)
+	}
+}
+
+func TestRenderSettings(t * testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a shell")
+	}
+	osgt, err := ioutil.ReadFile("../../../render/reference/KdlProject_design_1.osgt")
+	if err != nil {
+		t.Skip("Reference scene is not available: " + err.Error())
+	}
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_settings%d", time.Now().UnixNano()))
+	os.MkdirAll(place, 0777)
+	in := path.Join(place, "scene.osgt")
+	ioutil.WriteFile(in, osgt, 0666)
+
+	// Keeps the scene it was given.
+	defer fake_renderer(place, "cp \"$1\" \"$3.lxs\"\necho exr > \"$3.exr\"\necho png > \"$3.png\"\n")()
+
+	settings := cloud.RenderSettings{Width: 320, Height: 240, Sampler: "erpt", Format: "exr"}
+	reporter := &live_reporter{}
+	err = render_job(in, in + ".exr", in + ".log", Resolver{}, RenderControl{Timeout: -1, Settings: settings, Limits: cloud.DefaultLimits}, reporter)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	used := reporter.outcome.Settings
+	if used.Width != 320 || used.Height != 240 || used.Sampler != "erpt" || used.HaltSPP != 20 {
+		t.Errorf("Used settings should be reported: %#v", used)
+	}
+	rendered, _ := ioutil.ReadFile(in + ".lxs")
+	for _, expected := range []string{`"integer xresolution" [320]`, `Sampler "erpt"`, `"bool write_exr" ["true"]`} {
+		if !strings.Contains(string(rendered), expected) {
+			t.Errorf("Scene should have %s: %s", expected, rendered)
+		}
+	}
+	if _, err := os.Stat(in + ".exr"); err != nil {
+		t.Error("Picture should be in the format asked: " + err.Error())
+	}
+
+	os.Remove(in + ".lxs")
+	reporter = &live_reporter{}
+	render_job(in, in + ".exr", in + ".log", Resolver{}, RenderControl{Timeout: -1, Settings: settings, Limits: cloud.RenderLimits{Width: 200}}, reporter)
+	if reporter.outcome.State != cloud.JobFailed || reporter.outcome.Transient || !strings.Contains(reporter.outcome.Error, "limit") {
+		t.Errorf("Settings beyond the limits must fail: %#v", reporter.outcome)
+	}
+	if _, err := os.Stat(in + ".lxs"); err == nil {
+		t.Error("Nothing should be rendered beyond the limits")
+	}
+
+	// The walls may be uploaded after the scene.
+	waiting := path.Join(place, "waiting.xml")
+	ioutil.WriteFile(waiting, []byte("<RenderingData><Scene>C:/Projects/walls.osgt</Scene></RenderingData>"), 0666)
+	reporter = &live_reporter{}
+	render_job(waiting, waiting + ".exr", waiting + ".log", Resolver{}, RenderControl{Timeout: -1, Settings: settings, Limits: cloud.DefaultLimits}, reporter)
+	if reporter.outcome.State != cloud.JobFailed || !reporter.outcome.Transient {
+		t.Errorf("Scene missing its files is worth another try: %#v", reporter.outcome)
+	}
+}
+
 func renderScene(t * testing.T, new_scene LUXScener, out string) {
 	pix, log := out + ".png", out + ".log"
 
@@ -160,7 +419,7 @@ func TestSceneCompound(t * testing.T) {
 	Shape "disk" "float radius" [20] "float height" [-1]
 AttributeEnd
 `)
-	scene := LUXWorld{LUXHeader{[9]float32{-100, 0, -100, 0, 0, 0, 0, 1, 0}, 31.0, 100, 100, 2}, LUXSequence{LUXHeadLight, body}}
+	scene := LUXWorld{LUXHeader{[9]float32{-100, 0, -100, 0, 0, 0, 0, 1, 0}, 31.0, 100, 100, 2, LUXLens{}}, LUXSequence{LUXHeadLight, body}}
 	b := &bytes.Buffer{}
 	scene.Scenify(b)
 	got := string(b.Bytes())
@@ -239,8 +498,8 @@ func TestObjLux(t * testing.T) {
 	an := OBJ{}
 	// Shoud be simpler?
 	an.Geodes = []OBJGeode{
-		OBJGeode{"a", []OBJFace{[]OBJFaceVertex{OBJFaceVertex{1, 1, 1}, OBJFaceVertex{2, 1, 2}, OBJFaceVertex{3, 1, 3}}}},
-		OBJGeode{"b", []OBJFace{[]OBJFaceVertex{OBJFaceVertex{1, 1, 1}, OBJFaceVertex{3, 1, 3}, OBJFaceVertex{4, 1, 4}}}}}
+		OBJGeode{Name: "a", Faces: []OBJFace{[]OBJFaceVertex{OBJFaceVertex{1, 1, 1}, OBJFaceVertex{2, 1, 2}, OBJFaceVertex{3, 1, 3}}}},
+		OBJGeode{Name: "b", Faces: []OBJFace{[]OBJFaceVertex{OBJFaceVertex{1, 1, 1}, OBJFaceVertex{3, 1, 3}, OBJFaceVertex{4, 1, 4}}}}}
 	an.Vertices = []OBJVector{OBJVector{0, 0, 0}, OBJVector{0, 21, 0}, OBJVector{21, 21, 0}, OBJVector{21, 0, 0}}
 	an.Normals = []OBJNormal{OBJNormal{0, 0, 1}}
 	an.UWs = []OBJUW{OBJUW{0, 0}, OBJUW{0, 1}, OBJUW{1, 1}, OBJUW{1, 0}}
@@ -251,9 +510,9 @@ func TestObjLux(t * testing.T) {
 		t.Fatal("Expected to get 21 somewhere in there.")
 	}
 
-	chair := LUXWorld{LUXHeader{[9]float32{120, 100, 120, 0, 40, 0, 0, 1, 0}, 41.0, 150, 150, 2}, LUXSequence{LUXHeadLight, testReadObj(t, "Swivel_Chair.obj")}}
-	table := LUXWorld{LUXHeader{[9]float32{120, 100, 120, 0, 40, 0, 0, 1, 0}, 50.0, 150, 150, 2}, LUXSequence{LUXHeadLight, testReadObj(t, "Coffe-Table.obj")}}
-	bed := LUXWorld{LUXHeader{[9]float32{220, 200, 220, 0, 40, 0, 0, 1, 0}, 41.0, 150, 150, 2}, LUXSequence{LUXHeadLight, testReadObj(t, "Dalselv_Bed.obj")}}
+	chair := LUXWorld{LUXHeader{[9]float32{120, 100, 120, 0, 40, 0, 0, 1, 0}, 41.0, 150, 150, 2, LUXLens{}}, LUXSequence{LUXHeadLight, testReadObj(t, "Swivel_Chair.obj")}}
+	table := LUXWorld{LUXHeader{[9]float32{120, 100, 120, 0, 40, 0, 0, 1, 0}, 50.0, 150, 150, 2, LUXLens{}}, LUXSequence{LUXHeadLight, testReadObj(t, "Coffe-Table.obj")}}
+	bed := LUXWorld{LUXHeader{[9]float32{220, 200, 220, 0, 40, 0, 0, 1, 0}, 41.0, 150, 150, 2, LUXLens{}}, LUXSequence{LUXHeadLight, testReadObj(t, "Dalselv_Bed.obj")}}
 	renderScene(t, chair, "chair")
 	renderScene(t, table, "table")
 	renderScene(t, bed, "bed")
@@ -275,7 +534,7 @@ func testRenderOsgtLux(t * testing.T, ref, name string) {
 	files.Scan(STORE_PLACE)
 
 	walls_scene := LUXOSGTGeometry {*rd, files}
-	walls := LUXWorld{LUXHeader{[9]float32{1220, 100, 1220, 0, 0, 0, -1, 0, 0}, 31.0, 150, 150, 20}, LUXSequence{LUXHeadLight, walls_scene}}
+	walls := LUXWorld{LUXHeader{[9]float32{1220, 100, 1220, 0, 0, 0, -1, 0, 0}, 31.0, 150, 150, 20, LUXLens{}}, LUXSequence{LUXHeadLight, walls_scene}}
 	renderScene(t, walls, name)
 
 }
@@ -291,7 +550,7 @@ func TestTransformLux(t * testing.T) {
 	disk := LUXStringScene(`AttributeBegin
 		Shape "disk" "float radius" [1]
 		AttributeEnd`)
-	transform := LUXWorld{LUXHeader{[9]float32{0, 0, -1, 0, 0, 0, 0, 1, 0}, 90.0, 150, 150, 1}, LUXSequence{LUXHeadLight,
+	transform := LUXWorld{LUXHeader{[9]float32{0, 0, -1, 0, 0, 0, 0, 1, 0}, 90.0, 150, 150, 1, LUXLens{}}, LUXSequence{LUXHeadLight,
 		LUXDoTransform([16]float32{
 				0.5, 0, 0, 0,
 				0, 0.5, 0, 0,
@@ -310,10 +569,10 @@ func TestLightLux(t * testing.T) {
 			Shape "sphere" "float radius" [0.25]
 		TransformEnd`)
 
-	point_light := LUXLight{[3]float32{-1.3, -1.3, -1.3}}
-	area_light := LUXAreaLight{0.3, [3]float32{-1.3, -1.3, -1.3}}
+	point_light := LUXLight{Position: [3]float32{-1.3, -1.3, -1.3}}
+	area_light := LUXAreaLight{Size: 0.3, Position: [3]float32{-1.3, -1.3, -1.3}}
 
-	light := LUXWorld{LUXHeader{[9]float32{0, 0, -20, 0, 0, 0, 0, 1, 0}, 7.0, 100, 100, 50},
+	light := LUXWorld{LUXHeader{[9]float32{0, 0, -20, 0, 0, 0, 0, 1, 0}, 7.0, 100, 100, 50, LUXLens{}},
 		LUXSequence{area_light, disk, moon}}
 	renderScene(t, light, "light")
 	t.Log(point_light)
@@ -327,8 +586,8 @@ func TestTextureLux(t * testing.T) {
 		Shape "sphere" "float radius" [2]
 		AttributeEnd`)
 	texture := LUXNamedMaterial{"/store/sheer_a bc/CSLibrairies/Materials/FloorTexture.tga", STORE_PLACE + "/store/sheer_abc/CSLibrairies/Materials/FloorTexture.tga"}
-	light := LUXWorld{LUXHeader{[9]float32{0, 0, -1.3, 0, 0, 0, 0, 1, 0}, 90.0, 100, 100, 100},
-		LUXSequence{LUXLight{[3]float32{-0, -0, -1.3}}, texture, disk}}
+	light := LUXWorld{LUXHeader{[9]float32{0, 0, -1.3, 0, 0, 0, 0, 1, 0}, 90.0, 100, 100, 100, LUXLens{}},
+		LUXSequence{LUXLight{Position: [3]float32{-0, -0, -1.3}}, texture, disk}}
 	renderScene(t, light, "texture")
 }
 
@@ -354,7 +613,7 @@ func TestConfiguredSceneLux(t * testing.T) {
 	}
 
 
-	all := LUXSceneFull{a, *scn}	
+	all := LUXSceneFull{a, *scn, cloud.RenderSettings{Debug: true}}	
 
 	f, e := os.Create("hi.lux")
 	if e != nil {
@@ -437,6 +696,52 @@ func TestDoFindRender(t * testing.T) {
 	}
 }
 
+func TestScanner(t * testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a shell")
+	}
+	osgt, err := ioutil.ReadFile("../../../render/reference/KdlProject_design_1.osgt")
+	if err != nil {
+		t.Skip("Reference scene is not available: " + err.Error())
+	}
+	place := path.Join(os.TempDir(), fmt.Sprintf("lux_scanner%d", time.Now().UnixNano()))
+	defer fake_renderer(path.Join(place, "bin"), "echo image > \"$3.png\"\n")()
+	rescan := RescanInterval
+	RescanInterval = time.Hour // Only the one at start.
+	defer func() { RescanInterval = rescan }()
+
+	cfg := cloud.OpenConfig(path.Join(place, "store"))
+	cfg.AddMember(cloud.Member{FullName: "Tester", Login: "tester", Password: "pw"})
+	for _, scene := range []string{"hand/scene.osgt", "queued/scene.osgt"} {
+		os.MkdirAll(path.Dir(cfg.GetOsPath("tester", scene)), 0777)
+		ioutil.WriteFile(cfg.GetOsPath("tester", scene), osgt, 0666)
+	}
+	ioutil.WriteFile(cfg.GetOsPath("tester", "hand/scene.osgt" + cloud.JOB_SUFFIX), []byte{}, 0666)
+
+	go WatchAndRenderPool(cfg.TheRoot, RenderPool{1, 0})
+
+	rendered := func(scene string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if job := cfg.Jobs().Latest("tester", scene); job != nil && job.State.Final() {
+				if job.State != cloud.JobSucceeded {
+					t.Errorf("Unexpected outcome: %#v", job)
+				}
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("%s is not rendered in time", scene)
+	}
+	rendered("hand/scene.osgt")
+
+	// No rescan is due; the job wakes the scanner.
+	if _, err := cfg.Jobs().Submit("tester", "queued/scene.osgt"); err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered("queued/scene.osgt")
+}
+
 // NotTestRenderScene infinite test full cycle with markers.
 func NotTestRenderScene(t * testing.T){
 	WatchAndRender(STORE_PLACE)
@@ -0,0 +1,125 @@
+package lux
+
+/*
+
+  Truevision TGA images.
+
+  Textures of the desktop application are TGA, which the image packages do not read.
+  True-colour and grey images are read, plain or run-length encoded.
+
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+)
+
+// tga_header is the fixed start of a TGA file.
+type tga_header struct {
+	IDLength, ColorMapType, ImageType uint8
+	ColorMapStart, ColorMapLength     uint16
+	ColorMapDepth                     uint8
+	X, Y, Width, Height               uint16
+	Depth, Descriptor                 uint8
+}
+
+// DecodeTGA reads a true-colour or grey TGA image, plain or run-length encoded.
+func DecodeTGA(r io.Reader) (image.Image, error) {
+	in := bufio.NewReader(r)
+	h := tga_header{}
+	if err := binary.Read(in, binary.LittleEndian, &h); err != nil {
+		return nil, ConvertError{"Unable to read TGA header", err}
+	}
+	grey, rle := false, false
+	switch h.ImageType {
+	case 2:
+	case 3:
+		grey = true
+	case 10:
+		rle = true
+	case 11:
+		grey, rle = true, true
+	default:
+		return nil, ConvertError{"Only true-colour and grey TGA images are supported", nil}
+	}
+	size := int(h.Depth) / 8
+	if (grey && size != 1) || (!grey && size != 3 && size != 4) || h.ColorMapType != 0 {
+		return nil, ConvertError{"Unsupported TGA pixel depth", nil}
+	}
+	if _, err := in.Discard(int(h.IDLength)); err != nil {
+		return nil, ConvertError{"Truncated TGA image", err}
+	}
+
+	width, height := int(h.Width), int(h.Height)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	pixel := make([]byte, size)
+	repeat, literal := 0, 0
+	for i := 0; i < width*height; i++ {
+		if rle && repeat == 0 && literal == 0 {
+			packet, err := in.ReadByte()
+			if err != nil {
+				return nil, ConvertError{"Truncated TGA image", err}
+			}
+			if packet&0x80 != 0 {
+				repeat = int(packet&0x7f) + 1
+				if _, err := io.ReadFull(in, pixel); err != nil {
+					return nil, ConvertError{"Truncated TGA image", err}
+				}
+			} else {
+				literal = int(packet) + 1
+			}
+		}
+		switch {
+		case repeat > 0:
+			repeat--
+		default:
+			if _, err := io.ReadFull(in, pixel); err != nil {
+				return nil, ConvertError{"Truncated TGA image", err}
+			}
+			if literal > 0 {
+				literal--
+			}
+		}
+
+		x, y := i%width, i/width
+		if h.Descriptor&0x10 != 0 { // Right to left.
+			x = width - 1 - x
+		}
+		if h.Descriptor&0x20 == 0 { // Bottom up.
+			y = height - 1 - y
+		}
+		c := color.NRGBA{A: 255}
+		switch size {
+		case 1:
+			c.R, c.G, c.B = pixel[0], pixel[0], pixel[0]
+		case 4:
+			c.A = pixel[3]
+			fallthrough
+		default:
+			c.R, c.G, c.B = pixel[2], pixel[1], pixel[0]
+		}
+		img.SetNRGBA(x, y, c)
+	}
+	return img, nil
+}
+
+// write_tga writes an uncompressed true-colour TGA.
+func write_tga(w io.Writer, img *image.RGBA) error {
+	size := img.Bounds().Size()
+	h := tga_header{ImageType: 2, Width: uint16(size.X), Height: uint16(size.Y), Depth: 24, Descriptor: 0x20}
+	pixels := make([]byte, 0, size.X*size.Y*3)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			c := img.RGBAAt(x, y)
+			pixels = append(pixels, c.B, c.G, c.R)
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	_, err := w.Write(pixels)
+	return err
+}
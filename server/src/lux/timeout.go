@@ -0,0 +1,92 @@
+package lux
+
+import (
+	"cloud"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RenderTimedOut is returned when a render was stopped for running past its limit.
+var RenderTimedOut = RenderError{"Render took too long", nil}
+
+// Limits a render gets when its job does not tell, see DefaultTimeout.
+var (
+	TimeoutBase      = 5 * time.Minute // Loading the scene and writing the image.
+	TimeoutMax       = 12 * time.Hour  // Also for scenes which never halt by themselves.
+	SamplesPerSecond = 20000.0         // Slow enough for a modest machine.
+)
+
+var (
+	lux_resolution = regexp.MustCompile(`"integer ([xy])resolution"\s*\[\s*(\d+)\s*\]`)
+	lux_halt_time  = regexp.MustCompile(`"integer halttime"\s*\[\s*(\d+)\s*\]`)
+)
+
+// DefaultTimeout guesses how long rendering a scene file may take from its resolution and quality:
+// TimeoutBase and the samples asked for at SamplesPerSecond, at most TimeoutMax.
+func DefaultTimeout(scene string) time.Duration {
+	data, err := ioutil.ReadFile(scene)
+	if err != nil {
+		return TimeoutMax
+	}
+	if found := lux_halt_time.FindSubmatch(data); found != nil {
+		seconds, _ := strconv.Atoi(string(found[1]))
+		return limit_timeout(TimeoutBase + time.Duration(seconds)*time.Second)
+	}
+	halt := HaltSamplesPerPixel(scene)
+	if halt == 0 {
+		return TimeoutMax
+	}
+	pixels := 1.0
+	for _, found := range lux_resolution.FindAllSubmatch(data, 2) {
+		side, _ := strconv.Atoi(string(found[2]))
+		pixels *= float64(side)
+	}
+	seconds := pixels * float64(halt) / SamplesPerSecond
+	return limit_timeout(TimeoutBase + time.Duration(seconds*float64(time.Second)))
+}
+
+func limit_timeout(limit time.Duration) time.Duration {
+	if limit > TimeoutMax {
+		return TimeoutMax
+	}
+	return limit
+}
+
+// transient_errors are renderer messages about the machine rather than the scene.
+var transient_errors = []string{"bad_alloc", "out of memory", "no space left on device"}
+
+// Transient tells if a render failure is likely to go away when tried again, maybe elsewhere:
+// the renderer is missing, was killed by someone else, the machine ran out of resources,
+// or a texture or model of the scene is not uploaded yet.
+// Broken scenes, cancels and timeouts are not.
+func Transient(err error, progress cloud.JobProgress) bool {
+	switch failure := err.(type) {
+	case nil:
+		return false
+	case MissingFile:
+		return true
+	case RenderError:
+		return Transient(failure.CausedBy, progress)
+	case ConvertError:
+		return Transient(failure.CausedBy, progress)
+	case *exec.Error:
+		return true
+	case *exec.ExitError:
+		if failure.ExitCode() == -1 { // Killed by a signal.
+			return true
+		}
+	}
+	for _, message := range progress.Errors {
+		message = strings.ToLower(message)
+		for _, known := range transient_errors {
+			if strings.Contains(message, known) {
+				return true
+			}
+		}
+	}
+	return false
+}
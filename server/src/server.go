@@ -6,13 +6,18 @@
   Server:   serving files from file system.
   Renderer: (-scan) scanning file system for requests to render.
 
+  Any arguments after the flags are administrative subcommands, see admin.go.
+
 */
 
 package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"path"
 	"lux"
 	"cloud"
 )
@@ -22,25 +27,92 @@ var ui_base = flag.String("ui", "./ui", "UI files location")
 var port = flag.String("port", "8080", "Port to bind to")
 var show_version = flag.Bool("version", false, "Show the version of the cloud")
 var do_scan = flag.Bool("scan", false, "Scanner mode")
+var slots = flag.Int("slots", 1, "Renders running at once in scanner or node mode")
+var threads = flag.Int("threads", 0, "CPU threads per render in scanner or node mode, 0 lets luxconsole decide")
+var node_server = flag.String("node", "", "Render node mode: URL of the server to render for")
+var node_name = flag.String("name", "", "Name of the render node, as added with 'node add'")
+var node_token = flag.String("token", "", "Token of the render node")
+var node_work = flag.String("work", "./work", "Local folder for jobs of the render node")
+var node_ca = flag.String("ca", "", "Certificate the render node trusts, such as the self-signed one of the server")
+var cert_file = flag.String("cert", "", "TLS certificate; HTTPS is served when given with -key")
+var key_file = flag.String("key", "", "TLS private key")
+var self_signed = flag.Bool("selfsigned", false, "Generate self-signed -cert and -key if they are missing")
+var redirect_port = flag.String("redirect", "", "Port to redirect plain HTTP from, when serving HTTPS")
+var retries = flag.Int("retries", cloud.Retry.Attempts, "Attempts at a job failing for passing reasons, such as a killed renderer")
+var backoff = flag.Duration("backoff", cloud.Retry.Backoff, "Wait before retrying a failed job, multiplied by -factor with each further attempt")
+var factor = flag.Float64("factor", cloud.Retry.Factor, "Growth of the wait before each further retry")
+var max_backoff = flag.Duration("maxbackoff", cloud.Retry.MaxBackoff, "Longest wait before retrying a failed job, 0 for no limit")
+var renderer = flag.String("renderer", lux.TheRenderer.Name(), "Renderer in scanner or node mode: luxconsole, or fake to try the pipeline without it")
+var network = flag.String("net", "tcp4", "Network to listen on: tcp4, tcp6 or tcp for both")
+var private_hooks = flag.Bool("privatehooks", false, "Let webhooks post to loopback, link-local and private addresses")
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [subcommand]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(os.Stderr, admin_usage)
+	}
 	flag.Parse()
 	if *show_version {
 		log.Print("Cloud version is " + cloud.Version)
 		return
 	}
 
+	cloud.Retry = cloud.RetryPolicy{Attempts: *retries, Backoff: *backoff, Factor: *factor, MaxBackoff: *max_backoff}
+	cloud.HookPrivate = *private_hooks
+
+	if flag.NArg() > 0 {
+		if err := admin(*storage_base, flag.Args()); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
 	if *do_scan {
+		if err := lux.UseRenderer(*renderer); err != nil {
+			log.Fatal(err.Error())
+		}
 		if err := lux.CheckLux(); err != nil {
-			log.Fatal("luxconsole seem to not exist or absent from PATH");
+			log.Fatal(*renderer + " is not able to run: " + err.Error())
 		}
 		log.Print("Scanning mode at " + *storage_base)
-		lux.WatchAndRender(*storage_base)
+		lux.WatchAndRenderPool(*storage_base, lux.RenderPool{Slots: *slots, Threads: *threads})
 		return
 	}
+	if *node_server != "" {
+		if err := lux.UseRenderer(*renderer); err != nil {
+			log.Fatal(err.Error())
+		}
+		if err := lux.CheckLux(); err != nil {
+			log.Fatal(*renderer + " is not able to run: " + err.Error())
+		}
+		client, err := cloud.NewNodeClient(*node_server, *node_name, *node_token, *node_ca)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		node := &lux.RenderNode{Client: client, Pool: lux.RenderPool{Slots: *slots, Threads: *threads}, Work: *node_work}
+		log.Fatal(node.Run().Error())
+	}
 	log.Print("Port: " + *port)
 	log.Print("Data: ", *storage_base)
 	log.Print("Static: " + *ui_base)
 	cloud.Configure(*storage_base) // Test users
-	cloud.Serve(*port, *ui_base)
+	if *self_signed && *cert_file == "" && *key_file == "" {
+		*cert_file, *key_file = path.Join(*storage_base, "cert.pem"), path.Join(*storage_base, "key.pem")
+	}
+	if *cert_file != "" {
+		log.Print("Certificate: " + *cert_file)
+	}
+	err := cloud.ServeWith(cloud.ServeOptions{
+		Port:         *port,
+		Static:       *ui_base,
+		Network:      *network,
+		CertFile:     *cert_file,
+		KeyFile:      *key_file,
+		SelfSigned:   *self_signed,
+		RedirectPort: *redirect_port,
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 }